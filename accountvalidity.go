@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// How often users are checked for the start and end of their validity
+const accountValidityInterval = time.Minute
+
+// outsideValidity returns why a user can't be used at now, outside of its
+// validFrom and validUntil, or "". An invalid date is taken as outside.
+func (u configUser) outsideValidity(now time.Time) string {
+	if len(u.ValidFrom) > 0 {
+		if from, err := parseConfigTime(u.ValidFrom); err != nil || now.Before(from) {
+			return "not valid yet"
+		}
+	}
+	if len(u.ValidUntil) > 0 {
+		if until, err := parseConfigTime(u.ValidUntil); err != nil || !now.Before(until) {
+			return "expired"
+		}
+	}
+	return ""
+}
+
+// active reports whether a user is enabled and valid at now
+func (u configUser) active(now time.Time) bool {
+	return !u.Disabled && len(u.outsideValidity(now)) == 0
+}
+
+// shadowExpire returns the shadowExpire of a user in days since 1970-01-01:
+// 1 for a user that isn't active, the day of its validUntil, or 0 without
+// one
+func (u configUser) shadowExpire(now time.Time) int {
+	if !u.active(now) {
+		return 1
+	}
+	if until, err := parseConfigTime(u.ValidUntil); err == nil {
+		return epochDays(until)
+	}
+	return 0
+}
+
+// checkAccountValidity checks the validity of a user for checkConfig
+func checkAccountValidity(u *configUser, problem func(key, format string, args ...interface{})) {
+	for _, setting := range []struct{ name, value string }{{"validFrom", u.ValidFrom}, {"validUntil", u.ValidUntil}} {
+		if _, err := parseConfigTime(setting.value); err != nil && len(setting.value) > 0 {
+			problem(setting.name, "user '%s': invalid %s '%s': please use RFC 3339 or YYYY-MM-DD", u.CommonName, setting.name, setting.value)
+		}
+	}
+	from, errFrom := parseConfigTime(u.ValidFrom)
+	until, errUntil := parseConfigTime(u.ValidUntil)
+	if errFrom == nil && errUntil == nil && !from.Before(until) {
+		problem("validUntil", "user '%s': validUntil '%s' is not after validFrom '%s'", u.CommonName, u.ValidUntil, u.ValidFrom)
+	}
+}
+
+// watchAccountValidity logs users of the backend as they become valid, or
+// expire, without a reload
+func watchAccountValidity(backend Backend) {
+	valid := map[string]bool{}
+	logValidityChanges(backend, valid, true)
+	ticker := time.NewTicker(accountValidityInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		logValidityChanges(backend, valid, false)
+	}
+}
+
+// logValidityChanges logs the users whose validity changed since the last
+// check, as recorded in valid by lower-case name
+func logValidityChanges(backend Backend, valid map[string]bool, initial bool) {
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, u := range directoryUsers(backend) {
+		if len(u.ValidFrom) == 0 && len(u.ValidUntil) == 0 {
+			continue
+		}
+		name := strings.ToLower(u.CommonName)
+		seen[name] = true
+		outside := u.outsideValidity(now)
+		was, known := valid[name]
+		valid[name] = len(outside) == 0
+		if initial || !known || was == valid[name] {
+			continue
+		}
+		if valid[name] {
+			log.Noticef("User '%s' is valid from %s", u.CommonName, u.ValidFrom)
+		} else if outside == "expired" {
+			log.Noticef("User '%s' expired at %s: binds are refused", u.CommonName, u.ValidUntil)
+		}
+	}
+	for name := range valid {
+		if !seen[name] {
+			delete(valid, name)
+		}
+	}
+}
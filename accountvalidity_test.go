@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metala/ldap"
+)
+
+func TestOutsideValidity(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		user         configUser
+		outside      string
+		shadowExpire int
+	}{
+		{"no window", configUser{}, "", 0},
+		{"within", configUser{ValidFrom: "2025-06-01", ValidUntil: "2025-07-01T00:00:00Z"}, "", epochDays(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC))},
+		{"from now", configUser{ValidFrom: "2025-06-15T12:00:00Z"}, "", 0},
+		{"not valid yet", configUser{ValidFrom: "2025-06-16"}, "not valid yet", 1},
+		{"until now", configUser{ValidUntil: "2025-06-15T12:00:00Z"}, "expired", 1},
+		{"expired", configUser{ValidFrom: "2025-01-01", ValidUntil: "2025-06-01"}, "expired", 1},
+		{"time zone", configUser{ValidUntil: "2025-06-15T13:00:00+02:00"}, "expired", 1},
+		{"invalid validFrom", configUser{ValidFrom: "soon"}, "not valid yet", 1},
+		{"invalid validUntil", configUser{ValidUntil: "2025-06-31"}, "expired", 1},
+		{"disabled", configUser{Disabled: true, ValidUntil: "2026-01-01"}, "", 1},
+	}
+	for _, test := range tests {
+		if outside := test.user.outsideValidity(now); outside != test.outside {
+			t.Errorf("%s: outside %q, want %q", test.name, outside, test.outside)
+		}
+		if shadowExpire := test.user.shadowExpire(now); shadowExpire != test.shadowExpire {
+			t.Errorf("%s: shadowExpire %d, want %d", test.name, shadowExpire, test.shadowExpire)
+		}
+	}
+}
+
+func TestCheckAccountValidity(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     configUser
+		problems []string
+	}{
+		{"valid", configUser{ValidFrom: "2025-01-01", ValidUntil: "2025-12-31T23:59:59Z"}, nil},
+		{"invalid validFrom", configUser{ValidFrom: "next monday"}, []string{"validFrom: user 'alice': invalid validFrom 'next monday'"}},
+		{"invalid validUntil", configUser{ValidUntil: "2025-02-30"}, []string{"validUntil: user 'alice': invalid validUntil '2025-02-30'"}},
+		{"empty window", configUser{ValidFrom: "2025-06-01", ValidUntil: "2025-06-01"}, []string{"validUntil: user 'alice': validUntil '2025-06-01' is not after validFrom '2025-06-01'"}},
+		{"reversed window", configUser{ValidFrom: "2025-06-01", ValidUntil: "2025-01-01"}, []string{"validUntil: user 'alice': validUntil '2025-01-01' is not after validFrom '2025-06-01'"}},
+	}
+	for _, test := range tests {
+		test.user.CommonName = "alice"
+		problems := []string{}
+		checkAccountValidity(&test.user, func(key, format string, args ...interface{}) {
+			problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+		})
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: problems %q, want %q", test.name, problems, test.problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.HasPrefix(problem, test.problems[i]) {
+				t.Errorf("%s: problem %q, want %q", test.name, problem, test.problems[i])
+			}
+		}
+	}
+}
+
+func TestBindAccountValidity(t *testing.T) {
+	audit := captureAudit(t)
+	now := time.Now().UTC()
+	h := newTestHandler(&config{Users: []configUser{
+		{CommonName: "current", UserPassword: testPasswordHash, ValidFrom: now.AddDate(0, 0, -1).Format(time.RFC3339), ValidUntil: now.AddDate(0, 0, 1).Format(time.RFC3339)},
+		{CommonName: "future", UserPassword: testPasswordHash, ValidFrom: now.AddDate(0, 0, 1).Format("2006-01-02")},
+		{CommonName: "past", UserPassword: testPasswordHash, ValidUntil: now.Add(-time.Minute).Format(time.RFC3339)},
+		{CommonName: "invalid", UserPassword: testPasswordHash, ValidUntil: "someday"},
+		// disabled comes first
+		{CommonName: "disabled", UserPassword: testPasswordHash, Disabled: true, ValidUntil: "2000-01-01"},
+	}})
+	tests := []struct {
+		user    string
+		outcome string
+		reason  string
+	}{
+		{"current", bindOutcomeSuccess, ""},
+		{"future", bindOutcomeAccountInactive, "account not valid yet"},
+		{"past", bindOutcomeAccountInactive, "account expired"},
+		{"invalid", bindOutcomeAccountInactive, "account expired"},
+		{"disabled", bindOutcomeAccountDisabled, "account disabled"},
+	}
+	for _, test := range tests {
+		// refused whatever the password
+		for _, password := range []string{"secret", "guess"} {
+			outcome, reason := test.outcome, test.reason
+			if outcome == bindOutcomeSuccess && password != "secret" {
+				outcome, reason = bindOutcomeBadPassword, "invalid password"
+			}
+			result, rec := bind(t, h, audit, userDN(test.user), password, newTestConn(t))
+			if (result == ldap.LDAPResultSuccess) != (outcome == bindOutcomeSuccess) || rec.Outcome != outcome || rec.Reason != reason {
+				t.Errorf("%s with %q: %d %+v, want outcome %q reason %q", test.user, password, result, rec, outcome, reason)
+			}
+		}
+	}
+}
+
+func TestLogValidityChanges(t *testing.T) {
+	now := time.Now().UTC()
+	h := newTestHandler(&config{Users: []configUser{
+		{CommonName: "Alice", ValidFrom: now.AddDate(0, 0, -1).Format(time.RFC3339)},
+		{CommonName: "bob", ValidUntil: now.AddDate(0, 0, -1).Format(time.RFC3339)},
+		{CommonName: "carol"},
+	}})
+	// as recorded by the previous check: alice wasn't valid yet, and dave was
+	// removed since
+	valid := map[string]bool{"alice": false, "dave": true}
+	logValidityChanges(h, valid, false)
+	want := map[string]bool{"alice": true, "bob": false}
+	if fmt.Sprint(valid) != fmt.Sprint(want) {
+		t.Errorf("valid %v, want %v", valid, want)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often the last use of an app password is saved to the state file; a
+// client that binds every minute doesn't need a write every minute
+const appPasswordUseInterval = 10 * time.Minute
+
+// appPasswordInfo is an app password as listed by the admin interface,
+// without its hash
+type appPasswordInfo struct {
+	User      string     `json:"user"`
+	Name      string     `json:"name"`
+	Created   string     `json:"created,omitempty"`
+	Expires   string     `json:"expires,omitempty"`
+	Expired   bool       `json:"expired"`
+	Sources   []string   `json:"sources,omitempty"`
+	Listeners []string   `json:"listeners,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+// parseConfigTime parses a timestamp of the config, in RFC 3339 or as a date
+func parseConfigTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// expired reports whether an app password expired at now
+func (a configUserAppPassword) expired(now time.Time) bool {
+	if len(a.Expires) == 0 {
+		return false
+	}
+	expires, err := parseConfigTime(a.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+// refusal returns why an app password may not be used on conn, or ""
+func (a configUserAppPassword) refusal(conn net.Conn) string {
+	if a.expired(time.Now()) {
+		return "expired"
+	}
+	if len(a.Sources) > 0 {
+		ip, _ := connSource(conn)
+		if !matchSource(a.Sources, net.ParseIP(ip)) {
+			return "not allowed from this source"
+		}
+	}
+	if len(a.Listeners) > 0 {
+		if _, listener := connInfo(conn); findIndex(a.Listeners, listener) == -1 {
+			return "not allowed on this listener"
+		}
+	}
+	return ""
+}
+
+// directoryUsers returns the users a backend serves
+func directoryUsers(b Backend) []configUser {
+	switch h := b.(type) {
+	case *reloadableBackend:
+		return directoryUsers(h.backend())
+	case *sqlHandler:
+		return directoryUsers(h.handler())
+	case configHandler:
+		return h.cfg.Users
+	}
+	return nil
+}
+
+// serveAppPasswords lists the app passwords on GET, only those of a user
+// with /app-passwords?user=<name>
+func serveAppPasswords(w http.ResponseWriter, r *http.Request, backend Backend) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		serveJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	user := r.URL.Query().Get("user")
+	now := time.Now()
+	infos := []appPasswordInfo{}
+	for _, u := range directoryUsers(backend) {
+		if len(user) > 0 && !strings.EqualFold(u.CommonName, user) {
+			continue
+		}
+		for _, a := range u.AppPasswords {
+			info := appPasswordInfo{
+				User:      u.CommonName,
+				Name:      a.Name,
+				Created:   a.Created,
+				Expires:   a.Expires,
+				Expired:   a.expired(now),
+				Sources:   a.Sources,
+				Listeners: a.Listeners,
+			}
+			if lastUsed := otpStates.appPasswordLastUsed(u.CommonName, a.Name); !lastUsed.IsZero() {
+				info.LastUsed = &lastUsed
+			}
+			infos = append(infos, info)
+		}
+	}
+	json.NewEncoder(w).Encode(infos)
+}
+
+// checkAppPasswords checks the app passwords of a user for checkConfig
+func checkAppPasswords(u *configUser, problem func(format string, args ...interface{})) {
+	names := map[string]bool{}
+	for j, a := range u.AppPasswords {
+		switch {
+		case len(a.Name) == 0:
+			problem("user '%s': appPasswords #%d has no name", u.CommonName, j)
+		case names[strings.ToLower(a.Name)]:
+			problem("user '%s': appPasswords name '%s' is used twice", u.CommonName, a.Name)
+		}
+		names[strings.ToLower(a.Name)] = true
+		if _, _, _, err := parsePassword(a.Password); err != nil {
+			problem("user '%s': invalid password of app password '%s': %s", u.CommonName, a.Name, err.Error())
+		}
+		for _, setting := range []struct{ name, value string }{{"created", a.Created}, {"expires", a.Expires}} {
+			if _, err := parseConfigTime(setting.value); err != nil && len(setting.value) > 0 {
+				problem("user '%s': invalid %s '%s' of app password '%s': please use RFC 3339 or YYYY-MM-DD", u.CommonName, setting.name, setting.value, a.Name)
+			}
+		}
+		for _, source := range a.Sources {
+			if _, err := parseSource(source); err != nil {
+				problem("user '%s': invalid source '%s' of app password '%s': please use an IP address or CIDR", u.CommonName, source, a.Name)
+			}
+		}
+	}
+}
+
+// generateAppPassword runs the generate-app-password command, which prints a
+// new app password, with the settings to add to a user
+func generateAppPassword(args map[string]interface{}) error {
+	name := args["<name>"].(string)
+	expires, _ := args["--expires"].(string)
+	if _, err := parseConfigTime(expires); err != nil && len(expires) > 0 {
+		return fmt.Errorf("Invalid --expires '%s': please use RFC 3339 or YYYY-MM-DD", expires)
+	}
+	password, err := randomCode(4, 5)
+	if err != nil {
+		return err
+	}
+	hash, err := hashUserPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("App password: %s\n\n", password)
+	fmt.Printf("Add to the user:\n  [[users.appPasswords]]\n    name = %s\n    password = %s\n    created = %s\n",
+		tomlString(name), tomlString(hash), tomlString(time.Now().UTC().Format(time.RFC3339)))
+	if len(expires) > 0 {
+		fmt.Printf("    expires = %s\n", tomlString(expires))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/metala/ldap"
+)
+
+// appPasswordsConfig has alice with an app password of each kind; each one's
+// password is its name followed by "-pw"
+func appPasswordsConfig(t *testing.T) *config {
+	appPassword := func(a configUserAppPassword) configUserAppPassword {
+		hash, err := hashUserPassword(a.Name + "-pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Password = hash
+		return a
+	}
+	legacy := sha256.Sum256([]byte("legacy-pw"))
+	return &config{Users: []configUser{{
+		CommonName:   "alice",
+		UserPassword: testPasswordHash,
+		AppPasswords: []configUserAppPassword{
+			appPassword(configUserAppPassword{Name: "mail", Created: "2024-01-01"}),
+			appPassword(configUserAppPassword{Name: "old", Expires: "2000-01-01"}),
+			appPassword(configUserAppPassword{Name: "office", Sources: []string{"198.51.100.0/24"}}),
+			appPassword(configUserAppPassword{Name: "secure", Listeners: []string{"ldaps"}}),
+			appPassword(configUserAppPassword{Name: "scoped", Expires: "2999-01-01T00:00:00Z", Sources: []string{"192.0.2.0/24"}, Listeners: []string{"test"}}),
+		},
+		PassAppSHA256: []string{hex.EncodeToString(legacy[:])},
+	}}}
+}
+
+func TestBindAppPasswords(t *testing.T) {
+	useOTPStateFile(t)
+	audit := captureAudit(t)
+	h := newTestHandler(appPasswordsConfig(t))
+
+	// test connections come from 192.0.2.1, on the listener "test"
+	tests := []struct {
+		name        string
+		password    string
+		outcome     string
+		reason      string
+		device      string
+		appPassword int // the index of a legacy app password, -1 for none
+	}{
+		{"named", "mail-pw", bindOutcomeAppPassword, "", "mail", -1},
+		{"expired", "old-pw", bindOutcomeAppPasswordDenied, "app password expired", "old", -1},
+		{"from another source", "office-pw", bindOutcomeAppPasswordDenied, "app password not allowed from this source", "office", -1},
+		{"on another listener", "secure-pw", bindOutcomeAppPasswordDenied, "app password not allowed on this listener", "secure", -1},
+		{"scoped", "scoped-pw", bindOutcomeAppPassword, "", "scoped", -1},
+		{"legacy", "legacy-pw", bindOutcomeAppPassword, "", "", 0},
+		{"password", "secret", bindOutcomeSuccess, "", "", -1},
+		{"wrong password", "unknown-pw", bindOutcomeBadPassword, "invalid password", "", -1},
+	}
+	for _, test := range tests {
+		result, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		appPassword := -1
+		if rec.AppPassword != nil {
+			appPassword = *rec.AppPassword
+		}
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess || test.outcome == bindOutcomeAppPassword) ||
+			rec.Outcome != test.outcome || rec.Reason != test.reason || rec.Device != test.device || appPassword != test.appPassword {
+			t.Errorf("%s: %d %+v, want outcome %q reason %q device %q", test.name, result, rec, test.outcome, test.reason, test.device)
+		}
+	}
+
+	for name, used := range map[string]bool{"mail": true, "scoped": true, "old": false, "office": false} {
+		if lastUsed := otpStates.appPasswordLastUsed("alice", name); lastUsed.IsZero() == used {
+			t.Errorf("%s: last used %v", name, lastUsed)
+		}
+	}
+}
+
+func TestCheckAppPasswords(t *testing.T) {
+	tests := []struct {
+		name         string
+		appPasswords []configUserAppPassword
+		problems     []string
+	}{
+		{"valid", []configUserAppPassword{{Name: "mail", Password: testPasswordHash, Created: "2024-01-01", Expires: "2025-01-01T00:00:00Z", Sources: []string{"192.0.2.0/24"}}}, nil},
+		{"no name", []configUserAppPassword{{Password: testPasswordHash}}, []string{"user 'alice': appPasswords #0 has no name"}},
+		{"name used twice", []configUserAppPassword{{Name: "mail", Password: testPasswordHash}, {Name: "Mail", Password: testPasswordHash}}, []string{"user 'alice': appPasswords name 'Mail' is used twice"}},
+		{"invalid password", []configUserAppPassword{{Name: "mail", Password: "plain"}}, []string{"user 'alice': invalid password of app password 'mail': "}},
+		{"invalid expires", []configUserAppPassword{{Name: "mail", Password: testPasswordHash, Expires: "next year"}}, []string{"user 'alice': invalid expires 'next year' of app password 'mail'"}},
+		{"invalid source", []configUserAppPassword{{Name: "mail", Password: testPasswordHash, Sources: []string{"office"}}}, []string{"user 'alice': invalid source 'office' of app password 'mail'"}},
+	}
+	for _, test := range tests {
+		problems := []string{}
+		checkAppPasswords(&configUser{CommonName: "alice", AppPasswords: test.appPasswords}, func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		})
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: problems %q, want %q", test.name, problems, test.problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.HasPrefix(problem, test.problems[i]) {
+				t.Errorf("%s: problem %q, want %q", test.name, problem, test.problems[i])
+			}
+		}
+	}
+}
+
+func TestServeAppPasswords(t *testing.T) {
+	cfg := appPasswordsConfig(t)
+	cfg.Users = append(cfg.Users, configUser{CommonName: "bob", AppPasswords: []configUserAppPassword{{Name: "mail", Password: testPasswordHash}}})
+	h := newTestHandler(cfg)
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"alice/mail", "alice/old (expired)", "alice/office", "alice/secure", "alice/scoped", "bob/mail"}},
+		{"?user=BOB", []string{"bob/mail"}},
+		{"?user=carol", []string{}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		serveAppPasswords(w, httptest.NewRequest(http.MethodGet, "/app-passwords"+test.query, nil), h)
+		if strings.Contains(w.Body.String(), "$") || strings.Contains(w.Body.String(), "{SSHA") {
+			t.Errorf("%s: password hashes listed: %s", test.query, w.Body.String())
+		}
+		infos := []appPasswordInfo{}
+		if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, info := range infos {
+			name := info.User + "/" + info.Name
+			if info.Expired {
+				name += " (expired)"
+			}
+			names = append(names, name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("%s: %v, want %v", test.query, names, test.names)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveAppPasswords(w, httptest.NewRequest(http.MethodDelete, "/app-passwords", nil), h)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: %d", w.Code)
+	}
+}
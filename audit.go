@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/metala/ldap"
+	"github.com/op/go-logging"
+)
+
+const auditModule = programName + "-audit"
+
+// auditLog is nil unless the audit stream is enabled
+var auditLog *logging.Logger
+
+// auditRecord is a single line of the audit stream. It must never carry
+// passwords, OTP values or other secrets.
+type auditRecord struct {
+	Time       string `json:"time"`
+	Operation  string `json:"op"`
+	ConnID     uint64 `json:"connId"`
+	Listener   string `json:"listener,omitempty"`
+	SourceIP   string `json:"sourceIp,omitempty"`
+	SourcePort string `json:"sourcePort,omitempty"`
+	BindDN     string `json:"bindDn,omitempty"`
+	User       string `json:"user,omitempty"`
+	// Bind
+	Factors     []string `json:"factors,omitempty"`
+	AppPassword *int     `json:"appPassword,omitempty"`
+	Device      string   `json:"device,omitempty"` // the TOTP secret or Yubikey
+	Policy      string   `json:"policy,omitempty"` // the bind policy applied
+	// Search
+	BaseDN  string `json:"baseDn,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	AuthzDN string `json:"authzDn,omitempty"` // proxied authorization
+	// Add, Modify, Delete, ModifyDN and Compare
+	DN        string `json:"dn,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	// Outcome
+	ResultCode ldap.LDAPResultCode `json:"resultCode"`
+	Result     string              `json:"result"`
+	Outcome    string              `json:"outcome,omitempty"`
+	Reason     string              `json:"reason,omitempty"`
+}
+
+// newAuditRecord starts the audit record of an operation on a connection
+func newAuditRecord(operation, bindDN string, conn net.Conn) *auditRecord {
+	id, listener := connInfo(conn)
+	ip, port := connSource(conn)
+	return &auditRecord{
+		Operation:  operation,
+		ConnID:     id,
+		Listener:   listener,
+		SourceIP:   ip,
+		SourcePort: port,
+		BindDN:     bindDN,
+	}
+}
+
+// fail records why an operation was rejected
+func (r *auditRecord) fail(outcome, reason string) {
+	r.Outcome = outcome
+	r.Reason = reason
+}
+
+// write completes the record with its result and emits it
+func (r *auditRecord) write(resultCode ldap.LDAPResultCode) {
+	if auditLog == nil {
+		return
+	}
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	r.ResultCode = resultCode
+	r.Result = ldap.LDAPResultCodeMap[resultCode]
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Unable to encode audit record: %s", err.Error())
+		return
+	}
+	auditLog.Notice(string(line))
+}
+
+// enableAudit opens the audit stream: "stdout", "stderr", "syslog" or a file path
+func enableAudit(auditConfig *configAudit) error {
+	var backend logging.Backend
+	switch auditConfig.Output {
+	case "", "stdout":
+		backend = logging.NewLogBackend(os.Stdout, "", 0)
+	case "stderr":
+		backend = logging.NewLogBackend(os.Stderr, "", 0)
+	case "syslog":
+		syslogBackend, err := logging.NewSyslogBackend(auditModule)
+		if err != nil {
+			return err
+		}
+		backend = syslogBackend
+	default:
+		f, err := os.OpenFile(auditConfig.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("Unable to open audit log: %s", err.Error())
+		}
+		backend = logging.NewLogBackend(f, "", 0)
+	}
+
+	leveled := logging.AddModuleLevel(logging.NewBackendFormatter(backend, logging.MustStringFormatter("%{message}")))
+	leveled.SetLevel(logging.NOTICE, auditModule)
+	auditLog = logging.MustGetLogger(auditModule)
+	auditLog.SetBackend(leveled)
+	log.Noticef("Audit log enabled (%s)", auditConfig.Output)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/metala/ldap"
+)
+
+func TestAuditRecords(t *testing.T) {
+	h := newTestHandler(&config{Users: []configUser{{CommonName: "alice", UserPassword: testPasswordHash}}})
+	search := func(boundDN, filter string) func(conn testConn) {
+		return func(conn testConn) {
+			h.Search(boundDN, ldap.SearchRequest{BaseDN: testBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: filter}, conn)
+		}
+	}
+	tests := []struct {
+		name string
+		op   func(conn testConn)
+		want auditRecord
+	}{
+		{
+			name: "bind",
+			op:   func(conn testConn) { h.Bind(userDN("alice"), "secret", conn) },
+			want: auditRecord{Operation: "bind", BindDN: userDN("alice"), User: "alice", Factors: []string{"password"}, Result: "Success", Outcome: bindOutcomeSuccess},
+		},
+		{
+			name: "failed bind",
+			op:   func(conn testConn) { h.Bind(userDN("alice"), "guess", conn) },
+			want: auditRecord{Operation: "bind", BindDN: userDN("alice"), User: "alice", ResultCode: ldap.LDAPResultInvalidCredentials, Result: "Invalid Credentials", Outcome: bindOutcomeBadPassword, Reason: "invalid password"},
+		},
+		{
+			name: "unknown user",
+			op:   func(conn testConn) { h.Bind(userDN("mallory"), "secret", conn) },
+			want: auditRecord{Operation: "bind", BindDN: userDN("mallory"), ResultCode: ldap.LDAPResultInvalidCredentials, Result: "Invalid Credentials", Outcome: bindOutcomeUnknownUser, Reason: "user not found"},
+		},
+		{
+			name: "search",
+			op:   search(userDN("alice"), "(cn=alice)"),
+			want: auditRecord{Operation: "search", BindDN: userDN("alice"), BaseDN: testBaseDN, Filter: "(cn=alice)", Result: "Success"},
+		},
+		{
+			name: "anonymous search",
+			op:   search("", "(cn=alice)"),
+			want: auditRecord{Operation: "search", BaseDN: testBaseDN, Filter: "(cn=alice)", ResultCode: ldap.LDAPResultInsufficientAccessRights, Result: "Insufficient Access Rights", Reason: "Search Error: Anonymous BindDN not allowed "},
+		},
+		{
+			name: "close",
+			op:   func(conn testConn) { h.Close(userDN("alice"), conn) },
+			want: auditRecord{Operation: "close", BindDN: userDN("alice"), Result: "Success"},
+		},
+	}
+	audit := captureAudit(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newTestConn(t)
+			test.op(conn)
+			records := audit()
+			if len(records) != 1 {
+				t.Fatalf("audit %+v, want 1 record", records)
+			}
+			record := records[0]
+			if len(record.Time) == 0 || record.ConnID != conn.addr.id || record.Listener != "test" || record.SourceIP != "192.0.2.1" || record.SourcePort != "40000" {
+				t.Errorf("record %+v of connection %d", record, conn.addr.id)
+			}
+			record.Time, record.ConnID, record.Listener, record.SourceIP, record.SourcePort = "", 0, "", "", ""
+			if !reflect.DeepEqual(record, test.want) {
+				t.Errorf("record\n%+v\nwant\n%+v", record, test.want)
+			}
+		})
+	}
+}
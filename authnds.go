@@ -1,12 +1,10 @@
 package main
 
 import (
-	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"os"
 
-	"github.com/BurntSushi/toml"
-	"github.com/GeertJohan/yubigo"
 	"github.com/docopt/docopt-go"
 	"github.com/metala/ldap"
 	"github.com/op/go-logging"
@@ -18,11 +16,25 @@ var usage = `authnds: simple LDAP for auth
 
 Usage:
   authnds [options] -c /path/to/config.toml
+  authnds healthcheck [options] -c /path/to/config.toml
+  authnds check-config [options] -c /path/to/config.toml
+  authnds convert-config [options] -c /path/to/config.toml [--to <format>] [-o <file>]
+  authnds config-schema
+  authnds generate-otp hotp [--user <name>] [--name <name>]
+  authnds generate-otp recovery-codes [--count <n>]
+  authnds generate-app-password <name> [--expires <date>]
   authnds -h --help
   authnds --version
 
 Options:
-  -c, --config <file>       Config file.
+  -c, --config <file>       Config file or directory.
+  --format <format>         Config file format (toml, yaml or json), instead of the file extension.
+  --to <format>             Format to convert to, instead of the output file extension.
+  -o, --output <file>       Write the converted config to a file instead of stdout.
+  --user <name>             User of the HOTP secret, for the otpauth:// URI.
+  --name <name>             Name of the HOTP device [default: token].
+  --count <n>               Number of recovery codes [default: 10].
+  --expires <date>          Expiry of the app password, RFC 3339 or YYYY-MM-DD.
   -h, --help                Show this screen.
   --version                 Show version.
 `
@@ -31,6 +43,11 @@ Options:
 type Backend interface {
 	ldap.Binder
 	ldap.Searcher
+	ldap.Adder
+	ldap.Modifier
+	ldap.Deleter
+	ldap.ModifyDNr
+	ldap.Comparer
 	ldap.Closer
 }
 
@@ -40,109 +57,197 @@ func main() {
 	stderr := initLogging()
 	log.Debug("AP start")
 
-	cfg, err := doConfig()
-	if err != nil {
-		log.Fatalf("Configuration file error: %s", err.Error())
-	}
-	if cfg.Syslog {
-		enableSyslog(stderr)
+	args, cfg, err := doConfig()
+	if args["config-schema"].(bool) || args["convert-config"].(bool) || args["generate-otp"].(bool) || args["generate-app-password"].(bool) {
+		if err == nil {
+			err = doConfigTool(args)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
 	}
-
-	yubiAuth := (*yubigo.YubiAuth)(nil)
-	if len(cfg.YubikeyClientID) > 0 && len(cfg.YubikeySecret) > 0 {
-		yubiAuth, err = yubigo.NewYubiAuth(cfg.YubikeyClientID, cfg.YubikeySecret)
-
+	if args["healthcheck"].(bool) {
+		if err == nil {
+			format, _ := args["--format"].(string)
+			err = runHealthcheck(args["--config"].(string), format)
+		}
 		if err != nil {
-			log.Fatalf("Yubikey Auth failed")
+			log.Fatalf("Healthcheck failed: %s", err.Error())
 		}
+		return
 	}
-
-	// configure the backend
-	s := ldap.NewServer()
-	s.EnforceLDAP = true
-	if cfg.LDAPS.EnforceTLS {
-		s.EnforceTLS = true
-		cert, err := tls.LoadX509KeyPair(cfg.LDAPS.Cert, cfg.LDAPS.Key)
+	if args["check-config"].(bool) {
 		if err != nil {
-			log.Fatalf("Unable to load TLS configuration.")
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
 		}
-		s.TLSConfig = &tls.Config{
-			ServerName:   cfg.ServerName,
-			Certificates: []tls.Certificate{cert},
+		fmt.Println("Configuration OK")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Configuration file error: %s", err.Error())
+	}
+	if err := setupLogging(cfg, stderr); err != nil {
+		log.Fatalf("Logging error: %s", err.Error())
+	}
+	if cfg.Audit.Enabled {
+		if err := enableAudit(&cfg.Audit); err != nil {
+			log.Fatalf("Audit log error: %s", err.Error())
 		}
+	}
 
+	yubikey, err := newYubikeyValidator(cfg)
+	if err != nil {
+		log.Fatalf("Yubikey Auth failed: %s", err.Error())
 	}
 
-	handler := newConfigHandler(cfg, yubiAuth)
-	log.Notice("Using config backend")
-	s.BindFunc("", handler)
-	s.SearchFunc("", handler)
-	s.CloseFunc("", handler)
+	health.setYubikey(yubikey)
 
-	if cfg.LDAP.Enabled {
-		// Dont block if also starting a LDAPS server afterwards
-		shouldBlock := !cfg.LDAPS.Enabled
+	if err := otpStates.configure(&cfg.OTP); err != nil {
+		log.Fatalf("OTP state error: %s", err.Error())
+	}
 
-		if shouldBlock {
-			startLDAP(&cfg.LDAP, s)
-		} else {
-			go startLDAP(&cfg.LDAP, s)
-		}
+	backend, err := newBackend(cfg, yubikey)
+	if err != nil {
+		log.Fatalf("Backend error: %s", err.Error())
+	}
+	sessions.setTimeouts(&cfg.Sessions)
+	handler := newReloadableBackend(backend)
+	log.Noticef("Using %s backend", cfg.Backend.Datastore)
+	observeConfigReload(true)
+	reloader := newConfigReloader(cfg, handler, yubikey)
+	reloadWrittenConfig = reloader.reload
+	go reloader.run()
+	go watchAccountValidity(handler)
+
+	if cfg.HTTP.Enabled {
+		go startHTTP(&cfg.HTTP, handler)
 	}
 
-	if cfg.LDAPS.Enabled {
-		// Always block here
-		startLDAPS(&cfg.LDAPS, s)
+	errs, err := startListeners(cfg, handler)
+	if err != nil {
+		log.Fatalf("Unable to start listeners: %s", err.Error())
+	}
+	if err := <-errs; err != nil {
+		log.Fatalf("LDAP Server Failed: %s", err.Error())
 	}
 
 	log.Critical("AP exit")
 }
 
-func startLDAP(ldapConfig *configLDAP, server *ldap.Server) {
-	log.Notice(fmt.Sprintf("LDAP server listening on %s", ldapConfig.Listen))
-	if err := server.ListenAndServe(ldapConfig.Listen); err != nil {
-		log.Fatalf("LDAP Server Failed: %s", err.Error())
+// newBackend returns the handler of the configured datastore
+func newBackend(cfg *config, yubikey yubikeyValidator) (Backend, error) {
+	if cfg.Backend.Datastore == "sql" {
+		handler, err := newSQLHandler(cfg, yubikey)
+		if err != nil {
+			return nil, err
+		}
+		return handler, nil
 	}
+	return newConfigHandler(cfg, yubikey), nil
 }
 
-func startLDAPS(ldapsConfig *configLDAPS, server *ldap.Server) {
-	log.Notice(fmt.Sprintf("LDAPS server listening on %s", ldapsConfig.Listen))
-	if err := server.ListenAndServeTLS(ldapsConfig.Listen, ldapsConfig.Cert, ldapsConfig.Key); err != nil {
-		log.Fatalf("LDAP Server Failed: %s", err.Error())
+// doConfig reads the cli flags and config file
+func doConfig() (map[string]interface{}, *config, error) {
+	// parse the command-line args
+	args, err := docopt.Parse(usage, nil, true, getVersionString(), false)
+	if err != nil {
+		return args, &config{}, err
+	}
+
+	if args["config-schema"].(bool) || args["convert-config"].(bool) || args["generate-otp"].(bool) || args["generate-app-password"].(bool) ||
+		args["healthcheck"].(bool) {
+		// these only read the config file they are given, if any
+		return args, &config{}, nil
+	}
+
+	format, _ := args["--format"].(string)
+	cfg, err := loadConfig(args["--config"].(string), format)
+	return args, cfg, err
+}
+
+// doConfigTool runs the config-schema, convert-config, generate-otp and
+// generate-app-password commands
+func doConfigTool(args map[string]interface{}) error {
+	if args["generate-otp"].(bool) {
+		return generateOTP(args)
+	}
+	if args["generate-app-password"].(bool) {
+		return generateAppPassword(args)
 	}
+	if args["config-schema"].(bool) {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(configSchema())
+	}
+	format, _ := args["--format"].(string)
+	to, _ := args["--to"].(string)
+	output, _ := args["--output"].(string)
+	return convertConfig(args["--config"].(string), format, to, output)
 }
 
-// doConfig reads the cli flags and config file
-func doConfig() (*config, error) {
-	cfg := config{}
+// loadConfig reads and validates the config file, both at startup and on reload
+func loadConfig(configFile string, format string) (*config, error) {
+	return loadPendingConfig(configFile, format, nil)
+}
+
+// loadPendingConfig is loadConfig, reading the pending contents of the config
+// files they're keyed by instead of the files themselves
+func loadPendingConfig(configFile string, format string, pending map[string][]byte) (*config, error) {
+	cfg := config{pending: pending}
 	// setup defaults
 	cfg.LDAP.Enabled = false
 	cfg.LDAPS.Enabled = true
 
-	// parse the command-line args
-	args, err := docopt.Parse(usage, nil, true, getVersionString(), false)
-	if err != nil {
+	// parse the config file, or directory, and its includes
+	if err := decodeConfigFiles(&cfg, configFile, format); err != nil {
 		return &cfg, err
 	}
-
-	// parse the config file
-	if _, err := toml.DecodeFile(args["--config"].(string), &cfg); err != nil {
+	if err := expandConfig(&cfg); err != nil {
 		return &cfg, err
 	}
-	// Setup logging level
-	switch cfg.LogLevel {
-	case "debug":
-		logging.SetLevel(logging.DEBUG, programName)
-		log.Debug("Debugging enabled")
-	case "error":
-		logging.SetLevel(logging.ERROR, programName)
-	case "info":
-		logging.SetLevel(logging.INFO, programName)
-		log.Debug("Debugging enabled")
-	case "warning":
-		logging.SetLevel(logging.WARNING, programName)
+	cfg.ConfigFile = configFile
+	cfg.format = format
+
+	setLogLevel(cfg.LogLevel)
+
+	if cfg.AwsUsers.Enabled {
+		if err := loadAwsUsers(&cfg); err != nil {
+			return &cfg, err
+		}
+	}
+
+	if problems := checkConfig(&cfg); len(problems) > 0 {
+		return &cfg, problems
+	}
+
+	switch cfg.Backend.Datastore {
+	case "":
+		cfg.Backend.Datastore = "config"
+	case "config":
+	case "sql":
+		if err := validateSQLConfig(&cfg.SQL); err != nil {
+			return &cfg, err
+		}
 	default:
-		logging.SetLevel(logging.NOTICE, programName)
+		return &cfg, fmt.Errorf("Unknown datastore '%s': please use one of 'config' or 'sql'", cfg.Backend.Datastore)
+	}
+
+	if _, err := newLogFormatter(cfg.LogFormat, false); err != nil {
+		return &cfg, err
+	}
+	if cfg.RemoteSyslog.Enabled {
+		if len(cfg.RemoteSyslog.Address) == 0 {
+			return &cfg, fmt.Errorf("No remote syslog address was specified: please disable remote syslog or use the 'address' option")
+		}
+		if len(cfg.RemoteSyslog.Network) == 0 {
+			cfg.RemoteSyslog.Network = "udp"
+		}
+		if len(cfg.RemoteSyslog.Facility) == 0 {
+			cfg.RemoteSyslog.Facility = "daemon"
+		}
 	}
 
 	if len(cfg.Frontend.Listen) > 0 && (len(cfg.LDAP.Listen) > 0 || len(cfg.LDAPS.Listen) > 0) {
@@ -150,6 +255,57 @@ func doConfig() (*config, error) {
 		return &cfg, fmt.Errorf("Both old and new server-config in use - please remove old format ([frontend]) and migrate to new format ([ldap], [ldaps])")
 	}
 
+	if cfg.HTTP.CertWarningDays == 0 {
+		cfg.HTTP.CertWarningDays = defaultCertWarningDays
+	}
+	if cfg.HTTP.Enabled && len(cfg.HTTP.Listen) == 0 {
+		return &cfg, fmt.Errorf("No HTTP bind address was specified: please disable HTTP or use the 'listen' option")
+	}
+	if err := validateSessionConfig(&cfg.Sessions); err != nil {
+		return &cfg, err
+	}
+	if err := validateYubikeyConfig(&cfg); err != nil {
+		return &cfg, err
+	}
+	if err := validateOTPConfig(&cfg); err != nil {
+		return &cfg, err
+	}
+	if err := validatePushConfig(&cfg); err != nil {
+		return &cfg, err
+	}
+	if err := validateBindPolicies(&cfg); err != nil {
+		return &cfg, err
+	}
+	if err := validatePasswordPolicy(&cfg); err != nil {
+		return &cfg, err
+	}
+
+	if len(cfg.Listeners) > 0 && (len(cfg.Frontend.Listen) > 0 || len(cfg.LDAP.Listen) > 0 || len(cfg.LDAPS.Listen) > 0) {
+		// [[listeners]] replaces all of the older server-config formats
+		return &cfg, fmt.Errorf("Both [[listeners]] and [frontend], [ldap] or [ldaps] server-config in use - please migrate to [[listeners]] as-per documentation")
+	}
+
+	if len(cfg.Listeners) > 0 {
+		names := map[string]bool{}
+		for i := range cfg.Listeners {
+			l := &cfg.Listeners[i]
+			if len(l.Name) == 0 {
+				l.Name = fmt.Sprintf("listener%d", i)
+			}
+			if names[l.Name] {
+				return &cfg, fmt.Errorf("Listener name '%s' is used more than once", l.Name)
+			}
+			names[l.Name] = true
+			if len(l.Type) == 0 {
+				l.Type = "tcp"
+			}
+			if err := validateListener(l); err != nil {
+				return &cfg, err
+			}
+		}
+		return &cfg, nil
+	}
+
 	if len(cfg.Frontend.Listen) > 0 {
 		// We're going with old format - parse it into new
 		log.Warning("Config [frontend] is deprecated - please move to [ldap] and [ldaps] as-per documentation")
@@ -172,7 +328,7 @@ func doConfig() (*config, error) {
 	}
 
 	if !cfg.LDAP.Enabled && !cfg.LDAPS.Enabled {
-		return &cfg, fmt.Errorf("No server configuration found: please provide either LDAP or LDAPS configuration")
+		return &cfg, fmt.Errorf("No server configuration found: please provide [[listeners]], LDAP or LDAPS configuration")
 	}
 
 	if cfg.LDAPS.Enabled {
@@ -193,27 +349,70 @@ func doConfig() (*config, error) {
 		}
 	}
 
+	cfg.Listeners = legacyListeners(&cfg)
+
 	return &cfg, nil
 }
 
+// setLogLevel applies the logLevel option
+func setLogLevel(logLevel string) {
+	switch logLevel {
+	case "debug":
+		logging.SetLevel(logging.DEBUG, programName)
+		log.Debug("Debugging enabled")
+	case "error":
+		logging.SetLevel(logging.ERROR, programName)
+	case "info":
+		logging.SetLevel(logging.INFO, programName)
+	case "warning":
+		logging.SetLevel(logging.WARNING, programName)
+	default:
+		logging.SetLevel(logging.NOTICE, programName)
+	}
+}
+
 // initLogging sets up logging to stderr
 func initLogging() *logging.LogBackend {
-	format := "%{color}%{time:15:04:05.000000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}"
 	logBackend := logging.NewLogBackend(os.Stderr, "", 0)
 	logging.SetBackend(logBackend)
 	logging.SetLevel(logging.NOTICE, programName)
-	logging.SetFormatter(logging.MustStringFormatter(format))
+	logging.SetFormatter(logging.MustStringFormatter(textLogFormat))
 	return logBackend
 }
 
-// enableSyslog turns on syslog and turns off color
-func enableSyslog(stderrBackend *logging.LogBackend) {
-	format := "%{time:15:04:05.000000} %{shortfunc} ▶ %{level:.4s} %{id:03x} %{message}"
-	logging.SetFormatter(logging.MustStringFormatter(format))
-	syslogBackend, err := logging.NewSyslogBackend("")
+// setupLogging applies the log format and turns on local and remote syslog.
+// Color is turned off along with local syslog.
+func setupLogging(cfg *config, stderrBackend *logging.LogBackend) error {
+	formatter, err := newLogFormatter(cfg.LogFormat, !cfg.Syslog)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logging.SetFormatter(formatter)
+
+	backends := []logging.Backend{stderrBackend}
+	if cfg.Syslog {
+		syslogBackend, err := logging.NewSyslogBackend("")
+		if err != nil {
+			return err
+		}
+		backends = append(backends, syslogBackend)
+	}
+	if cfg.RemoteSyslog.Enabled {
+		remoteBackend, err := newRemoteSyslogBackend(&cfg.RemoteSyslog)
+		if err != nil {
+			return fmt.Errorf("Unable to connect to remote syslog: %s", err.Error())
+		}
+		backends = append(backends, logging.NewBackendFormatter(remoteBackend, newSyslogLogFormatter(cfg.LogFormat, formatter)))
+	}
+
+	// Replacing the backends resets the log level
+	logging.SetBackend(backends...)
+	setLogLevel(cfg.LogLevel)
+	if cfg.Syslog {
+		log.Debug("Syslog enabled")
+	}
+	if cfg.RemoteSyslog.Enabled {
+		log.Debugf("Remote syslog enabled (%s %s)", cfg.RemoteSyslog.Network, cfg.RemoteSyslog.Address)
 	}
-	logging.SetBackend(stderrBackend, syslogBackend)
-	log.Debug("Syslog enabled")
+	return nil
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultAwsRegion = "us-east-1"
+
+// awsClient makes the few S3 and SSM requests needed to load users, signed
+// with AWS Signature Version 4. Without credentials, requests are anonymous.
+type awsClient struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+	// S3 or SSM endpoint of an S3-compatible stand-in such as MinIO
+	endpoint string
+	http     *http.Client
+}
+
+// newAwsClient uses the AWS settings of the config, or else the standard
+// AWS_* environment variables
+func newAwsClient(cfg *config) *awsClient {
+	c := &awsClient{
+		accessKeyID:     cfg.AwsAccessKeyId,
+		secretAccessKey: cfg.AwsSecretAccessKey,
+		region:          cfg.AwsRegion,
+		endpoint:        strings.TrimSuffix(cfg.AwsUsers.Endpoint, "/"),
+		http:            &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(c.accessKeyID) == 0 {
+		c.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if len(c.region) == 0 {
+		c.region = os.Getenv("AWS_REGION")
+	}
+	if len(c.region) == 0 {
+		c.region = defaultAwsRegion
+	}
+	return c
+}
+
+// awsURIEncode escapes everything but the unreserved characters, as required
+// by Signature Version 4
+func awsURIEncode(s string, encodeSlash bool) string {
+	var out strings.Builder
+	for _, b := range []byte(s) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' && !encodeSlash {
+			out.WriteByte(b)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", b)
+		}
+	}
+	return out.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds a Signature Version 4 Authorization header to req, covering the
+// host and every header already set. Headers added afterwards are not signed.
+func (c *awsClient) sign(req *http.Request, service string, body []byte, now time.Time) {
+	if len(c.accessKeyID) == 0 {
+		return
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(c.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+
+	path := req.URL.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Object is the result of a conditional GetObject
+type s3Object struct {
+	data        []byte
+	etag        string
+	notModified bool
+}
+
+// getS3Object fetches an object, unless its ETag still matches etag
+func (c *awsClient) getS3Object(bucket string, key string, etag string) (*s3Object, error) {
+	// An S3-compatible stand-in is addressed path-style, AWS virtual-hosted style
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.region, awsURIEncode(key, false))
+	if len(c.endpoint) > 0 {
+		objectURL = fmt.Sprintf("%s/%s/%s", c.endpoint, bucket, awsURIEncode(key, false))
+	}
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, "s3", nil, time.Now())
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &s3Object{data: body, etag: resp.Header.Get("ETag")}, nil
+	case http.StatusNotModified:
+		return &s3Object{etag: etag, notModified: true}, nil
+	}
+	return nil, fmt.Errorf("GetObject s3://%s/%s: %s %s", bucket, key, resp.Status, awsErrorMessage(body))
+}
+
+// ssmParameter is a parameter returned by GetParameter or GetParametersByPath
+type ssmParameter struct {
+	Name    string
+	Value   string
+	Version int64
+}
+
+// ssmRequest calls an SSM action with a JSON request and decodes its response
+func (c *awsClient) ssmRequest(action string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://ssm.%s.amazonaws.com/", c.region)
+	if len(c.endpoint) > 0 {
+		endpoint = c.endpoint + "/"
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonSSM."+action)
+	c.sign(req, "ssm", body, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", action, resp.Status, awsErrorMessage(data))
+	}
+	return json.Unmarshal(data, response)
+}
+
+// getSSMParameter fetches a single, decrypted, parameter
+func (c *awsClient) getSSMParameter(name string) (*ssmParameter, error) {
+	var response struct {
+		Parameter ssmParameter
+	}
+	request := map[string]interface{}{"Name": name, "WithDecryption": true}
+	if err := c.ssmRequest("GetParameter", request, &response); err != nil {
+		return nil, err
+	}
+	return &response.Parameter, nil
+}
+
+// getSSMParametersByPath fetches every parameter below path, decrypted
+func (c *awsClient) getSSMParametersByPath(path string) ([]ssmParameter, error) {
+	parameters := []ssmParameter{}
+	nextToken := ""
+	for {
+		var response struct {
+			Parameters []ssmParameter
+			NextToken  string
+		}
+		request := map[string]interface{}{"Path": path, "Recursive": true, "WithDecryption": true}
+		if len(nextToken) > 0 {
+			request["NextToken"] = nextToken
+		}
+		if err := c.ssmRequest("GetParametersByPath", request, &response); err != nil {
+			return nil, err
+		}
+		parameters = append(parameters, response.Parameters...)
+		if nextToken = response.NextToken; len(nextToken) == 0 {
+			return parameters, nil
+		}
+	}
+}
+
+// awsErrorMessage extracts the message of an S3 (XML) or SSM (JSON) error
+func awsErrorMessage(body []byte) string {
+	text := string(body)
+	if start := strings.Index(text, "<Message>"); start >= 0 {
+		if end := strings.Index(text, "</Message>"); end > start {
+			return text[start+len("<Message>") : end]
+		}
+	}
+	var ssmError struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &ssmError) == nil && len(ssmError.Type) > 0 {
+		return strings.TrimSpace(ssmError.Type + " " + ssmError.Message)
+	}
+	return ""
+}
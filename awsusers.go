@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsDocument is a users and groups document fetched from S3 or SSM
+type awsDocument struct {
+	Name string // s3://bucket/key or ssm:<parameter name>
+	Data string
+}
+
+// awsUsersCopy is a copy of the documents of a source. Version is the ETag of
+// an S3 object, or the names and versions of SSM parameters.
+type awsUsersCopy struct {
+	Source    string
+	Version   string
+	Documents []awsDocument
+}
+
+// awsUsersSource fetches the awsUsers documents and keeps the last good copy,
+// which is used whenever the source can't be fetched or doesn't load
+type awsUsersSource struct {
+	mu       sync.Mutex
+	good     *awsUsersCopy
+	rejected string // version that failed to load
+	lastPoll time.Time
+}
+
+var awsUsers = &awsUsersSource{}
+
+// parseAwsUsersSource splits an s3://bucket/key or ssm:/name source
+func parseAwsUsersSource(source string) (service string, bucket string, name string, err error) {
+	if strings.HasPrefix(source, "ssm:") {
+		name = strings.TrimPrefix(source, "ssm:")
+		if !strings.HasPrefix(name, "/") {
+			return "", "", "", fmt.Errorf("SSM parameter '%s' must start with '/'", name)
+		}
+		return "ssm", "", name, nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme != "s3" || len(u.Host) == 0 || len(u.Path) <= 1 {
+		return "", "", "", fmt.Errorf("Unknown source '%s': please use s3://bucket/key or ssm:/parameter", source)
+	}
+	return "s3", u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// fetchAwsDocuments fetches the documents of a source, or returns nil if they
+// still match version
+func fetchAwsDocuments(client *awsClient, source string, version string) (*awsUsersCopy, error) {
+	service, bucket, name, err := parseAwsUsersSource(source)
+	if err != nil {
+		return nil, err
+	}
+	fetched := &awsUsersCopy{Source: source}
+
+	if service == "s3" {
+		object, err := client.getS3Object(bucket, name, version)
+		if err != nil || object.notModified {
+			return nil, err
+		}
+		fetched.Version = object.etag
+		fetched.Documents = []awsDocument{{source, string(object.data)}}
+		return fetched, nil
+	}
+
+	parameters := []ssmParameter{}
+	if strings.HasSuffix(name, "/") {
+		if parameters, err = client.getSSMParametersByPath(name); err != nil {
+			return nil, err
+		}
+		if len(parameters) == 0 {
+			return nil, fmt.Errorf("No SSM parameters below %s", name)
+		}
+	} else {
+		parameter, err := client.getSSMParameter(name)
+		if err != nil {
+			return nil, err
+		}
+		parameters = append(parameters, *parameter)
+	}
+	sort.Slice(parameters, func(i, j int) bool { return parameters[i].Name < parameters[j].Name })
+	versions := []string{}
+	for _, p := range parameters {
+		versions = append(versions, fmt.Sprintf("%s@%d", p.Name, p.Version))
+		fetched.Documents = append(fetched.Documents, awsDocument{"ssm:" + p.Name, p.Value})
+	}
+	fetched.Version = strings.Join(versions, ",")
+	if fetched.Version == version {
+		return nil, nil
+	}
+	return fetched, nil
+}
+
+// decodeAwsDocuments decodes the users and groups of a copy of the documents.
+// Unlike config files, they are not expanded: ${VAR} and file: would hand the
+// environment and the files of the server to whoever can write the source.
+func decodeAwsDocuments(documents *awsUsersCopy, format string) (*config, error) {
+	remote := &config{}
+	for _, doc := range documents.Documents {
+		docFormat := format
+		if len(docFormat) == 0 {
+			docFormat = configFormats[strings.ToLower(path.Ext(doc.Name))]
+		}
+		if len(docFormat) == 0 {
+			return nil, fmt.Errorf("%s: unknown format, please set awsUsers.format", doc.Name)
+		}
+
+		decoded := config{}
+		keys, err := decodeConfigData(&decoded, []byte(doc.Data), docFormat)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", doc.Name, err.Error())
+		}
+		for _, key := range keys {
+			if !strings.EqualFold(key[0], "users") && !strings.EqualFold(key[0], "groups") {
+				return nil, fmt.Errorf("%s: only users and groups may be set, not '%s'", doc.Name, strings.Join(key, "."))
+			}
+		}
+
+		for j := range decoded.Users {
+			remote.userSources = append(remote.userSources, configSource{doc.Name, j})
+		}
+		for j := range decoded.Groups {
+			remote.groupSources = append(remote.groupSources, configSource{doc.Name, j})
+		}
+		remote.Users = append(remote.Users, decoded.Users...)
+		remote.Groups = append(remote.Groups, decoded.Groups...)
+	}
+	return remote, nil
+}
+
+// load fetches and decodes the documents, falling back to the last good copy
+// (kept in memory, or in the cache file at startup) on errors
+func (s *awsUsersSource) load(cfg *config) (*config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := &cfg.AwsUsers
+	if s.good != nil && s.good.Source != settings.Source {
+		s.good = nil
+	}
+	if s.good == nil && len(settings.CacheFile) > 0 {
+		s.good = readAwsUsersCache(settings.CacheFile, settings.Source)
+	}
+
+	version := ""
+	if s.good != nil {
+		version = s.good.Version
+	}
+	s.lastPoll = time.Now()
+	fetched, err := fetchAwsDocuments(newAwsClient(cfg), settings.Source, version)
+	if err == nil && fetched != nil {
+		if _, err = decodeAwsDocuments(fetched, settings.Format); err != nil {
+			s.rejected = fetched.Version
+		} else {
+			s.good = fetched
+			s.rejected = ""
+			if len(settings.CacheFile) > 0 {
+				if err := writeAwsUsersCache(settings.CacheFile, fetched); err != nil {
+					log.Warningf("Unable to write %s: %s", settings.CacheFile, err.Error())
+				}
+			}
+		}
+	}
+	if err != nil {
+		if s.good == nil {
+			return nil, fmt.Errorf("Unable to load users from %s: %s", settings.Source, err.Error())
+		}
+		log.Warningf("Unable to load users from %s, using the last good copy: %s", settings.Source, err.Error())
+	}
+	return decodeAwsDocuments(s.good, settings.Format)
+}
+
+// poll fetches the documents once the poll interval has passed, and reports
+// whether they changed since the last good copy
+func (s *awsUsersSource) poll(cfg *config) bool {
+	interval, err := time.ParseDuration(cfg.AwsUsers.PollInterval)
+	if err != nil || interval <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	if time.Since(s.lastPoll) < interval {
+		s.mu.Unlock()
+		return false
+	}
+	s.lastPoll = time.Now()
+	version := ""
+	if s.good != nil {
+		version = s.good.Version
+	}
+	rejected := s.rejected
+	s.mu.Unlock()
+
+	fetched, err := fetchAwsDocuments(newAwsClient(cfg), cfg.AwsUsers.Source, version)
+	if err != nil {
+		log.Warningf("Unable to poll %s, keeping the last good copy: %s", cfg.AwsUsers.Source, err.Error())
+		return false
+	}
+	return fetched != nil && fetched.Version != rejected
+}
+
+func readAwsUsersCache(cacheFile string, source string) *awsUsersCopy {
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Unable to read %s: %s", cacheFile, err.Error())
+		}
+		return nil
+	}
+	cached := &awsUsersCopy{}
+	if err := json.Unmarshal(data, cached); err != nil || cached.Source != source {
+		return nil
+	}
+	return cached
+}
+
+func writeAwsUsersCache(cacheFile string, documents *awsUsersCopy) error {
+	data, err := json.Marshal(documents)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cacheFile+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(cacheFile+".tmp", cacheFile)
+}
+
+// loadAwsUsers adds the users and groups of the awsUsers source to cfg
+func loadAwsUsers(cfg *config) error {
+	if _, _, _, err := parseAwsUsersSource(cfg.AwsUsers.Source); err != nil {
+		return fmt.Errorf("awsUsers: %s", err.Error())
+	}
+	if len(cfg.AwsUsers.PollInterval) > 0 {
+		if _, err := time.ParseDuration(cfg.AwsUsers.PollInterval); err != nil {
+			return fmt.Errorf("awsUsers: invalid pollInterval: %s", err.Error())
+		}
+	}
+
+	remote, err := awsUsers.load(cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Users = append(cfg.Users, remote.Users...)
+	cfg.Groups = append(cfg.Groups, remote.Groups...)
+	cfg.userSources = append(cfg.userSources, remote.userSources...)
+	cfg.groupSources = append(cfg.groupSources, remote.groupSources...)
+	log.Debugf("Loaded %d users and %d groups from %s", len(remote.Users), len(remote.Groups), cfg.AwsUsers.Source)
+	return nil
+}
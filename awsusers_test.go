@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// fakeS3 serves objects path-style, like MinIO behind awsUsers.endpoint
+func fakeS3(t *testing.T, objects map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+			return
+		}
+		etag := `"` + sha256Hex([]byte(data))[:16] + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAwsUsersNotExpanded(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("local secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTHNDS_TEST_SECRET", "environment secret")
+
+	server := fakeS3(t, map[string]string{
+		"/authnds/users.toml": `
+[[users]]
+  commonName = "fromfile"
+  userPassword = "file:` + secretFile + `"
+[[users]]
+  commonName = "fromenv"
+  loginShell = "${AUTHNDS_TEST_SECRET}"
+[[groups]]
+  commonName = "remote"
+  description = "file:` + secretFile + `"
+`,
+	})
+	cfg := &config{AwsUsers: configAwsUsers{
+		Enabled:  true,
+		Source:   "s3://authnds/users.toml",
+		Endpoint: server.URL,
+	}}
+	source := &awsUsersSource{}
+	remote, err := source.load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"file: secret", remote.Users[0].UserPassword, "file:" + secretFile},
+		{"environment variable", remote.Users[1].LoginShell, "${AUTHNDS_TEST_SECRET}"},
+		{"group setting", remote.Groups[0].Description, "file:" + secretFile},
+	}
+	for _, test := range tests {
+		if test.value != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, test.value, test.want)
+		}
+	}
+	if remote.userSources[0].file != "s3://authnds/users.toml" {
+		t.Errorf("source of the first user: %q", remote.userSources[0].file)
+	}
+}
+
+func TestAwsUsersLastGoodCopy(t *testing.T) {
+	objects := map[string]string{"/authnds/users.toml": "[[users]]\n  commonName = \"first\"\n"}
+	server := fakeS3(t, objects)
+	cfg := &config{AwsUsers: configAwsUsers{Enabled: true, Source: "s3://authnds/users.toml", Endpoint: server.URL}}
+	source := &awsUsersSource{}
+
+	tests := []struct {
+		name     string
+		document string // "" to remove the object
+		want     string
+	}{
+		{"initial", "[[users]]\n  commonName = \"first\"\n", "first"},
+		{"unchanged", "[[users]]\n  commonName = \"first\"\n", "first"},
+		{"changed", "[[users]]\n  commonName = \"second\"\n", "second"},
+		{"other settings", "baseDN = \"dc=evil\"\n", "second"},
+		{"unavailable", "", "second"},
+	}
+	for _, test := range tests {
+		if len(test.document) > 0 {
+			objects["/authnds/users.toml"] = test.document
+		} else {
+			delete(objects, "/authnds/users.toml")
+		}
+		remote, err := source.load(cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if len(remote.Users) != 1 || remote.Users[0].CommonName != test.want {
+			t.Errorf("%s: got users %+v, want %s", test.name, remote.Users, test.want)
+		}
+	}
+}
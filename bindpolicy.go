@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Values of bindPolicies[].require
+const (
+	bindRequireDefault     = "default"      // the factors of the user, or an app password
+	bindRequireOTP         = "otp"          // the password and a second factor
+	bindRequirePassword    = "password"     // the password alone
+	bindRequireAppPassword = "app_password" // an app password
+)
+
+// validateBindPolicies checks the [[bindPolicies]] of a config
+func validateBindPolicies(cfg *config) error {
+	for i := range cfg.BindPolicies {
+		p := &cfg.BindPolicies[i]
+		if len(p.Name) == 0 {
+			p.Name = fmt.Sprintf("policy%d", i)
+		}
+		switch p.Require {
+		case "":
+			p.Require = bindRequireDefault
+		case bindRequireDefault, bindRequireOTP, bindRequirePassword, bindRequireAppPassword:
+		default:
+			return fmt.Errorf("Invalid require '%s' in bind policy '%s': please use one of '%s', '%s', '%s' or '%s'",
+				p.Require, p.Name, bindRequireDefault, bindRequireOTP, bindRequirePassword, bindRequireAppPassword)
+		}
+		for _, source := range p.Sources {
+			if _, err := parseSource(source); err != nil {
+				return fmt.Errorf("Invalid source '%s' in bind policy '%s': please use an IP address or CIDR", source, p.Name)
+			}
+		}
+		for _, baseDN := range p.BaseDNs {
+			if err := validateDN(baseDN); err != nil {
+				return fmt.Errorf("Invalid baseDN '%s' in bind policy '%s': %s", baseDN, p.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// parseSource parses a CIDR, or a single IP address
+func parseSource(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address")
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(source)
+	return ipNet, err
+}
+
+// bindPolicy returns the first bind policy that matches a Bind as user to
+// bindDN, or nil. A policy matches when each of its lists is empty or has a
+// match: the source of the connection, its listener, the user or the account
+// the connection was bound as before, and a base DN the bind DN is under.
+func (h configHandler) bindPolicy(user *configUser, bindDN string, conn net.Conn) *configBindPolicy {
+	_, listener := connInfo(conn)
+	ip, _ := connSource(conn)
+	boundUser := ""
+	if ou, cn, ok := parseEntryDN(sessionBindDN(conn), h.cfg.Backend.BaseDN); ok && ou == "users" {
+		boundUser = cn
+	}
+	for i := range h.cfg.BindPolicies {
+		p := &h.cfg.BindPolicies[i]
+		if len(p.Sources) > 0 && !matchSource(p.Sources, net.ParseIP(ip)) {
+			continue
+		}
+		if len(p.Listeners) > 0 && findIndex(p.Listeners, listener) == -1 {
+			continue
+		}
+		if len(p.Accounts) > 0 && findIndex(p.Accounts, user.CommonName) == -1 && (len(boundUser) == 0 || findIndex(p.Accounts, boundUser) == -1) {
+			continue
+		}
+		if len(p.BaseDNs) > 0 && !matchBaseDN(p.BaseDNs, bindDN) {
+			continue
+		}
+		return p
+	}
+	return nil
+}
+
+// matchSource reports whether ip is in one of sources; never for Unix domain
+// sockets
+func matchSource(sources []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, source := range sources {
+		if ipNet, err := parseSource(source); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchBaseDN reports whether dn is one of baseDNs, or under one
+func matchBaseDN(baseDNs []string, dn string) bool {
+	dn = strings.ToLower(dn)
+	for _, baseDN := range baseDNs {
+		baseDN = strings.ToLower(baseDN)
+		if dn == baseDN || strings.HasSuffix(dn, ","+baseDN) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metala/ldap"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidateBindPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []configBindPolicy
+		err      string
+	}{
+		{"valid", []configBindPolicy{{Name: "lan", Sources: []string{"192.0.2.0/24", "2001:db8::1"}, Listeners: []string{"ldaps"}, BaseDNs: []string{"ou=users,dc=example,dc=com"}, Require: bindRequirePassword}}, ""},
+		{"unknown require", []configBindPolicy{{Name: "lan", Require: "none"}}, "Invalid require 'none' in bind policy 'lan'"},
+		{"invalid source", []configBindPolicy{{Sources: []string{"192.0.2.0/33"}}}, "Invalid source '192.0.2.0/33' in bind policy 'policy0'"},
+		{"host name source", []configBindPolicy{{Name: "vpn", Sources: []string{"vpn.example.com"}}}, "Invalid source 'vpn.example.com' in bind policy 'vpn'"},
+		{"invalid base DN", []configBindPolicy{{}, {BaseDNs: []string{"users"}}}, "Invalid baseDN 'users' in bind policy 'policy1'"},
+	}
+	for _, test := range tests {
+		err := validateBindPolicies(&config{BindPolicies: test.policies})
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && err != nil {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// the defaults
+	cfg := &config{BindPolicies: []configBindPolicy{{}}}
+	if err := validateBindPolicies(cfg); err != nil || cfg.BindPolicies[0].Name != "policy0" || cfg.BindPolicies[0].Require != bindRequireDefault {
+		t.Errorf("defaults: %+v %v", cfg.BindPolicies[0], err)
+	}
+}
+
+func TestBindPolicies(t *testing.T) {
+	const otpSecret = "JBSWY3DPEHPK3PXP"
+	audit := captureAudit(t)
+	code, err := totp.GenerateCode(otpSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appPassword, err := hashUserPassword("app-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []configUser{
+		{CommonName: "alice", UserPassword: testPasswordHash, OTPSecret: otpSecret, AppPasswords: []configUserAppPassword{{Name: "mail", Password: appPassword}}},
+		{CommonName: "bob", UserPassword: testPasswordHash},
+		{CommonName: "svc", UserPassword: testPasswordHash},
+	}
+
+	// test connections come from 192.0.2.1, on the listener "test"
+	tests := []struct {
+		name     string
+		policies []configBindPolicy
+		boundAs  string // the service account the connection is bound as
+		user     string
+		password string
+		outcome  string
+		reason   string
+		policy   string
+	}{
+		{"no policy", nil, "", "alice", "secret", bindOutcomeBadOTP, "OTP missing", ""},
+		{"no policy, OTP", nil, "", "alice", "secret" + code, bindOutcomeSuccess, "", ""},
+		{"no policy, app password", nil, "", "alice", "app-secret", bindOutcomeAppPassword, "", ""},
+		{"source", []configBindPolicy{{Name: "lan", Sources: []string{"192.0.2.0/24"}, Require: bindRequirePassword}}, "", "alice", "secret", bindOutcomeSuccess, "", "lan"},
+		{"other source", []configBindPolicy{{Name: "lan", Sources: []string{"198.51.100.0/24"}, Require: bindRequirePassword}}, "", "alice", "secret", bindOutcomeBadOTP, "OTP missing", ""},
+		{"listener", []configBindPolicy{{Name: "strict", Listeners: []string{"test"}, Require: bindRequireOTP}}, "", "bob", "secret", bindOutcomePolicy, "policy requires an OTP", "strict"},
+		{"listener, app password", []configBindPolicy{{Name: "strict", Listeners: []string{"test"}, Require: bindRequireOTP}}, "", "alice", "app-secret", bindOutcomeBadOTP, "invalid totp OTP", "strict"},
+		{"other listener", []configBindPolicy{{Name: "strict", Listeners: []string{"ldaps"}, Require: bindRequireOTP}}, "", "bob", "secret", bindOutcomeSuccess, "", ""},
+		{"account", []configBindPolicy{{Name: "mail", Accounts: []string{"alice"}, Require: bindRequireAppPassword}}, "", "alice", "secret" + code, bindOutcomePolicy, "policy requires an app password", "mail"},
+		{"account, app password", []configBindPolicy{{Name: "mail", Accounts: []string{"alice"}, Require: bindRequireAppPassword}}, "", "alice", "app-secret", bindOutcomeAppPassword, "", "mail"},
+		{"base DN", []configBindPolicy{{Name: "users", BaseDNs: []string{"OU=users," + testBaseDN}, Require: bindRequireOTP}}, "", "bob", "secret", bindOutcomePolicy, "policy requires an OTP", "users"},
+		{"other base DN", []configBindPolicy{{Name: "admins", BaseDNs: []string{"ou=admins," + testBaseDN}, Require: bindRequireOTP}}, "", "bob", "secret", bindOutcomeSuccess, "", ""},
+		{"bound service account", []configBindPolicy{{Name: "proxy", Accounts: []string{"svc"}, Require: bindRequirePassword}}, "svc", "alice", "secret", bindOutcomeSuccess, "", "proxy"},
+		{"not bound as the service account", []configBindPolicy{{Name: "proxy", Accounts: []string{"svc"}, Require: bindRequirePassword}}, "", "alice", "secret", bindOutcomeBadOTP, "OTP missing", ""},
+		{"first match", []configBindPolicy{{Name: "lan", Sources: []string{"192.0.2.1"}, Require: bindRequirePassword}, {Name: "all", Require: bindRequireOTP}}, "", "alice", "secret", bindOutcomeSuccess, "", "lan"},
+	}
+	for _, test := range tests {
+		cfg := &config{Users: users, BindPolicies: test.policies}
+		if err := validateBindPolicies(cfg); err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		h := newTestHandler(cfg)
+		conn := newTestConn(t)
+		if len(test.boundAs) > 0 {
+			bindTestSession(t, conn, test.boundAs, []string{"password"}, false)
+		}
+		result, rec := bind(t, h, audit, userDN(test.user), test.password, conn)
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess || test.outcome == bindOutcomeAppPassword) ||
+			rec.Outcome != test.outcome || rec.Reason != test.reason || rec.Policy != test.policy {
+			t.Errorf("%s: %d %+v, want outcome %q reason %q policy %q", test.name, result, rec, test.outcome, test.reason, test.policy)
+		}
+	}
+}
@@ -2,9 +2,21 @@ package main
 
 // config file
 type configBackend struct {
-	BaseDN   string
-	Insecure bool     // For LDAP backend only
-	Servers  []string // For LDAP backend only
+	BaseDN          string
+	Datastore       string   // config (default) or sql
+	AdminGroup      string   // members may add, modify and delete users and groups
+	ProxyAuthzGroup string   // members may search as another user (RFC 4370)
+	HideDisabled    bool     // leave disabled and expired users out of searches and group members
+	Insecure        bool     // For LDAP backend only
+	Servers         []string // For LDAP backend only
+}
+type configSQL struct {
+	Driver       string // sqlite or postgres
+	DSN          string
+	Migrate      bool   // apply pending schema migrations at startup
+	CacheTTL     string // how long users and groups are cached, e.g. "30s"
+	MaxOpenConns int
+	MaxIdleConns int
 }
 type configFrontend struct {
 	AllowedBaseDNs []string // For LDAP backend only
@@ -24,15 +36,106 @@ type configLDAPS struct {
 	Key        string
 	EnforceTLS bool
 }
+type configListener struct {
+	Name       string
+	Type       string // tcp, tls or unix
+	Listen     string // host:port, socket path or systemd:<name>
+	Cert       string
+	Key        string
+	EnforceTLS bool
+	// Unix domain sockets only
+	Mode  string
+	Owner string
+	Group string
+}
+type configHTTP struct {
+	Enabled         bool
+	Listen          string
+	CertWarningDays int
+	AdminToken      string // the bearer token of the admin endpoints, which are refused without one
+}
+type configYubikey struct {
+	Validation  string             // yubicloud (default), servers or local
+	Servers     []string           // yubikey-val URLs, for servers
+	Keys        []configYubikeyKey // for local
+	KeyFile     string             // more keys for local, "publicID,privateID,aesKey" per line
+	CounterFile string             // where local keeps the counters of the last OTP of each key
+}
+type configYubikeyKey struct {
+	PublicID  string // modhex, the first 12 characters of its OTPs
+	PrivateID string // hex, 12 characters
+	AESKey    string // hex, 32 characters
+}
+type configOTP struct {
+	StateFile   string // where HOTP counters and used recovery codes are kept
+	HOTPWindow  int    // how many HOTP codes ahead of the counter are accepted
+	Mode        string // "password": the OTP is part of the bind password, "challenge": it's sent in a second bind
+	Position    string // "suffix" or "prefix": where the OTP is in the bind password
+	Separator   string // between the password and the OTP, if set
+	ChallengeDN string // the bind DN of the second bind in challenge mode
+}
+type configPush struct {
+	URL         string // the webhook called for each Bind to approve
+	Secret      string // sent as a bearer token to the webhook, and expected in callbacks
+	Timeout     string // how long a Bind waits for the approval, e.g. "30s"
+	CallbackURL string // the base URL of the HTTP server, for approval services that call back
+}
+type configBindPolicy struct {
+	Name      string
+	Sources   []string // IP addresses or CIDRs clients connect from
+	Listeners []string // listener names
+	Accounts  []string // user names, of the user binding or of the service account the connection was bound as
+	BaseDNs   []string // the bind DN is under one of these
+	Require   string   // default, otp, password or app_password
+}
+type configPasswordPolicy struct {
+	MaxAgeDays        int  // passwords expire this many days after they were changed, never when 0
+	ExpireWarningDays int  // binds are warned this many days before their password expires
+	GraceLogins       int  // binds allowed with an expired password, to change it
+	MinLength         int  // of passwords set through LDAP
+	Complexity        int  // how many of lower case, upper case, digits and other characters they need
+	History           int  // how many previous passwords can't be used again
+	MustChange        bool // passwords set by an admin must be changed at the next bind
+}
+type configSessions struct {
+	IdleTimeout     string // close connections idle for this long, e.g. "15m"
+	AbsoluteTimeout string // close connections open for this long, e.g. "8h"
+}
+type configAudit struct {
+	Enabled bool
+	Output  string // stdout, stderr, syslog or a file path
+}
+type configRemoteSyslog struct {
+	Enabled  bool
+	Network  string // udp, tcp or tls
+	Address  string
+	Facility string
+	CA       string // tls only
+}
+type configAwsUsers struct {
+	Enabled      bool
+	Source       string // s3://bucket/key, ssm:/name or ssm:/path/ for every parameter below path
+	Format       string // toml, yaml or json; defaults to the extension of the key or name
+	PollInterval string // e.g. "1m"; empty to only load at startup and on reload
+	CacheFile    string // last good copy, used when the source is unavailable at startup
+	Endpoint     string // S3-compatible stand-in such as MinIO, or SSM endpoint
+}
 type configUser struct {
 	CommonName string
 	Disabled   bool
+	ValidFrom  string // RFC 3339 or YYYY-MM-DD; binds are refused before
+	ValidUntil string // RFC 3339 or YYYY-MM-DD; binds are refused from then on
 	// Person
 	DisplayName  string
 	GivenName    string
 	Surname      string
 	UserPassword string
 	Mail         string
+	// Password policy
+	PwdChangedTime     string   // RFC 3339 or YYYY-MM-DD, when userPassword was last set
+	PasswordExpires    string   // RFC 3339 or YYYY-MM-DD; replaces passwordPolicy.maxAgeDays when set
+	PasswordHistory    []string // hashes of the previous passwords, newest first
+	PasswordMustChange bool     // binds may only change the password
 	// Posix
 	PosixGroupID int
 	PosixUserID  int
@@ -40,11 +143,35 @@ type configUser struct {
 	LoginShell   string
 	SSHKeys      []string
 	// 2FA
-	OTPSecret string
-	Yubikey   string
+	OTPSecret     string
+	Yubikey       string
+	OTPSecrets    []configUserOTPSecret // more TOTP devices, tried in order
+	Yubikeys      []configUserYubikey   // more Yubikeys
+	HOTPSecrets   []configUserOTPSecret // counter-based, e.g. hardware tokens without a clock
+	RecoveryCodes []string              // hashed like userPassword, each valid once
+	Push          bool                  // binds are approved through the [push] webhook
 	// Extra
 	GroupNames    []string
 	PassAppSHA256 []string
+	AppPasswords  []configUserAppPassword
+}
+type configUserAppPassword struct {
+	Name      string   // shown in logs, e.g. "phone mail"
+	Password  string   // hashed like userPassword
+	Created   string   // RFC 3339 or YYYY-MM-DD
+	Expires   string   // RFC 3339 or YYYY-MM-DD; never when empty
+	Sources   []string // IP addresses or CIDRs it may be used from, any when empty
+	Listeners []string // listener names it may be used on, any when empty
+}
+type configUserOTPSecret struct {
+	Name     string // shown in the audit log, e.g. "phone"
+	Secret   string // base32
+	Disabled bool
+}
+type configUserYubikey struct {
+	ID       string // the first 12 characters of its OTPs
+	Name     string // shown in the audit log instead of the ID
+	Disabled bool
 }
 type configGroup struct {
 	CommonName  string
@@ -53,17 +180,44 @@ type configGroup struct {
 type config struct {
 	ServerName         string
 	Backend            configBackend
+	SQL                configSQL
 	LogLevel           string
+	LogFormat          string
 	YubikeyClientID    string
 	YubikeySecret      string
+	Yubikey            configYubikey
+	OTP                configOTP
+	Push               configPush
+	BindPolicies       []configBindPolicy
+	PasswordPolicy     configPasswordPolicy
 	Frontend           configFrontend
 	LDAP               configLDAP
 	LDAPS              configLDAPS
+	Listeners          []configListener
+	HTTP               configHTTP
+	Sessions           configSessions
+	Audit              configAudit
 	Groups             []configGroup
 	Syslog             bool
+	RemoteSyslog       configRemoteSyslog
 	Users              []configUser
 	ConfigFile         string
 	AwsAccessKeyId     string
 	AwsSecretAccessKey string
 	AwsRegion          string
+	AwsUsers           configAwsUsers
+	Include            []string
+	WatchConfig        bool
+
+	// Where the settings, users and groups were loaded from
+	format         string
+	files          []string
+	includeGlobs   []string
+	settingSources map[string]string
+	userSources    []configSource
+	groupSources   []configSource
+
+	// contents read instead of the config files, to check an LDAP write
+	// before the files are replaced
+	pending map[string][]byte
 }
@@ -6,21 +6,23 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
-	"github.com/GeertJohan/yubigo"
 	"github.com/metala/ldap"
 	"github.com/pquerna/otp/totp"
 )
 
 type configHandler struct {
-	cfg         *config
-	yubikeyAuth *yubigo.YubiAuth
+	cfg     *config
+	yubikey yubikeyValidator
+	store   directoryStore
 }
 
-func newConfigHandler(cfg *config, yubikeyAuth *yubigo.YubiAuth) Backend {
+func newConfigHandler(cfg *config, yubikey yubikeyValidator) Backend {
 	handler := configHandler{
-		cfg:         cfg,
-		yubikeyAuth: yubikeyAuth}
+		cfg:     cfg,
+		yubikey: yubikey,
+		store:   configFileStore{cfg}}
 	return handler
 }
 
@@ -29,18 +31,30 @@ func (h configHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultC
 	bindDN = strings.ToLower(bindDN)
 	baseDNSuffix := strings.ToLower("," + h.cfg.Backend.BaseDN)
 	usersOuSuffix := ",ou=users"
+	clog := newConnLogger(conn)
+	rec := newAuditRecord("bind", bindDN, conn)
+	defer func(start time.Time) {
+		countBind(rec.Outcome)
+		observeBindDuration(start)
+		rec.write(resultCode)
+		if resultCode == ldap.LDAPResultSuccess {
+			sessionAuthenticated(conn, rec.User, rec.Factors)
+		}
+	}(time.Now())
 
-	log.Infof("Bind request: bindDN: %s, BaseDN: %s, source: %s", bindDN, h.cfg.Backend.BaseDN, conn.RemoteAddr().String())
+	clog.Infof("Bind request: bindDN: %s, BaseDN: %s, source: %s", bindDN, h.cfg.Backend.BaseDN, conn.RemoteAddr().String())
 
 	// parse the bindDN - ensure that the bindDN ends with the BaseDN
 	if !strings.HasSuffix(bindDN, baseDNSuffix) {
-		log.Warningf("Bind Error: BindDN %s not our BaseDN %s", bindDN, h.cfg.Backend.BaseDN)
+		clog.Warningf("Bind Error: BindDN %s not our BaseDN %s", bindDN, h.cfg.Backend.BaseDN)
+		rec.fail(bindOutcomeUnknownUser, "bind DN not in base DN")
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
 
 	userName := strings.TrimSuffix(bindDN, baseDNSuffix)
 	if !strings.HasSuffix(userName, usersOuSuffix) {
-		log.Warningf("Bind Error: BindDN %s is not part of ou=users,%s", bindDN, h.cfg.Backend.BaseDN)
+		clog.Warningf("Bind Error: BindDN %s is not part of ou=users,%s", bindDN, h.cfg.Backend.BaseDN)
+		rec.fail(bindOutcomeUnknownUser, "bind DN not in ou=users")
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
 	userName = strings.TrimPrefix(userName, "cn=")
@@ -56,38 +70,58 @@ func (h configHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultC
 		}
 	}
 	if !found {
-		log.Warningf("Bind Error: User %s not found.", userName)
+		clog.Warningf("Bind Error: User %s not found.", userName)
+		rec.fail(bindOutcomeUnknownUser, "user not found")
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
+	rec.User = user.CommonName
 
-	validotp := false
-	if len(user.Yubikey) == 0 && len(user.OTPSecret) == 0 {
-		validotp = true
+	// disabled users can't bind, not even with an app password
+	if user.Disabled {
+		clog.Warningf("Bind Error: User %s is disabled", userName)
+		rec.fail(bindOutcomeAccountDisabled, "account disabled")
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+	if outside := user.outsideValidity(time.Now()); len(outside) > 0 {
+		clog.Warningf("Bind Error: User %s is %s (valid from '%s' until '%s')", userName, outside, user.ValidFrom, user.ValidUntil)
+		rec.fail(bindOutcomeAccountInactive, "account "+outside)
+		return ldap.LDAPResultInvalidCredentials, nil
 	}
 
-	// Test Yubikey OTP, if exists
-	if !validotp && len(user.Yubikey) > 0 && h.yubikeyAuth != nil {
-		if len(bindSimplePw) > 44 {
-			otp := bindSimplePw[len(bindSimplePw)-44:]
-			yubikeyid := otp[0:12]
+	// The bind policy of the client decides which factors are needed
+	require := bindRequireDefault
+	if policy := h.bindPolicy(&user, bindDN, conn); policy != nil {
+		require = policy.Require
+		rec.Policy = policy.Name
+		clog.Debugf("Bind policy '%s' requires '%s' for '%s' from '%s'", policy.Name, require, bindDN, conn.RemoteAddr().String())
+	}
+	if require == bindRequireOTP && !user.hasOTP() {
+		clog.Warningf("Bind Error: policy '%s' requires an OTP, which '%s' doesn't have", rec.Policy, bindDN)
+		rec.fail(bindOutcomePolicy, "policy requires an OTP")
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+	hasOTP := user.hasOTP() && require != bindRequirePassword
 
-			if user.Yubikey == yubikeyid {
-				bindSimplePw = bindSimplePw[:len(bindSimplePw)-44]
-				_, ok, err := h.yubikeyAuth.Verify(otp)
-				if err != nil {
-					log.Warningf("Yubikey OTP validation error: '%s' for '%s' from '%s'", err.Error(), bindDN, conn.RemoteAddr().String())
-				}
-				validotp = ok
-			}
+	// The OTP of a challenge comes alone, in a bind to the challenge DN
+	if sessionChallengeResponse(conn, bindDN) && hasOTP {
+		_, otp := h.checkOTP(&user, bindSimplePw, exactOTP, bindDN, conn)
+		if code, ok := h.acceptOTP(&user, otp, rec, bindDN, conn); !ok {
+			return code, nil
 		}
+		if code, ok := h.checkPasswordAge(&user, rec, bindDN, conn, true); !ok {
+			return code, nil
+		}
+		clog.Noticef("Bind success with an OTP challenge as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		rec.Outcome = bindOutcomeSuccess
+		rec.Factors = []string{"password", otp.factor}
+		return ldap.LDAPResultSuccess, nil
 	}
+	challenge := h.cfg.OTP.Mode == otpModeChallenge && hasOTP && !user.Push
 
-	// Test OTP, if exists
-	if !validotp && len(user.OTPSecret) > 0 && len(bindSimplePw) > 6 {
-		otp := bindSimplePw[len(bindSimplePw)-6:]
-		bindSimplePw = bindSimplePw[:len(bindSimplePw)-6]
-
-		validotp = totp.Validate(otp, user.OTPSecret)
+	password := bindSimplePw
+	otp := otpCheck{valid: !hasOTP}
+	if !otp.valid && !challenge && require != bindRequireAppPassword {
+		bindSimplePw, otp = h.checkOTP(&user, bindSimplePw, newOTPSplitter(&h.cfg.OTP), bindDN, conn)
 	}
 
 	// finally, validate user passwords
@@ -95,38 +129,255 @@ func (h configHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (resultC
 	pwHash.Write([]byte(bindSimplePw))
 	pwHashDigest := hex.EncodeToString(pwHash.Sum(nil))
 
-	// check app passwords first
-	for index, appPw := range user.PassAppSHA256 {
+	// check app passwords first, unless the policy requires other factors
+	appPasswords, namedAppPasswords := user.PassAppSHA256, user.AppPasswords
+	if require == bindRequireOTP || require == bindRequirePassword {
+		appPasswords, namedAppPasswords = nil, nil
+	}
+	// named app passwords are checked as typed, before an OTP is taken from it
+	for _, appPw := range namedAppPasswords {
+		if ok, _ := checkPassword(appPw.Password, password); !ok {
+			continue
+		}
+		rec.Device = appPw.Name
+		if refusal := appPw.refusal(conn); len(refusal) > 0 {
+			clog.Warningf("Bind Error: app password '%s' of '%s' is %s, from %s", appPw.Name, bindDN, refusal, conn.RemoteAddr().String())
+			rec.fail(bindOutcomeAppPasswordDenied, "app password "+refusal)
+			return ldap.LDAPResultInvalidCredentials, nil
+		}
+		clog.Noticef("Bind success using app password '%s' as %s from %s", appPw.Name, bindDN, conn.RemoteAddr().String())
+		if err := otpStates.appPasswordUsed(user.CommonName, appPw.Name); err != nil {
+			clog.Warningf("Unable to save the last use of app password '%s' of '%s': %s", appPw.Name, bindDN, err.Error())
+		}
+		rec.Outcome = bindOutcomeAppPassword
+		rec.Factors = []string{"app_password"}
+		return ldap.LDAPResultSuccess, nil
+	}
+	for index, appPw := range appPasswords {
 		if appPw != pwHashDigest {
-			log.Warningf(fmt.Sprintf("Attempted to bind app pw #%d - failure as %s from %s", index, bindDN, conn.RemoteAddr().String()))
+			clog.Warningf("Attempted to bind app pw #%d - failure as %s from %s", index, bindDN, conn.RemoteAddr().String())
 		} else {
-			log.Noticef("Bind success using app pw #%d as %s from %s", index, bindDN, conn.RemoteAddr().String())
+			clog.Noticef("Bind success using app pw #%d as %s from %s", index, bindDN, conn.RemoteAddr().String())
+			appPassword := index
+			rec.Outcome = bindOutcomeAppPassword
+			rec.Factors = []string{"app_password"}
+			rec.AppPassword = &appPassword
+			rec.Device = ""
 			return ldap.LDAPResultSuccess, nil
 		}
 	}
 
-	// Then ensure the OTP is valid before checking the user password
-	if !validotp {
-		log.Warningf("Bind Error: invalid OTP token as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+	if require == bindRequireAppPassword {
+		clog.Warningf("Bind Error: policy '%s' only accepts app passwords, as '%s' from '%s'", rec.Policy, bindDN, conn.RemoteAddr().String())
+		rec.fail(bindOutcomePolicy, "policy requires an app password")
+		return ldap.LDAPResultInvalidCredentials, nil
+	}
+
+	if challenge {
+		if ok, err := checkPassword(user.UserPassword, bindSimplePw); !ok {
+			clog.Warningf("Bind Error: invalid userPassword as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+			rec.fail(bindOutcomeBadPassword, "invalid password")
+			return ldap.LDAPResultInvalidCredentials, err
+		}
+		if code, ok := h.checkPasswordAge(&user, rec, bindDN, conn, false); !ok {
+			return code, nil
+		}
+		// Refused like a wrong password, so the result doesn't tell whether
+		// the password was right
+		clog.Infof("OTP challenge for '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		sessionChallenge(conn, bindDN, h.cfg.OTP.ChallengeDN)
+		rec.fail(bindOutcomeOTPRequired, "OTP required in a bind to "+h.cfg.OTP.ChallengeDN)
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
 
+	// Without an OTP, a user with push approval is asked on their device,
+	// once the password is right
+	push := !otp.valid && len(otp.factor) == 0 && user.Push
+
+	// Then ensure the OTP is valid before checking the user password
+	if !otp.valid && !push {
+		code, _ := h.acceptOTP(&user, otp, rec, bindDN, conn)
+		return code, nil
+	}
+
 	if ok, err := checkPassword(user.UserPassword, bindSimplePw); !ok {
-		log.Warningf("Bind Error: invalid userPassword as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		clog.Warningf("Bind Error: invalid userPassword as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		rec.fail(bindOutcomeBadPassword, "invalid password")
 		return ldap.LDAPResultInvalidCredentials, err
 	}
+	if code, ok := h.checkPasswordAge(&user, rec, bindDN, conn, false); !ok {
+		return code, nil
+	}
 
-	log.Noticef("Bind success as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+	if push {
+		clog.Infof("Push approval for '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		approved, err := pushApprovals.approve(&h.cfg.Push, user.CommonName, bindDN, conn)
+		if err != nil {
+			clog.Warningf("Push approval error: '%s' for '%s' from '%s'", err.Error(), bindDN, conn.RemoteAddr().String())
+		}
+		if !approved {
+			clog.Warningf("Bind Error: push not approved as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+			if err != nil {
+				rec.fail(bindOutcomeBadOTP, "push failed")
+			} else {
+				rec.fail(bindOutcomeBadOTP, "push denied")
+			}
+			return ldap.LDAPResultInvalidCredentials, nil
+		}
+		otp.valid, otp.factor = true, "push"
+	}
+
+	if code, ok := h.acceptOTP(&user, otp, rec, bindDN, conn); !ok {
+		return code, nil
+	}
+	if code, ok := h.checkPasswordAge(&user, rec, bindDN, conn, true); !ok {
+		return code, nil
+	}
+
+	clog.Noticef("Bind success as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+	rec.Outcome = bindOutcomeSuccess
+	rec.Factors = []string{"password"}
+	if len(otp.factor) > 0 {
+		rec.Factors = append(rec.Factors, otp.factor)
+	}
 	return ldap.LDAPResultSuccess, nil
 }
 
+// otpCheck is the outcome of checking the OTP of a bind
+type otpCheck struct {
+	valid        bool
+	factor       string // of the OTP given, if any
+	device       string
+	disabled     bool   // the OTP is from a disabled device
+	recoveryCode string // hash of the recovery code, used once the bind succeeds
+}
+
+// checkOTP takes the OTP from a bind password with split, and checks it
+// against the second factors of the user: the Yubikeys by the ID the OTP
+// starts with, recovery codes, then the TOTP and HOTP secrets in order. It
+// returns the password without the OTP.
+func (h configHandler) checkOTP(user *configUser, password string, split otpSplitter, bindDN string, conn net.Conn) (string, otpCheck) {
+	clog := newConnLogger(conn)
+	check := otpCheck{}
+	otpSecrets, yubikeys := user.otpDevices()
+
+	if rest, otp, ok := split(password, yubikeyOTPLength); ok && len(yubikeys) > 0 && h.yubikey != nil {
+		yubikeyid := otp[0:yubikeyPublicIDLength]
+		for _, yubikey := range yubikeys {
+			if yubikey.ID != yubikeyid {
+				continue
+			}
+			password = rest
+			check.factor = "yubikey"
+			check.device = yubikey.label()
+			if yubikey.Disabled {
+				check.disabled = true
+				return password, check
+			}
+			ok, err := h.yubikey.verify(otp)
+			if err != nil {
+				clog.Warningf("Yubikey OTP validation error: '%s' for '%s' from '%s'", err.Error(), bindDN, conn.RemoteAddr().String())
+			}
+			check.valid = ok
+			return password, check
+		}
+	}
+
+	if rest, otp, ok := split(password, recoveryCodeLength); ok && len(user.RecoveryCodes) > 0 && isRecoveryCode(otp) {
+		check.factor = "recovery_code"
+		check.recoveryCode, check.valid = otpStates.findRecoveryCode(user.CommonName, user.RecoveryCodes, otp)
+		return rest, check
+	}
+
+	rest, otp, ok := split(password, 6)
+	if !ok || len(otpSecrets) == 0 && len(user.HOTPSecrets) == 0 {
+		// OTP missing
+		return password, check
+	}
+	password = rest
+	check.factor = "totp"
+	if len(otpSecrets) == 0 {
+		check.factor = "hotp"
+	}
+	for _, secret := range otpSecrets {
+		if !secret.Disabled && totp.Validate(otp, secret.Secret) {
+			check.valid = true
+			check.device = secret.Name
+			return password, check
+		}
+	}
+	// tell a disabled device from a wrong code in the audit log
+	for _, secret := range otpSecrets {
+		if secret.Disabled && totp.Validate(otp, secret.Secret) {
+			check.disabled = true
+			check.device = secret.Name
+			return password, check
+		}
+	}
+	if len(user.HOTPSecrets) > 0 {
+		device, ok, err := otpStates.verifyHOTP(user.CommonName, user.HOTPSecrets, otp)
+		if err != nil {
+			clog.Warningf("HOTP validation error: '%s' for '%s' from '%s'", err.Error(), bindDN, conn.RemoteAddr().String())
+		}
+		if len(device) > 0 {
+			check.factor = "hotp"
+			check.device = device
+			check.valid = ok
+			check.disabled = !ok && err == nil
+		}
+	}
+	return password, check
+}
+
+// acceptOTP records the OTP check of a bind in its audit record, and uses up
+// a valid recovery code. It returns false, with the result code, when the
+// bind fails.
+func (h configHandler) acceptOTP(user *configUser, check otpCheck, rec *auditRecord, bindDN string, conn net.Conn) (ldap.LDAPResultCode, bool) {
+	clog := newConnLogger(conn)
+	rec.Device = check.device
+	if !check.valid {
+		clog.Warningf("Bind Error: invalid OTP token as '%s' from '%s'", bindDN, conn.RemoteAddr().String())
+		if len(check.factor) == 0 {
+			rec.fail(bindOutcomeBadOTP, "OTP missing")
+		} else if check.disabled {
+			clog.Warningf("Bind Error: %s device '%s' of '%s' is disabled", check.factor, check.device, bindDN)
+			rec.fail(bindOutcomeBadOTP, "disabled "+check.factor+" device")
+		} else {
+			rec.fail(bindOutcomeBadOTP, "invalid "+check.factor+" OTP")
+		}
+		return ldap.LDAPResultInvalidCredentials, false
+	}
+	if len(check.recoveryCode) > 0 {
+		left, err := otpStates.useRecoveryCode(user.CommonName, user.RecoveryCodes, check.recoveryCode)
+		if err != nil {
+			clog.Warningf("Bind Error: recovery code of '%s' from '%s': %s", bindDN, conn.RemoteAddr().String(), err.Error())
+			rec.fail(bindOutcomeBadOTP, "invalid recovery_code OTP")
+			return ldap.LDAPResultInvalidCredentials, false
+		}
+		clog.Noticef("Recovery code used by '%s', %d left", bindDN, left)
+	}
+	return ldap.LDAPResultSuccess, true
+}
+
 //
 func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn net.Conn) (result ldap.ServerSearchResult, err error) {
 	bindDN = strings.ToLower(bindDN)
 	baseDN := strings.ToLower("," + h.cfg.Backend.BaseDN)
 	searchBaseDN := strings.ToLower(searchReq.BaseDN)
-	log.Infof("Search request '%s' as '%s' from %s", searchReq.Filter, bindDN, conn.RemoteAddr().String())
-	log.Debugf("Search request: %#v as '%s' from %s", searchReq, bindDN, conn.RemoteAddr().String())
+	clog := newConnLogger(conn)
+	filterEntity := "unknown"
+	rec := newAuditRecord("search", bindDN, conn)
+	rec.BaseDN = searchReq.BaseDN
+	rec.Filter = searchReq.Filter
+	defer func(start time.Time) {
+		observeSearch(filterEntity, result.ResultCode, start)
+		if err != nil {
+			rec.Reason = err.Error()
+		}
+		rec.write(result.ResultCode)
+	}(time.Now())
+	clog.Infof("Search request '%s' as '%s' from %s", searchReq.Filter, bindDN, conn.RemoteAddr().String())
+	clog.Debugf("Search request: %#v as '%s' from %s", searchReq, bindDN, conn.RemoteAddr().String())
 
 	// validate the user is authenticated and has appropriate access
 	if len(bindDN) < 1 {
@@ -135,16 +386,33 @@ func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn
 	if !strings.HasSuffix(bindDN, baseDN) {
 		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, fmt.Errorf("Search Error: BindDN %s not in our BaseDN %s", bindDN, h.cfg.Backend.BaseDN)
 	}
+	if sessionMustChangePassword(conn) {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, fmt.Errorf("Search Error: %s must change their password first", bindDN)
+	}
+	if control := ldap.FindControl(searchReq.Controls, controlTypeProxiedAuthz); control != nil {
+		authzDN, code, err := h.proxiedAuthz(bindDN, control)
+		if err != nil {
+			return ldap.ServerSearchResult{ResultCode: code}, err
+		}
+		clog.Infof("Search as '%s' for '%s'", authzDN, bindDN)
+		// the ACLs apply to the proxied user
+		bindDN = authzDN
+		rec.AuthzDN = authzDN
+		if len(bindDN) < 1 {
+			return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, fmt.Errorf("Search Error: Anonymous BindDN not allowed %s", bindDN)
+		}
+	}
 	if !strings.HasSuffix(searchBaseDN, h.cfg.Backend.BaseDN) {
 		searchBaseDN = fmt.Sprintf("%s,%s", searchBaseDN, h.cfg.Backend.BaseDN) // Some applications send empty baseDN (e.g. Jenkins)
 		// return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, fmt.Errorf("Search Error: search BaseDN %s is not in our BaseDN %s", searchBaseDN, h.cfg.Backend.BaseDN)
 	}
 	// return all users in the config file - the LDAP library will filter results for us
 	entries := []*ldap.Entry{}
-	filterEntity, err := ldap.GetFilterObjectClass(searchReq.Filter)
+	objectClass, err := ldap.GetFilterObjectClass(searchReq.Filter)
 	if err != nil {
 		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultOperationsError}, fmt.Errorf("Search Error: error parsing filter: %s", searchReq.Filter)
 	}
+	filterEntity = objectClass
 
 	traverseGroups := false
 	traverseUsers := false
@@ -164,6 +432,9 @@ func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn
 
 	if traverseUsers {
 		for _, u := range h.cfg.Users {
+			if h.hidden(&u) {
+				continue
+			}
 			attrs := h.userLdapAttributes(&u)
 			dn := fmt.Sprintf("cn=%s,ou=users,%s", u.CommonName, h.cfg.Backend.BaseDN)
 			entries = append(entries, &ldap.Entry{DN: dn, Attributes: attrs})
@@ -178,7 +449,7 @@ func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn
 		}
 	}
 
-	log.Infof("AP: Search OK: %s", searchReq.Filter)
+	clog.Infof("AP: Search OK: %s", searchReq.Filter)
 	return ldap.ServerSearchResult{
 		Entries:    filterLdapEntriesByBaseDN(entries, searchReq.BaseDN),
 		Referrals:  []string{},
@@ -187,7 +458,157 @@ func (h configHandler) Search(bindDN string, searchReq ldap.SearchRequest, conn
 	}, nil
 }
 
+// proxiedAuthz returns the DN a Search runs as, from the proxied authorization
+// control (RFC 4370) of the bound user. Only members of proxyAuthzGroup may
+// use it, and only to act as an enabled user, or anonymously.
+func (h configHandler) proxiedAuthz(bindDN string, control ldap.Control) (string, ldap.LDAPResultCode, error) {
+	c, ok := control.(*ldap.ControlString)
+	if !ok || !c.Criticality {
+		return "", ldap.LDAPResultProtocolError, fmt.Errorf("Search Error: the proxied authorization control must be critical")
+	}
+	if name, ok := h.groupAccess(bindDN, h.cfg.Backend.ProxyAuthzGroup); !ok {
+		return "", ldapResultAuthorizationDenied, fmt.Errorf("Search Error: '%s' may not use proxied authorization", name)
+	}
+
+	authzID := c.ControlValue
+	var cn string
+	switch {
+	case len(authzID) == 0:
+		return "", ldap.LDAPResultSuccess, nil
+	case strings.HasPrefix(authzID, "dn:"):
+		ou, name, ok := parseEntryDN(strings.TrimPrefix(authzID, "dn:"), h.cfg.Backend.BaseDN)
+		if !ok || ou != "users" {
+			return "", ldapResultAuthorizationDenied, fmt.Errorf("Search Error: proxied authorization ID %s is not a user", authzID)
+		}
+		cn = name
+	case strings.HasPrefix(authzID, "u:"):
+		cn = strings.TrimPrefix(authzID, "u:")
+	default:
+		return "", ldap.LDAPResultProtocolError, fmt.Errorf("Search Error: invalid proxied authorization ID %s", authzID)
+	}
+	for _, u := range h.cfg.Users {
+		if strings.EqualFold(u.CommonName, cn) && u.active(time.Now()) {
+			return strings.ToLower(fmt.Sprintf("cn=%s,ou=users,%s", u.CommonName, h.cfg.Backend.BaseDN)), ldap.LDAPResultSuccess, nil
+		}
+	}
+	return "", ldapResultAuthorizationDenied, fmt.Errorf("Search Error: proxied authorization ID %s is not an enabled user", authzID)
+}
+
+// Compare checks a value of a user or group entry, with the access and
+// matching rules of Search. userPassword is checked against the password
+// hash, except for users with a second factor: their password alone must not
+// be verifiable. It never matches for users who can't bind.
+func (h configHandler) Compare(boundDN string, req ldap.CompareRequest, conn net.Conn) (resultCode ldap.LDAPResultCode, err error) {
+	dn, attribute, value := compareRequestFields(req)
+	bindDN := strings.ToLower(boundDN)
+	clog := newConnLogger(conn)
+	rec := newAuditRecord("compare", bindDN, conn)
+	rec.DN = dn
+	rec.Attribute = attribute
+	defer func() {
+		observeCompare(resultCode)
+		rec.write(resultCode)
+	}()
+	clog.Infof("Compare request: %s of '%s' as '%s' from %s", attribute, dn, bindDN, conn.RemoteAddr().String())
+
+	// validate the user is authenticated and has appropriate access
+	if len(bindDN) < 1 {
+		clog.Warningf("Compare Error: Anonymous BindDN not allowed")
+		rec.Reason = "anonymous BindDN not allowed"
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	if !strings.HasSuffix(bindDN, strings.ToLower(","+h.cfg.Backend.BaseDN)) {
+		clog.Warningf("Compare Error: BindDN %s not in our BaseDN %s", bindDN, h.cfg.Backend.BaseDN)
+		rec.Reason = "bind DN not in base DN"
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	if sessionMustChangePassword(conn) {
+		clog.Warningf("Compare Error: %s must change their password first", bindDN)
+		rec.Reason = "password must be changed"
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	// Compare of userPassword checks a password like a Bind: only admins may
+	// check those of others
+	passwordCheck := strings.EqualFold(attribute, "userPassword")
+	if _, admin := h.writeAccess(bindDN); passwordCheck && !admin && !sameDN(dn, bindDN) {
+		clog.Warningf("Compare Error: %s is not a member of the admin group to compare the userPassword of '%s'", bindDN, dn)
+		rec.fail(bindOutcomePolicy, "userPassword of another user")
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+
+	ou, cn, ok := parseEntryDN(dn, h.cfg.Backend.BaseDN)
+	attrs := ldapAttrs(nil)
+	if ok && ou == "users" {
+		for _, u := range h.cfg.Users {
+			if !strings.EqualFold(u.CommonName, cn) || h.hidden(&u) {
+				continue
+			}
+			if passwordCheck {
+				rec.User = u.CommonName
+				outside := u.outsideValidity(time.Now())
+				switch {
+				case len(u.UserPassword) == 0:
+					rec.fail(bindOutcomeBadPassword, "no userPassword")
+					return ldap.LDAPResultNoSuchAttribute, nil
+				case u.hasOTP():
+					clog.Warningf("Compare Error: userPassword of '%s', who has a second factor", dn)
+					rec.fail(bindOutcomeOTPRequired, "userPassword of a user with a second factor")
+					return ldap.LDAPResultUnwillingToPerform, nil
+				case u.Disabled:
+					// like a Bind, which would fail
+					clog.Warningf("Compare Error: userPassword of '%s', who is disabled", dn)
+					rec.fail(bindOutcomeAccountDisabled, "account disabled")
+					return ldap.LDAPResultCompareFalse, nil
+				case len(outside) > 0:
+					clog.Warningf("Compare Error: userPassword of '%s', who is %s", dn, outside)
+					rec.fail(bindOutcomeAccountInactive, "account "+outside)
+					return ldap.LDAPResultCompareFalse, nil
+				}
+				if ok, _ := checkPassword(u.UserPassword, value); ok {
+					rec.Outcome = bindOutcomeSuccess
+					rec.Factors = []string{"password"}
+					return ldap.LDAPResultCompareTrue, nil
+				}
+				clog.Warningf("Compare: invalid userPassword of '%s'", dn)
+				rec.fail(bindOutcomeBadPassword, "invalid password")
+				return ldap.LDAPResultCompareFalse, nil
+			}
+			attrs = h.userLdapAttributes(&u)
+		}
+	} else if ok {
+		for _, g := range h.cfg.Groups {
+			if strings.EqualFold(g.CommonName, cn) {
+				attrs = h.groupLdapAttributes(&g)
+			}
+		}
+	}
+	if attrs == nil {
+		rec.Reason = "no such entry"
+		return ldap.LDAPResultNoSuchObject, nil
+	}
+
+	// Search filters match values case-insensitively
+	found := false
+	for _, attr := range attrs {
+		if !strings.EqualFold(attr.Name, attribute) {
+			continue
+		}
+		found = true
+		for _, v := range attr.Values {
+			if strings.EqualFold(v, value) {
+				return ldap.LDAPResultCompareTrue, nil
+			}
+		}
+	}
+	if !found {
+		return ldap.LDAPResultNoSuchAttribute, nil
+	}
+	return ldap.LDAPResultCompareFalse, nil
+}
+
 //
 func (h configHandler) Close(boundDn string, conn net.Conn) error {
+	newConnLogger(conn).Debugf("Connection closed, bound as '%s'", boundDn)
+	newAuditRecord("close", boundDn, conn).write(ldap.LDAPResultSuccess)
 	return nil
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/metala/ldap"
 )
@@ -22,11 +24,12 @@ func (attrs *ldapAttrs) addAttributes(name string, values []string) {
 
 func (h configHandler) userLdapAttributes(u *configUser) ldapAttrs {
 	attrs := ldapAttrs{}
+	now := time.Now()
 
 	attrs.addAttributes("objectClass", []string{"inetOrgPerson", "person", "uidObject"})
 	posixAccount := u.PosixUserID > 0 && u.PosixGroupID > 0
 	if posixAccount {
-		attrs.addAttribute("objectClass", "posixAccount")
+		attrs.addAttributes("objectClass", []string{"posixAccount", "shadowAccount"})
 	}
 	// General
 	attrs.addAttribute("cn", u.CommonName)
@@ -68,7 +71,7 @@ func (h configHandler) userLdapAttributes(u *configUser) ldapAttrs {
 			attrs.addAttribute("homeDirectory", "/home/"+u.CommonName)
 		}
 
-		if u.Disabled {
+		if !u.active(now) {
 			attrs.addAttribute("loginDisabled", "TRUE")
 		} else {
 			attrs.addAttribute("loginDisabled", "FALSE")
@@ -77,9 +80,15 @@ func (h configHandler) userLdapAttributes(u *configUser) ldapAttrs {
 		if len(u.SSHKeys) > 0 {
 			attrs.addAttributes("sshPublicKey", u.SSHKeys)
 		}
+
+		h.addShadowAttributes(&attrs, u, now)
+	}
+
+	if changed, err := parseConfigTime(u.PwdChangedTime); err == nil {
+		attrs.addAttribute("pwdChangedTime", changed.UTC().Format("20060102150405Z"))
 	}
 
-	if u.Disabled {
+	if !u.active(now) {
 		attrs.addAttribute("accountStatus", "inactive")
 	} else {
 		attrs.addAttribute("accountStatus", "active")
@@ -94,6 +103,34 @@ func (h configHandler) userLdapAttributes(u *configUser) ldapAttrs {
 	return attrs
 }
 
+// addShadowAttributes adds the shadowAccount attributes PAM checks, in days
+// since 1970-01-01: a shadowLastChange of 0 makes the user change their
+// password, and a shadowExpire of 1 is an account that expired long ago.
+func (h configHandler) addShadowAttributes(attrs *ldapAttrs, u *configUser, now time.Time) {
+	policy := &h.cfg.PasswordPolicy
+	changed, err := parseConfigTime(u.PwdChangedTime)
+	if err == nil {
+		lastChange := epochDays(changed)
+		if u.PasswordMustChange {
+			lastChange = 0
+		}
+		attrs.addAttribute("shadowLastChange", strconv.Itoa(lastChange))
+		maxDays := policy.MaxAgeDays
+		if expires, ok := u.passwordExpiry(policy); ok && len(u.PasswordExpires) > 0 {
+			maxDays = epochDays(expires) - epochDays(changed)
+		}
+		if maxDays > 0 {
+			attrs.addAttribute("shadowMax", strconv.Itoa(maxDays))
+			if policy.ExpireWarningDays > 0 {
+				attrs.addAttribute("shadowWarning", strconv.Itoa(policy.ExpireWarningDays))
+			}
+		}
+	}
+	if expire := u.shadowExpire(now); expire > 0 {
+		attrs.addAttribute("shadowExpire", strconv.Itoa(expire))
+	}
+}
+
 func (h configHandler) groupLdapAttributes(g *configGroup) ldapAttrs {
 	attrs := ldapAttrs{}
 
@@ -108,17 +145,54 @@ func (h configHandler) getGroupMembers(cn string) []string {
 	names := []string{}
 
 	for _, u := range h.cfg.Users {
-		if idx := findIndex(u.GroupNames, cn); idx != -1 {
+		if idx := findIndex(u.GroupNames, cn); idx != -1 && !h.hidden(&u) {
 			names = append(names, u.distingushedName(h.cfg.Backend.BaseDN))
 		}
 	}
 	return names
 }
 
+// hidden reports whether a user is left out of searches and group members,
+// with backend.hideDisabled
+func (h configHandler) hidden(u *configUser) bool {
+	return h.cfg.Backend.HideDisabled && !u.active(time.Now())
+}
+
 func (u configUser) distingushedName(baseDN string) string {
 	return fmt.Sprintf("cn=%s,ou=users,%s", u.CommonName, baseDN)
 }
 
+// otpDevices returns the TOTP secrets and Yubikeys of a user in the order
+// they are tried, the single otpSecret and yubikey settings first
+func (u configUser) otpDevices() ([]configUserOTPSecret, []configUserYubikey) {
+	secrets := []configUserOTPSecret{}
+	if len(u.OTPSecret) > 0 {
+		secrets = append(secrets, configUserOTPSecret{Name: "otpSecret", Secret: u.OTPSecret})
+	}
+	secrets = append(secrets, u.OTPSecrets...)
+	yubikeys := []configUserYubikey{}
+	if len(u.Yubikey) > 0 {
+		yubikeys = append(yubikeys, configUserYubikey{ID: u.Yubikey})
+	}
+	yubikeys = append(yubikeys, u.Yubikeys...)
+	return secrets, yubikeys
+}
+
+// hasOTP reports whether a user must bind with a second factor. Disabled
+// devices count, so disabling a user's last device doesn't turn off their 2FA.
+func (u configUser) hasOTP() bool {
+	return len(u.OTPSecret) > 0 || len(u.Yubikey) > 0 || len(u.OTPSecrets) > 0 || len(u.Yubikeys) > 0 ||
+		len(u.HOTPSecrets) > 0 || len(u.RecoveryCodes) > 0 || u.Push
+}
+
+// label names a Yubikey in logs, by its ID unless it has a name
+func (y configUserYubikey) label() string {
+	if len(y.Name) > 0 {
+		return y.Name
+	}
+	return y.ID
+}
+
 func (g configGroup) distingushedName(baseDN string) string {
 	return fmt.Sprintf("cn=%s,ou=groups,%s", g.CommonName, baseDN)
 }
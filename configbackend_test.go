@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/metala/ldap"
+	"github.com/op/go-logging"
+	"github.com/pquerna/otp/totp"
+)
+
+const testBaseDN = "dc=example,dc=com"
+
+// the hash of "secret"
+const testPasswordHash = "{SSHA256}+E+iFJ27Yu1ODPH1UNKUmzOmUT06dwfghQJRHHnMsO5zYWx0"
+
+var testConnID uint64
+
+// testConn is a client connection with a connection ID and a TCP source, as
+// the listeners hand them to the handlers
+type testConn struct {
+	net.Conn
+	addr connAddr
+}
+
+func (c testConn) RemoteAddr() net.Addr { return c.addr }
+
+func newTestConn(t *testing.T) testConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	id := atomic.AddUint64(&testConnID, 1)
+	return testConn{server, connAddr{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, id, "test"}}
+}
+
+// newTestHandler serves the users and groups of cfg below testBaseDN
+func newTestHandler(cfg *config) configHandler {
+	if len(cfg.Backend.BaseDN) == 0 {
+		cfg.Backend.BaseDN = testBaseDN
+	}
+	return newConfigHandler(cfg, nil).(configHandler)
+}
+
+func userDN(name string) string {
+	return "cn=" + name + ",ou=users," + testBaseDN
+}
+
+// lockedBuffer is a bytes.Buffer that test servers may write to while the
+// test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns the content of the buffer and empties it
+func (b *lockedBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+// captureAudit returns the audit records written until the test ends
+func captureAudit(t *testing.T) func() []auditRecord {
+	out := &lockedBuffer{}
+	backend := logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), logging.MustStringFormatter("%{message}")))
+	backend.SetLevel(logging.NOTICE, auditModule)
+	auditLog = logging.MustGetLogger(auditModule)
+	auditLog.SetBackend(backend)
+	t.Cleanup(func() { auditLog = nil })
+	return func() []auditRecord {
+		records := []auditRecord{}
+		for _, line := range strings.Split(strings.TrimSpace(out.take()), "\n") {
+			record := auditRecord{}
+			if err := json.Unmarshal([]byte(line), &record); err == nil {
+				records = append(records, record)
+			}
+		}
+		return records
+	}
+}
+
+// search returns the DNs found by a subtree search of the base DN
+func search(t *testing.T, h configHandler, boundDN, filter string) []string {
+	result, err := h.Search(boundDN, ldap.SearchRequest{BaseDN: testBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: filter}, newTestConn(t))
+	if err != nil || result.ResultCode != ldap.LDAPResultSuccess {
+		t.Fatalf("Search %s as %s: %d %v", filter, boundDN, result.ResultCode, err)
+	}
+	dns := []string{}
+	for _, entry := range result.Entries {
+		dns = append(dns, entry.DN)
+	}
+	sort.Strings(dns)
+	return dns
+}
+
+// groupMembers returns the member values of a group found by Search
+func groupMembers(t *testing.T, h configHandler, boundDN, group string) []string {
+	result, _ := h.Search(boundDN, ldap.SearchRequest{BaseDN: testBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: "(objectClass=posixGroup)"}, newTestConn(t))
+	for _, entry := range result.Entries {
+		if entry.GetAttributeValue("cn") == group {
+			return entry.GetAttributeValues("member")
+		}
+	}
+	t.Fatalf("group %s not found", group)
+	return nil
+}
+
+// compare runs a Compare request, which the LDAP library only builds from a
+// client request, so its unexported fields are set like compareRequestFields
+// reads them
+func compare(h configHandler, boundDN, dn, attribute, value string, conn net.Conn) ldap.LDAPResultCode {
+	req := ldap.CompareRequest{}
+	v := reflect.ValueOf(&req).Elem()
+	setField(v.FieldByName("dn"), dn)
+	ava := v.FieldByName("ava")
+	setField(ava, reflect.MakeSlice(ava.Type(), 1, 1).Interface())
+	setField(ava.Index(0).FieldByName("attributeDesc"), attribute)
+	setField(ava.Index(0).FieldByName("assertionValue"), value)
+	code, err := h.Compare(boundDN, req, conn)
+	if err != nil {
+		// as the LDAP library answers handler errors
+		return ldap.LDAPResultOperationsError
+	}
+	return code
+}
+
+func setField(field reflect.Value, value interface{}) {
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(value))
+}
+
+func disabledUsersConfig(hideDisabled bool) *config {
+	return &config{
+		Backend: configBackend{HideDisabled: hideDisabled},
+		Users: []configUser{
+			{CommonName: "alice", UserPassword: testPasswordHash, PosixUserID: 5001, PosixGroupID: 5000, GroupNames: []string{"staff"}},
+			{CommonName: "bob", UserPassword: testPasswordHash, PosixUserID: 5002, PosixGroupID: 5000, GroupNames: []string{"staff"}, Disabled: true},
+			{CommonName: "carol", UserPassword: testPasswordHash, PosixUserID: 5003, PosixGroupID: 5000, GroupNames: []string{"staff"}, ValidUntil: "2000-01-01"},
+		},
+		Groups: []configGroup{{CommonName: "staff"}},
+	}
+}
+
+// bindRecords returns the Bind records of the audit records, without the
+// closes of the connections of earlier tests
+func bindRecords(records []auditRecord) []auditRecord {
+	binds := []auditRecord{}
+	for _, record := range records {
+		if record.Operation == "bind" {
+			binds = append(binds, record)
+		}
+	}
+	return binds
+}
+
+// bind binds as dn on conn, and returns the result and the audit record of
+// the Bind
+func bind(t *testing.T, h configHandler, audit func() []auditRecord, dn, password string, conn net.Conn) (ldap.LDAPResultCode, auditRecord) {
+	code, _ := h.Bind(dn, password, conn)
+	records := bindRecords(audit())
+	if len(records) != 1 {
+		t.Fatalf("Bind as %s: %d audit records", dn, len(records))
+	}
+	return code, records[0]
+}
+
+func TestBindDisabledUser(t *testing.T) {
+	audit := captureAudit(t)
+	for _, hideDisabled := range []bool{false, true} {
+		h := newTestHandler(disabledUsersConfig(hideDisabled))
+		tests := []struct {
+			user    string
+			code    ldap.LDAPResultCode
+			outcome string
+			reason  string
+		}{
+			{"alice", ldap.LDAPResultSuccess, bindOutcomeSuccess, ""},
+			{"bob", ldap.LDAPResultInvalidCredentials, bindOutcomeAccountDisabled, "account disabled"},
+			{"carol", ldap.LDAPResultInvalidCredentials, bindOutcomeAccountInactive, "account expired"},
+		}
+		for _, test := range tests {
+			code, err := h.Bind(userDN(test.user), "secret", newTestConn(t))
+			if code != test.code || err != nil {
+				t.Errorf("hideDisabled=%v: Bind as %s: %d %v, want %d", hideDisabled, test.user, code, err, test.code)
+			}
+			records := audit()
+			if len(records) != 1 || records[0].Outcome != test.outcome || records[0].Reason != test.reason {
+				t.Errorf("hideDisabled=%v: Bind as %s: audit %+v, want outcome %q reason %q", hideDisabled, test.user, records, test.outcome, test.reason)
+			}
+		}
+	}
+}
+
+func TestHideDisabled(t *testing.T) {
+	tests := []struct {
+		name         string
+		hideDisabled bool
+		users        []string
+		members      []string
+		compare      ldap.LDAPResultCode // of the uidNumber of bob
+	}{
+		{
+			name:    "shown",
+			users:   []string{userDN("alice"), userDN("bob"), userDN("carol")},
+			members: []string{userDN("alice"), userDN("bob"), userDN("carol")},
+			compare: ldap.LDAPResultCompareTrue,
+		},
+		{
+			name:         "hidden",
+			hideDisabled: true,
+			users:        []string{userDN("alice")},
+			members:      []string{userDN("alice")},
+			compare:      ldap.LDAPResultNoSuchObject,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHandler(disabledUsersConfig(test.hideDisabled))
+			if users := search(t, h, userDN("alice"), "(objectClass=posixAccount)"); strings.Join(users, ";") != strings.Join(test.users, ";") {
+				t.Errorf("users %v, want %v", users, test.users)
+			}
+			if members := groupMembers(t, h, userDN("alice"), "staff"); strings.Join(members, ";") != strings.Join(test.members, ";") {
+				t.Errorf("members %v, want %v", members, test.members)
+			}
+			if code := compare(h, userDN("alice"), userDN("bob"), "uidNumber", "5002", newTestConn(t)); code != test.compare {
+				t.Errorf("Compare uidNumber of bob: %d, want %d", code, test.compare)
+			}
+		})
+	}
+}
+
+// testStore keeps the changes of LDAP writes instead of saving them
+type testStore struct {
+	applied *[]directoryChanges
+}
+
+func (s testStore) apply(changes directoryChanges) error {
+	*s.applied = append(*s.applied, changes)
+	return nil
+}
+
+// bindTestSession registers the session of conn, bound as user with factors
+func bindTestSession(t *testing.T, conn testConn, user string, factors []string, mustChange bool) {
+	s := &session{id: conn.addr.id, operations: map[string]uint64{}}
+	s.authenticated(user, factors)
+	s.passwordPolicy(ppolicyResponse{warning: ppolicyNone, err: ppolicyNone}, mustChange)
+	s.bound(userDN(user), true)
+	sessions.mu.Lock()
+	sessions.sessions[s.id] = s
+	sessions.mu.Unlock()
+	t.Cleanup(func() { sessions.end(s, sessionEndClose) })
+}
+
+func TestCompareUserPassword(t *testing.T) {
+	h := newTestHandler(&config{
+		Backend: configBackend{AdminGroup: "admins"},
+		Users: []configUser{
+			{CommonName: "admin", UserPassword: testPasswordHash, GroupNames: []string{"admins"}},
+			{CommonName: "alice", UserPassword: testPasswordHash},
+			{CommonName: "bob", UserPassword: testPasswordHash, Disabled: true},
+			{CommonName: "olivia", UserPassword: testPasswordHash, OTPSecret: "JBSWY3DPEHPK3PXP"},
+		},
+		Groups: []configGroup{{CommonName: "admins"}},
+	})
+	tests := []struct {
+		name    string
+		bound   string
+		target  string
+		value   string
+		code    ldap.LDAPResultCode
+		outcome string
+		reason  string
+	}{
+		{"own password", "alice", "alice", "secret", ldap.LDAPResultCompareTrue, bindOutcomeSuccess, ""},
+		{"own wrong password", "alice", "alice", "guess", ldap.LDAPResultCompareFalse, bindOutcomeBadPassword, "invalid password"},
+		{"another user", "alice", "admin", "secret", ldap.LDAPResultInsufficientAccessRights, bindOutcomePolicy, "userPassword of another user"},
+		{"unknown user", "alice", "nobody", "secret", ldap.LDAPResultInsufficientAccessRights, bindOutcomePolicy, "userPassword of another user"},
+		{"admin", "admin", "alice", "secret", ldap.LDAPResultCompareTrue, bindOutcomeSuccess, ""},
+		{"admin, wrong password", "admin", "alice", "guess", ldap.LDAPResultCompareFalse, bindOutcomeBadPassword, "invalid password"},
+		{"admin, disabled user", "admin", "bob", "secret", ldap.LDAPResultCompareFalse, bindOutcomeAccountDisabled, "account disabled"},
+		{"admin, second factor", "admin", "olivia", "secret", ldap.LDAPResultUnwillingToPerform, bindOutcomeOTPRequired, "userPassword of a user with a second factor"},
+	}
+	audit := captureAudit(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := compare(h, userDN(test.bound), userDN(test.target), "userPassword", test.value, newTestConn(t)); code != test.code {
+				t.Errorf("Compare: %d, want %d", code, test.code)
+			}
+			records := audit()
+			if len(records) != 1 || records[0].Outcome != test.outcome || records[0].Reason != test.reason {
+				t.Errorf("audit %+v, want outcome %q reason %q", records, test.outcome, test.reason)
+			}
+		})
+	}
+	// other attributes of other users can still be compared
+	if code := compare(h, userDN("alice"), userDN("admin"), "cn", "admin", newTestConn(t)); code != ldap.LDAPResultCompareTrue {
+		t.Errorf("Compare cn of another user: %d", code)
+	}
+}
+
+func TestSearchProxiedAuthz(t *testing.T) {
+	h := newTestHandler(&config{
+		Backend: configBackend{ProxyAuthzGroup: "proxies"},
+		Users: []configUser{
+			{CommonName: "portal", UserPassword: testPasswordHash, GroupNames: []string{"proxies"}},
+			{CommonName: "alice", UserPassword: testPasswordHash},
+			{CommonName: "bob", UserPassword: testPasswordHash, Disabled: true},
+		},
+		Groups: []configGroup{{CommonName: "proxies"}},
+	})
+	tests := []struct {
+		name    string
+		bound   string
+		control ldap.Control
+		code    ldap.LDAPResultCode
+		authzDN string
+		entries int
+	}{
+		{"as a user by DN", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "dn:" + userDN("alice")}, ldap.LDAPResultSuccess, userDN("alice"), 3},
+		{"as a user by name", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "u:Alice"}, ldap.LDAPResultSuccess, userDN("alice"), 3},
+		{"anonymously", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true}, ldap.LDAPResultInsufficientAccessRights, "", 0},
+		{"not critical", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, ControlValue: "u:alice"}, ldap.LDAPResultProtocolError, "", 0},
+		{"not a member", "alice", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "u:portal"}, ldapResultAuthorizationDenied, "", 0},
+		{"disabled user", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "u:bob"}, ldapResultAuthorizationDenied, "", 0},
+		{"unknown user", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "u:mallory"}, ldapResultAuthorizationDenied, "", 0},
+		{"group", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "dn:cn=proxies,ou=groups," + testBaseDN}, ldapResultAuthorizationDenied, "", 0},
+		{"invalid ID", "portal", &ldap.ControlString{ControlType: controlTypeProxiedAuthz, Criticality: true, ControlValue: "alice"}, ldap.LDAPResultProtocolError, "", 0},
+	}
+	audit := captureAudit(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := ldap.SearchRequest{BaseDN: testBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: "(objectClass=posixAccount)", Controls: []ldap.Control{test.control}}
+			result, _ := h.Search(userDN(test.bound), req, newTestConn(t))
+			if result.ResultCode != test.code || len(result.Entries) != test.entries {
+				t.Errorf("Search: %d with %d entries, want %d with %d", result.ResultCode, len(result.Entries), test.code, test.entries)
+			}
+			if records := audit(); len(records) != 1 || records[0].AuthzDN != test.authzDN {
+				t.Errorf("audit %+v, want authzDn %q", records, test.authzDN)
+			}
+		})
+	}
+}
+
+// invalidTOTP returns a code none of the secrets accept now
+func invalidTOTP(secrets ...string) string {
+	for n := 0; ; n++ {
+		code := fmt.Sprintf("%06d", n)
+		valid := false
+		for _, secret := range secrets {
+			valid = valid || totp.Validate(code, secret)
+		}
+		if !valid {
+			return code
+		}
+	}
+}
+
+func TestBindOTPDevices(t *testing.T) {
+	const (
+		legacySecret = "JBSWY3DPEHPK3PXP"
+		phoneSecret  = "KRSXG5CTMVRXEZLU"
+		tabletSecret = "MFRGGZDFMZTWQ2LK"
+		spareYubikey = "ccccccfghijk"
+	)
+	audit := captureAudit(t)
+	cfg := &config{
+		Backend: configBackend{BaseDN: testBaseDN},
+		Users: []configUser{{
+			CommonName:   "alice",
+			UserPassword: testPasswordHash,
+			OTPSecret:    legacySecret,
+			OTPSecrets:   []configUserOTPSecret{{Name: "phone", Secret: phoneSecret}, {Name: "tablet", Secret: tabletSecret, Disabled: true}},
+			Yubikeys:     []configUserYubikey{{ID: testYubikeyID, Name: "keychain"}, {ID: spareYubikey, Disabled: true}},
+		}},
+	}
+	h := newConfigHandler(cfg, newTestYubikeyValidator(t, filepath.Join(t.TempDir(), "counters.json"))).(configHandler)
+	code := func(secret string) string {
+		code, err := totp.GenerateCode(secret, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		outcome  string
+		reason   string
+		factors  string
+		device   string
+	}{
+		{"otpSecret", "secret" + code(legacySecret), bindOutcomeSuccess, "", "password,totp", "otpSecret"},
+		{"TOTP device", "secret" + code(phoneSecret), bindOutcomeSuccess, "", "password,totp", "phone"},
+		{"disabled TOTP device", "secret" + code(tabletSecret), bindOutcomeBadOTP, "disabled totp device", "", "tablet"},
+		{"invalid TOTP", "secret" + invalidTOTP(legacySecret, phoneSecret, tabletSecret), bindOutcomeBadOTP, "invalid totp OTP", "", ""},
+		{"Yubikey", "secret" + yubikeyOTP(testYubikeyID, testYubikeyPrivateID, testYubikeyAESKey, 1, 0), bindOutcomeSuccess, "", "password,yubikey", "keychain"},
+		{"disabled Yubikey", "secret" + yubikeyOTP(spareYubikey, testYubikeyPrivateID, testYubikeyAESKey, 1, 0), bindOutcomeBadOTP, "disabled yubikey device", "", spareYubikey},
+	}
+	for _, test := range tests {
+		code, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		if (code == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome || rec.Reason != test.reason ||
+			strings.Join(rec.Factors, ",") != test.factors || rec.Device != test.device {
+			t.Errorf("%s: %d %+v, want outcome %q reason %q factors %q device %q", test.name, code, rec, test.outcome, test.reason, test.factors, test.device)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pquerna/otp/hotp"
+)
+
+// configProblem is a single semantic error found in the config
+type configProblem struct {
+	file    string
+	line    int
+	message string
+}
+
+func (p configProblem) String() string {
+	if p.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.file, p.line, p.message)
+	}
+	return fmt.Sprintf("%s: %s", p.file, p.message)
+}
+
+// configProblems collects every problem instead of stopping at the first
+type configProblems []configProblem
+
+func (p configProblems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+	return fmt.Sprintf("%d problem(s) found:\n%s", len(p), strings.Join(lines, "\n"))
+}
+
+// configLocator finds the line of a setting in the TOML source, as the
+// decoder does not keep track of positions. Problems in YAML and JSON files
+// are reported without a line.
+type configLocator struct {
+	file  string
+	lines []string
+}
+
+func newConfigLocator(file string) *configLocator {
+	l := &configLocator{file: file}
+	if format, ok := configFormats[strings.ToLower(filepath.Ext(file))]; ok && format != "toml" {
+		return l
+	}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		l.lines = strings.Split(string(data), "\n")
+	}
+	return l
+}
+
+// line returns the line of key in the index-th [[table]] (or in [table] for
+// index -1, or at the top level for an empty table). If the key is not set,
+// the line of the table header is returned.
+func (l *configLocator) line(table string, index int, key string) int {
+	counts := map[string]int{}
+	inTable := len(table) == 0
+	headerLine := 0
+	for i, raw := range l.lines {
+		text := strings.TrimSpace(raw)
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if inTable {
+				// left the table without finding the key
+				return headerLine
+			}
+			name := strings.ToLower(strings.Trim(strings.SplitN(text, "#", 2)[0], "[] \t"))
+			occurrence := -1
+			if strings.HasPrefix(text, "[[") {
+				occurrence = counts[name]
+				counts[name]++
+			}
+			if name == strings.ToLower(table) && occurrence == index {
+				inTable = true
+				headerLine = i + 1
+				if len(key) == 0 {
+					return headerLine
+				}
+			}
+			continue
+		}
+		if !inTable {
+			continue
+		}
+		if eq := strings.Index(text, "="); eq > 0 && strings.EqualFold(strings.Trim(text[:eq], " \t\""), key) {
+			return i + 1
+		}
+	}
+	return headerLine
+}
+
+// configLocators caches a configLocator per config file
+type configLocators map[string]*configLocator
+
+func (l configLocators) get(file string) *configLocator {
+	if _, ok := l[file]; !ok {
+		l[file] = newConfigLocator(file)
+	}
+	return l[file]
+}
+
+// position returns "file:line" of a [[table]] entry, or of key within it, or
+// the file alone when the line is unknown
+func (l configLocators) position(table string, src configSource, key string) string {
+	if line := l.get(src.file).line(table, src.index, key); line > 0 {
+		return fmt.Sprintf("%s:%d", src.file, line)
+	}
+	return src.file
+}
+
+func (l configLocators) problem(table string, src configSource, key string, format string, args ...interface{}) configProblem {
+	return configProblem{src.file, l.get(src.file).line(table, src.index, key), fmt.Sprintf(format, args...)}
+}
+
+// checkConfig validates the users, groups and base DN of a config
+func checkConfig(cfg *config) configProblems {
+	problems := configProblems{}
+	loc := configLocators{}
+
+	if err := validateDN(cfg.Backend.BaseDN); err != nil {
+		src := configSource{cfg.settingSources["backend.basedn"], -1}
+		if len(src.file) == 0 {
+			src.file = cfg.ConfigFile
+		}
+		problems = append(problems, loc.problem("backend", src, "baseDN", "invalid baseDN '%s': %s", cfg.Backend.BaseDN, err.Error()))
+	}
+
+	// LDAP looks entries up by their commonName case-insensitively, but
+	// groupNames must match it exactly
+	groups := map[string]int{}
+	groupNames := map[string]bool{}
+	for i, g := range cfg.Groups {
+		src := cfg.groupSource(i)
+		if len(g.CommonName) == 0 {
+			problems = append(problems, loc.problem("groups", src, "", "group #%d has no commonName", src.index))
+			continue
+		}
+		if first, ok := groups[strings.ToLower(g.CommonName)]; ok {
+			problems = append(problems, loc.problem("groups", src, "commonName", "group '%s' is already defined at %s", g.CommonName, loc.position("groups", cfg.groupSource(first), "commonName")))
+			continue
+		}
+		groups[strings.ToLower(g.CommonName)] = i
+		groupNames[g.CommonName] = true
+	}
+
+	users := map[string]int{}
+	uids := map[int]int{}
+	for i, u := range cfg.Users {
+		src := cfg.userSource(i)
+		if len(u.CommonName) == 0 {
+			problems = append(problems, loc.problem("users", src, "", "user #%d has no commonName", src.index))
+		} else if first, ok := users[strings.ToLower(u.CommonName)]; ok {
+			problems = append(problems, loc.problem("users", src, "commonName", "user '%s' is already defined at %s", u.CommonName, loc.position("users", cfg.userSource(first), "commonName")))
+		} else {
+			users[strings.ToLower(u.CommonName)] = i
+		}
+
+		if u.PosixUserID > 0 {
+			if first, ok := uids[u.PosixUserID]; ok {
+				problems = append(problems, loc.problem("users", src, "posixUserID", "user '%s': posixUserID %d is already used by '%s' at %s", u.CommonName, u.PosixUserID, cfg.Users[first].CommonName, loc.position("users", cfg.userSource(first), "posixUserID")))
+			} else {
+				uids[u.PosixUserID] = i
+			}
+		}
+
+		for _, groupName := range u.GroupNames {
+			if !groupNames[groupName] {
+				problems = append(problems, loc.problem("users", src, "groupNames", "user '%s': group '%s' does not exist", u.CommonName, groupName))
+			}
+		}
+
+		if len(u.UserPassword) > 0 {
+			if _, _, _, err := parsePassword(u.UserPassword); err != nil {
+				problems = append(problems, loc.problem("users", src, "userPassword", "user '%s': invalid userPassword: %s", u.CommonName, err.Error()))
+			}
+		}
+
+		if len(u.OTPSecret) > 0 {
+			if _, err := hotp.GenerateCode(u.OTPSecret, 0); err != nil {
+				problems = append(problems, loc.problem("users", src, "otpSecret", "user '%s': otpSecret is not valid base32", u.CommonName))
+			}
+		}
+
+		// HOTP counters are kept by device name
+		for _, list := range []struct {
+			key     string
+			secrets []configUserOTPSecret
+		}{{"otpSecrets", u.OTPSecrets}, {"hotpSecrets", u.HOTPSecrets}} {
+			key, secrets := list.key, list.secrets
+			names := map[string]bool{"otpsecret": key == "otpSecrets" && len(u.OTPSecret) > 0}
+			for j, secret := range secrets {
+				switch {
+				case len(secret.Name) == 0:
+					problems = append(problems, loc.problem("users", src, key, "user '%s': %s #%d has no name", u.CommonName, key, j))
+				case names[strings.ToLower(secret.Name)]:
+					problems = append(problems, loc.problem("users", src, key, "user '%s': %s name '%s' is used twice", u.CommonName, key, secret.Name))
+				}
+				names[strings.ToLower(secret.Name)] = true
+				if _, err := hotp.GenerateCode(secret.Secret, 0); err != nil || len(secret.Secret) == 0 {
+					problems = append(problems, loc.problem("users", src, key, "user '%s': secret of %s '%s' is not valid base32", u.CommonName, key, secret.Name))
+				}
+			}
+		}
+
+		checkAppPasswords(&cfg.Users[i], func(format string, args ...interface{}) {
+			problems = append(problems, loc.problem("users", src, "appPasswords", format, args...))
+		})
+
+		checkPasswordPolicy(&cfg.Users[i], func(key, format string, args ...interface{}) {
+			problems = append(problems, loc.problem("users", src, key, format, args...))
+		})
+		checkAccountValidity(&cfg.Users[i], func(key, format string, args ...interface{}) {
+			problems = append(problems, loc.problem("users", src, key, format, args...))
+		})
+
+		for j, code := range u.RecoveryCodes {
+			if _, _, _, err := parsePassword(code); err != nil {
+				problems = append(problems, loc.problem("users", src, "recoveryCodes", "user '%s': invalid recoveryCodes #%d: %s", u.CommonName, j, err.Error()))
+			}
+		}
+
+		if len(u.Yubikey) > 0 {
+			if _, err := modhexDecode(u.Yubikey); err != nil || len(u.Yubikey) != yubikeyPublicIDLength {
+				problems = append(problems, loc.problem("users", src, "yubikey", "user '%s': invalid Yubikey ID '%s': expected %d modhex characters", u.CommonName, u.Yubikey, yubikeyPublicIDLength))
+			}
+		}
+		ids := map[string]bool{strings.ToLower(u.Yubikey): len(u.Yubikey) > 0}
+		for _, yubikey := range u.Yubikeys {
+			if _, err := modhexDecode(yubikey.ID); err != nil || len(yubikey.ID) != yubikeyPublicIDLength {
+				problems = append(problems, loc.problem("users", src, "yubikeys", "user '%s': invalid Yubikey ID '%s': expected %d modhex characters", u.CommonName, yubikey.ID, yubikeyPublicIDLength))
+			} else if ids[strings.ToLower(yubikey.ID)] {
+				problems = append(problems, loc.problem("users", src, "yubikeys", "user '%s': Yubikey '%s' is listed twice", u.CommonName, yubikey.ID))
+			}
+			ids[strings.ToLower(yubikey.ID)] = true
+		}
+	}
+
+	return problems
+}
+
+// validateDN checks that dn is a sequence of attribute=value RDNs
+func validateDN(dn string) error {
+	if len(strings.TrimSpace(dn)) == 0 {
+		return fmt.Errorf("empty DN")
+	}
+	for _, rdn := range strings.Split(dn, ",") {
+		parts := strings.SplitN(rdn, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return fmt.Errorf("'%s' is not an attribute=value pair", rdn)
+		}
+		for _, c := range strings.TrimSpace(parts[0]) {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+				return fmt.Errorf("invalid attribute type '%s'", parts[0])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfigHeader is the smallest config file that loads: a base DN and a
+// listener
+const testConfigHeader = "[backend]\n  baseDN = \"dc=example,dc=com\"\n[ldap]\n  enabled = true\n  listen = \"127.0.0.1:3899\"\n[ldaps]\n  enabled = false\n"
+
+// writeConfigFiles writes config files to a temporary directory, and returns
+// the path of the first one named
+func writeConfigFiles(t *testing.T, names []string, contents ...string) string {
+	dir := t.TempDir()
+	for i, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents[i]), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, names[0])
+}
+
+// loadConfigProblems loads a config file, and returns the problems
+// checkConfig found in it
+func loadConfigProblems(t *testing.T, configFile string) []string {
+	_, err := loadConfig(configFile, "")
+	problems, ok := err.(configProblems)
+	if err != nil && !ok {
+		t.Fatalf("loadConfig: %s", err.Error())
+	}
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, strings.ReplaceAll(problem.String(), filepath.Dir(configFile)+string(filepath.Separator), ""))
+	}
+	return messages
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name:   "valid",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  groupNames = [\"staff\"]\n  yubikey = \"cccccbdefghi\"\n[[groups]]\n  commonName = \"staff\"\n",
+		},
+		{
+			name:   "duplicate users",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n[[users]]\n  commonName = \"Alice\"\n",
+			problems: []string{
+				"config.toml:11: user 'Alice' is already defined at config.toml:9",
+			},
+		},
+		{
+			name:   "duplicate groups",
+			config: testConfigHeader + "[[groups]]\n  commonName = \"staff\"\n[[groups]]\n  commonName = \"STAFF\"\n",
+			problems: []string{
+				"config.toml:11: group 'STAFF' is already defined at config.toml:9",
+			},
+		},
+		{
+			// groupNames match the commonName of the group exactly
+			name:   "group name case",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  groupNames = [\"Staff\"]\n[[groups]]\n  commonName = \"staff\"\n",
+			problems: []string{
+				"config.toml:10: user 'alice': group 'Staff' does not exist",
+			},
+		},
+		{
+			name:   "invalid yubikey",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  yubikey = \"cccccbdefgh\"\n[[users]]\n  commonName = \"bob\"\n  yubikey = \"abcdefabcdef\"\n",
+			problems: []string{
+				"config.toml:10: user 'alice': invalid Yubikey ID 'cccccbdefgh': expected 12 modhex characters",
+				"config.toml:13: user 'bob': invalid Yubikey ID 'abcdefabcdef': expected 12 modhex characters",
+			},
+		},
+		{
+			name:   "yubikey listed twice",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  yubikey = \"cccccbdefghi\"\n  yubikeys = [{id = \"CCCCCBDEFGHI\"}, {id = \"cccccbdefgh\"}]\n",
+			problems: []string{
+				"config.toml:11: user 'alice': Yubikey 'CCCCCBDEFGHI' is listed twice",
+				"config.toml:11: user 'alice': invalid Yubikey ID 'cccccbdefgh': expected 12 modhex characters",
+			},
+		},
+		{
+			name:   "TOTP devices",
+			config: testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  otpSecret = \"JBSWY3DPEHPK3PXP\"\n  otpSecrets = [{name = \"OTPSecret\", secret = \"KRSXG5CTMVRXEZLU\"}, {secret = \"MFRGGZDFMZTWQ2LK\"}, {name = \"phone\", secret = \"not base32!\"}]\n",
+			problems: []string{
+				"config.toml:11: user 'alice': otpSecrets name 'OTPSecret' is used twice",
+				"config.toml:11: user 'alice': otpSecrets #1 has no name",
+				"config.toml:11: user 'alice': secret of otpSecrets 'phone' is not valid base32",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := loadConfigProblems(t, writeConfigFiles(t, []string{"config.toml"}, test.config))
+			if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+				t.Errorf("problems\n%s\nwant\n%s", strings.Join(problems, "\n"), strings.Join(test.problems, "\n"))
+			}
+		})
+	}
+}
+
+func TestCheckConfigIncludes(t *testing.T) {
+	// users of included files are checked against each other, and reported
+	// at the line of the file that defines them
+	configFile := writeConfigFiles(t, []string{"config.toml", "users.yaml", "more.toml"},
+		"include = [\"users.yaml\", \"more.toml\"]\n[backend]\n  baseDN = \"dc=example,dc=com\"\n[ldap]\n  enabled = true\n  listen = \"127.0.0.1:3899\"\n[ldaps]\n  enabled = false\n",
+		"users:\n  - commonName: alice\n",
+		"[[users]]\n  commonName = \"ALICE\"\n",
+	)
+	problems := loadConfigProblems(t, configFile)
+	want := "more.toml:2: user 'ALICE' is already defined at users.yaml"
+	if len(problems) != 1 || problems[0] != want {
+		t.Errorf("problems %q, want %q", problems, want)
+	}
+}
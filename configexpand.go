@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+const secretFilePrefix = "file:"
+
+// settings that are not expanded: include patterns are expanded while the
+// config files are decoded
+var unexpandedSettings = map[string]bool{"include": true, "configFile": true}
+
+// expandConfig resolves ${ENV_VAR} references and file: secrets in every
+// string setting of cfg
+func expandConfig(cfg *config) error {
+	return expandValue(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func expandValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := t.Field(i)
+			if len(field.PkgPath) > 0 {
+				// unexported, not read from the config file
+				continue
+			}
+			name := configKeyName(field.Name)
+			if len(path) == 0 && unexpandedSettings[name] {
+				continue
+			}
+			if len(path) > 0 {
+				name = path + "." + name
+			}
+			if err := expandValue(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		expanded, err := expandString(v.String())
+		if err != nil {
+			return fmt.Errorf("Setting '%s': %s", path, err.Error())
+		}
+		v.SetString(expanded)
+	}
+	return nil
+}
+
+// expandString replaces ${NAME} with the value of the environment variable
+// NAME ($${ stands for a literal ${), then, if the value starts with "file:",
+// replaces it with the contents of that file without the trailing newline
+func expandString(value string) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			out.WriteString(value)
+			break
+		}
+		if start > 0 && value[start-1] == '$' {
+			out.WriteString(value[:start-1] + "${")
+			value = value[start+2:]
+			continue
+		}
+		end := strings.Index(value[start:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated '${' in value")
+		}
+		name := value[start+2 : start+end]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not set", name)
+		}
+		out.WriteString(value[:start] + env)
+		value = value[start+end+1:]
+	}
+
+	expanded := out.String()
+	if !strings.HasPrefix(expanded, secretFilePrefix) {
+		return expanded, nil
+	}
+	secretFile := strings.TrimPrefix(expanded, secretFilePrefix)
+	data, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret: %s", err.Error())
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// configKeyName returns the config file key of a struct field, e.g. "yubikeySecret"
+func configKeyName(fieldName string) string {
+	runes := []rune(fieldName)
+	for i := 0; i < len(runes) && unicode.IsUpper(runes[i]); i++ {
+		// Lower the whole leading acronym, except the start of the next word
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandString(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTHNDS_TEST_HOST", "ldap.example.com")
+	t.Setenv("AUTHNDS_TEST_SECRET_FILE", secretFile)
+	t.Setenv("AUTHNDS_TEST_EMPTY", "")
+
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"plain", "plain", ""},
+		{"${AUTHNDS_TEST_HOST}:636", "ldap.example.com:636", ""},
+		{"${AUTHNDS_TEST_HOST}${AUTHNDS_TEST_EMPTY}/${AUTHNDS_TEST_HOST}", "ldap.example.com/ldap.example.com", ""},
+		{"$${AUTHNDS_TEST_HOST}", "${AUTHNDS_TEST_HOST}", ""},
+		{"cost $5", "cost $5", ""},
+		{"file:" + secretFile, "s3cret", ""},
+		{"file:${AUTHNDS_TEST_SECRET_FILE}", "s3cret", ""},
+		{"${AUTHNDS_TEST_UNSET}", "", "environment variable 'AUTHNDS_TEST_UNSET' is not set"},
+		{"${AUTHNDS_TEST_HOST", "", "unterminated '${' in value"},
+		{"file:" + secretFile + ".missing", "", "unable to read secret"},
+	}
+	for _, test := range tests {
+		expanded, err := expandString(test.value)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || expanded != test.want {
+			t.Errorf("%s: %q %v, want %q", test.value, expanded, err, test.want)
+		}
+	}
+}
+
+func TestLoadExpandedConfig(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "hash")
+	if err := ioutil.WriteFile(secretFile, []byte(testPasswordHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTHNDS_TEST_BASEDN", "dc=example,dc=com")
+	t.Setenv("AUTHNDS_TEST_HASH_FILE", secretFile)
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"expanded", "[backend]\n  baseDN = \"${AUTHNDS_TEST_BASEDN}\"\n[ldap]\n  enabled = true\n  listen = \"127.0.0.1:3899\"\n[ldaps]\n  enabled = false\n" +
+			"[[users]]\n  commonName = \"alice\"\n  userPassword = \"file:${AUTHNDS_TEST_HASH_FILE}\"\n  sshKeys = [\"${AUTHNDS_TEST_BASEDN}\"]\n", ""},
+		{"unset variable", testConfigHeader + "[[users]]\n  commonName = \"alice\"\n  mail = \"${AUTHNDS_TEST_UNSET}\"\n", "Setting 'users[0].mail': environment variable 'AUTHNDS_TEST_UNSET' is not set"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfigFiles(t, []string{"config.toml"}, test.config), "")
+			if len(test.err) > 0 {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Backend.BaseDN != "dc=example,dc=com" || cfg.Users[0].UserPassword != testPasswordHash || cfg.Users[0].SSHKeys[0] != "dc=example,dc=com" {
+				t.Errorf("not expanded: %+v %+v", cfg.Backend, cfg.Users[0])
+			}
+		})
+	}
+}
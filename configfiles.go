@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// arrays of tables that are concatenated across files, rather than being
+// settings that may only be defined once
+var mergedConfigTables = map[string]bool{"users": true, "groups": true, "listeners": true}
+
+// configSource is the file, and the position within that file, of a [[users]]
+// or [[groups]] entry
+type configSource struct {
+	file  string
+	index int
+}
+
+// userSource returns where the i-th user was defined
+func (cfg *config) userSource(i int) configSource {
+	if i < len(cfg.userSources) {
+		return cfg.userSources[i]
+	}
+	return configSource{cfg.ConfigFile, -1}
+}
+
+// groupSource returns where the i-th group was defined
+func (cfg *config) groupSource(i int) configSource {
+	if i < len(cfg.groupSources) {
+		return cfg.groupSources[i]
+	}
+	return configSource{cfg.ConfigFile, -1}
+}
+
+// configDirFiles returns the config file itself, or the config files of a
+// config directory in lexical order
+func configDirFiles(configPath string) ([]string, error) {
+	fi, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{configPath}, nil
+	}
+	files := configDirGlob(configPath)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No .toml, .yaml or .json files in config directory %s", configPath)
+	}
+	return files, nil
+}
+
+// decodeConfigFiles decodes the config file or directory at configPath and
+// every file it includes into cfg. Users, groups and listeners are merged;
+// any other setting may only be defined by a single file. The format of each
+// file is taken from its extension, unless format is set.
+func decodeConfigFiles(cfg *config, configPath string, format string) error {
+	files, err := configDirFiles(configPath)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, file := range files {
+		seen[file] = true
+	}
+	cfg.settingSources = map[string]string{}
+	cfg.includeGlobs = nil
+	includes := []string{}
+
+	for i := 0; i < len(files); i++ {
+		file := files[i]
+		users, groups, listeners := cfg.Users, cfg.Groups, cfg.Listeners
+		cfg.Users, cfg.Groups, cfg.Listeners, cfg.Include = nil, nil, nil, nil
+
+		fileFormat, err := configFileFormat(file, format)
+		if err != nil {
+			return err
+		}
+		var keys [][]string
+		if data, ok := cfg.pending[file]; ok {
+			keys, err = decodeConfigData(cfg, data, fileFormat)
+		} else {
+			keys, err = decodeConfigFile(cfg, file, fileFormat)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+
+		for j := range cfg.Users {
+			cfg.userSources = append(cfg.userSources, configSource{file, j})
+		}
+		for j := range cfg.Groups {
+			cfg.groupSources = append(cfg.groupSources, configSource{file, j})
+		}
+		cfg.Users = append(users, cfg.Users...)
+		cfg.Groups = append(groups, cfg.Groups...)
+		cfg.Listeners = append(listeners, cfg.Listeners...)
+
+		for _, key := range keys {
+			if mergedConfigTables[strings.ToLower(key[0])] || strings.EqualFold(key[0], "include") {
+				continue
+			}
+			name := strings.ToLower(strings.Join(key, "."))
+			// the keys of an array of tables repeat within a file
+			if first, ok := cfg.settingSources[name]; ok && first != file {
+				return fmt.Errorf("Setting '%s' is defined in both %s and %s", strings.Join(key, "."), first, file)
+			}
+			cfg.settingSources[name] = file
+		}
+
+		// Include patterns are relative to the file that contains them
+		for _, pattern := range cfg.Include {
+			pattern, err := expandString(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: setting 'include': %s", file, err.Error())
+			}
+			includes = append(includes, pattern)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(file), pattern)
+			}
+			cfg.includeGlobs = append(cfg.includeGlobs, pattern)
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid include pattern '%s': %s", file, pattern, err.Error())
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				if !seen[match] {
+					seen[match] = true
+					files = append(files, match)
+				}
+			}
+		}
+	}
+
+	cfg.Include = includes
+	cfg.files = files
+	return nil
+}
+
+// configFilesFingerprint returns a fingerprint of the config files and the files
+// matched by the include patterns, which changes when any of them changes
+func configFilesFingerprint(cfg *config) string {
+	files := map[string]bool{}
+	for _, file := range cfg.files {
+		files[file] = true
+	}
+	// Pick up files newly created in an included or config directory
+	if fi, err := os.Stat(cfg.ConfigFile); err == nil && fi.IsDir() {
+		for _, match := range configDirGlob(cfg.ConfigFile) {
+			files[match] = true
+		}
+	}
+	for _, pattern := range cfg.includeGlobs {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			files[match] = true
+		}
+	}
+
+	names := []string{}
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	fingerprint := []string{}
+	for _, file := range names {
+		if fi, err := os.Stat(file); err == nil {
+			fingerprint = append(fingerprint, fmt.Sprintf("%s@%d/%d", file, fi.ModTime().UnixNano(), fi.Size()))
+		}
+	}
+	return strings.Join(fingerprint, "\n")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfigFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string // config.toml, or the directory of the first file, then the other files
+		data   []string
+		users  []string // the users, with the file that defined them
+		groups []string
+		err    string
+	}{
+		{
+			name:  "single file",
+			files: []string{"config.toml"},
+			data:  []string{"[[users]]\n  commonName = \"alice\"\n"},
+			users: []string{"alice@config.toml"},
+		},
+		{
+			name:   "includes",
+			files:  []string{"config.toml", "users/a.toml", "users/b.toml", "groups.toml"},
+			data:   []string{"include = [\"users/*.toml\", \"groups.toml\"]\n[[users]]\n  commonName = \"admin\"\n", "[[users]]\n  commonName = \"alice\"\n", "[[users]]\n  commonName = \"bob\"\n", "[[groups]]\n  commonName = \"staff\"\n"},
+			users:  []string{"admin@config.toml", "alice@users/a.toml", "bob@users/b.toml"},
+			groups: []string{"staff@groups.toml"},
+		},
+		{
+			name:  "nested include",
+			files: []string{"config.toml", "users/a.toml", "users/more/b.toml"},
+			data:  []string{"include = [\"users/a.toml\"]\n", "include = [\"more/*.toml\"]\n[[users]]\n  commonName = \"alice\"\n", "[[users]]\n  commonName = \"bob\"\n"},
+			users: []string{"alice@users/a.toml", "bob@users/more/b.toml"},
+		},
+		{
+			name:  "included twice",
+			files: []string{"config.toml", "users.toml"},
+			data:  []string{"include = [\"users.toml\", \"*.toml\"]\n", "include = [\"config.toml\"]\n[[users]]\n  commonName = \"alice\"\n"},
+			users: []string{"alice@users.toml"},
+		},
+		{
+			name:  "directory",
+			files: []string{"conf.d/", "conf.d/10-backend.toml", "conf.d/20-users.yaml", "conf.d/notes.txt"},
+			data:  []string{"", "[backend]\n  baseDN = \"dc=example,dc=com\"\n", "users:\n  - commonName: alice\n", "not a config file"},
+			users: []string{"alice@conf.d/20-users.yaml"},
+		},
+		{
+			name:  "empty directory",
+			files: []string{"conf.d/", "conf.d/notes.txt"},
+			data:  []string{"", "not a config file"},
+			err:   "No .toml, .yaml or .json files in config directory",
+		},
+		{
+			name:  "setting in two files",
+			files: []string{"config.toml", "backend.toml"},
+			data:  []string{"include = [\"backend.toml\"]\n[backend]\n  baseDN = \"dc=example,dc=com\"\n", "[backend]\n  baseDN = \"dc=example,dc=org\"\n"},
+			err:   "Setting 'backend.baseDN' is defined in both",
+		},
+		{
+			name:  "invalid file",
+			files: []string{"config.toml", "users.toml"},
+			data:  []string{"include = [\"users.toml\"]\n", "[[users]\n"},
+			err:   "users.toml: ",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i, file := range test.files {
+				path := filepath.Join(dir, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasSuffix(file, "/") {
+					continue
+				}
+				if err := ioutil.WriteFile(path, []byte(test.data[i]), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := config{}
+			err := decodeConfigFiles(&cfg, filepath.Join(dir, test.files[0]), "")
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			users, groups := []string{}, []string{}
+			for i, u := range cfg.Users {
+				file, _ := filepath.Rel(dir, cfg.userSource(i).file)
+				users = append(users, u.CommonName+"@"+filepath.ToSlash(file))
+			}
+			for i, g := range cfg.Groups {
+				file, _ := filepath.Rel(dir, cfg.groupSource(i).file)
+				groups = append(groups, g.CommonName+"@"+filepath.ToSlash(file))
+			}
+			if strings.Join(users, ",") != strings.Join(test.users, ",") {
+				t.Errorf("users %v, want %v", users, test.users)
+			}
+			if strings.Join(groups, ",") != strings.Join(test.groups, ",") {
+				t.Errorf("groups %v, want %v", groups, test.groups)
+			}
+		})
+	}
+}
+
+func TestConfigFilesFingerprint(t *testing.T) {
+	configFile := writeConfigFiles(t, []string{"config.toml", "a.toml"}, "include = [\"*.d/*.toml\", \"a.toml\"]\n", "")
+	dir := filepath.Dir(configFile)
+	cfg := config{ConfigFile: configFile}
+	if err := decodeConfigFiles(&cfg, configFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := configFilesFingerprint(&cfg)
+
+	tests := []struct {
+		name   string
+		change func() error
+	}{
+		{"included file changed", func() error {
+			return ioutil.WriteFile(filepath.Join(dir, "a.toml"), []byte("[[users]]\n  commonName = \"alice\"\n"), 0600)
+		}},
+		{"file matching an include created", func() error {
+			if err := os.Mkdir(filepath.Join(dir, "users.d"), 0700); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, "users.d", "b.toml"), nil, 0600)
+		}},
+		{"config file touched", func() error {
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(configFile, later, later)
+		}},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatal(err)
+		}
+		changed := configFilesFingerprint(&cfg)
+		if changed == fingerprint {
+			t.Errorf("%s: the fingerprint didn't change", test.name)
+		}
+		fingerprint = changed
+	}
+	if configFilesFingerprint(&cfg) != fingerprint {
+		t.Error("the fingerprint changed without a change")
+	}
+}
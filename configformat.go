@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config file formats by file extension
+var configFormats = map[string]string{
+	".toml": "toml",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+}
+
+// configFileFormat returns the format of a config file: the format option if
+// set, otherwise the one of its extension
+func configFileFormat(file string, format string) (string, error) {
+	if len(format) > 0 {
+		switch format {
+		case "toml", "yaml", "json":
+			return format, nil
+		}
+		return "", fmt.Errorf("Unknown config format '%s': please use one of 'toml', 'yaml' or 'json'", format)
+	}
+	if format, ok := configFormats[strings.ToLower(filepath.Ext(file))]; ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("%s: unknown config file extension, please use .toml, .yaml or .json or set --format", file)
+}
+
+// configDirGlob returns the config files of a config directory, in lexical order
+func configDirGlob(dir string) []string {
+	files := []string{}
+	for ext := range configFormats {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// decodeConfigFile decodes a single config file into cfg and returns the keys
+// of the settings it defines, leaving out tables
+func decodeConfigFile(cfg *config, file string, format string) ([][]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfigData(cfg, data, format)
+}
+
+// decodeConfigData decodes a config document into cfg, see decodeConfigFile
+func decodeConfigData(cfg *config, data []byte, format string) ([][]string, error) {
+	if format == "toml" {
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return nil, err
+		}
+		keys := [][]string{}
+		for _, key := range md.Keys() {
+			if t := md.Type(key...); t != "Hash" && t != "ArrayHash" {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	tree, err := parseConfigTree(data, format)
+	if err != nil {
+		return nil, err
+	}
+	// The decoders of encoding/json match field names case-insensitively, like
+	// the TOML decoder, so YAML goes through JSON as well
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(encoded, cfg); err != nil {
+		return nil, err
+	}
+	return configTreeKeys(tree, nil), nil
+}
+
+// configTreeKeys lists the keys of the settings in a decoded config tree
+func configTreeKeys(tree map[string]interface{}, prefix []string) [][]string {
+	keys := [][]string{}
+	for name, value := range tree {
+		key := append(append([]string{}, prefix...), name)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			keys = append(keys, configTreeKeys(v, key)...)
+		case []interface{}:
+			if len(v) > 0 {
+				if _, ok := v[0].(map[string]interface{}); ok {
+					// array of tables
+					continue
+				}
+			}
+			keys = append(keys, key)
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// readConfigTree decodes a config file without mapping it onto the config
+// struct, keeping ${ENV_VAR} references, includes and unknown settings
+func readConfigTree(file string, format string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigTree(data, format)
+}
+
+// parseConfigTree decodes a config document, see readConfigTree
+func parseConfigTree(data []byte, format string) (map[string]interface{}, error) {
+	var err error
+	var tree interface{}
+	switch format {
+	case "toml":
+		m := map[string]interface{}{}
+		_, err = toml.Decode(string(data), &m)
+		tree = m
+	case "yaml":
+		err = yaml.Unmarshal(data, &tree)
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&tree)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		// empty file
+		return map[string]interface{}{}, nil
+	}
+	m, ok := normalizeConfigValue(tree).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the top level of the config must be a table")
+	}
+	return m, nil
+}
+
+// normalizeConfigValue converts the values of the TOML, YAML and JSON decoders
+// into types that every encoder supports, dropping null values
+func normalizeConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			if item != nil {
+				m[key] = normalizeConfigValue(item)
+			}
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			if item != nil {
+				m[fmt.Sprint(key)] = normalizeConfigValue(item)
+			}
+		}
+		return m
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = normalizeConfigValue(item)
+		}
+		return items
+	case []interface{}:
+		items := []interface{}{}
+		for _, item := range v {
+			if item != nil {
+				items = append(items, normalizeConfigValue(item))
+			}
+		}
+		return items
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	}
+	return value
+}
+
+// encodeConfigTree writes a config tree in the given format
+func encodeConfigTree(w io.Writer, tree map[string]interface{}, format string) error {
+	switch format {
+	case "toml":
+		return toml.NewEncoder(w).Encode(tree)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(tree); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(tree)
+	}
+	return fmt.Errorf("Unknown config format '%s'", format)
+}
+
+// convertConfig translates a single config file to another format. Includes
+// and ${ENV_VAR} references are kept as they are; comments are lost.
+func convertConfig(input string, inputFormat string, outputFormat string, output string) error {
+	inputFormat, err := configFileFormat(input, inputFormat)
+	if err != nil {
+		return err
+	}
+	if len(outputFormat) == 0 && (len(output) == 0 || output == "-") {
+		return fmt.Errorf("Please set the output format with --to")
+	}
+	// without --to, the output format is the one of the output file extension
+	if outputFormat, err = configFileFormat(output, outputFormat); err != nil {
+		return err
+	}
+
+	tree, err := readConfigTree(input, inputFormat)
+	if err != nil {
+		return fmt.Errorf("%s: %s", input, err.Error())
+	}
+	var out bytes.Buffer
+	if err := encodeConfigTree(&out, tree, outputFormat); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", outputFormat, err.Error())
+	}
+	if len(output) == 0 || output == "-" {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(output, out.Bytes(), 0600)
+}
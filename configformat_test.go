@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfigTOML = `[backend]
+  baseDN = "dc=example,dc=com"
+  hideDisabled = true
+[ldap]
+  enabled = true
+  listen = "127.0.0.1:3899"
+[ldaps]
+  enabled = false
+[[users]]
+  commonName = "alice"
+  userPassword = "${AUTHNDS_TEST_UNSET}"
+  posixUserID = 5001
+  posixGroupID = 5000
+  groupNames = ["staff"]
+  yubikeys = [{id = "cccccbdefghi", name = "keychain"}]
+[[groups]]
+  commonName = "staff"
+  description = "Staff"
+`
+
+const testConfigYAML = `backend:
+  baseDN: dc=example,dc=com
+  hideDisabled: true
+ldap:
+  enabled: true
+  listen: 127.0.0.1:3899
+ldaps:
+  enabled: false
+users:
+  - commonName: alice
+    userPassword: ${AUTHNDS_TEST_UNSET}
+    posixUserID: 5001
+    posixGroupID: 5000
+    groupNames: [staff]
+    yubikeys:
+      - id: cccccbdefghi
+        name: keychain
+groups:
+  - commonName: staff
+    description: Staff
+`
+
+const testConfigJSON = `{
+  "backend": {"baseDN": "dc=example,dc=com", "hideDisabled": true},
+  "ldap": {"enabled": true, "listen": "127.0.0.1:3899"},
+  "ldaps": {"enabled": false},
+  "users": [{"commonName": "alice", "userPassword": "${AUTHNDS_TEST_UNSET}", "posixUserID": 5001, "posixGroupID": 5000,
+    "groupNames": ["staff"], "yubikeys": [{"id": "cccccbdefghi", "name": "keychain"}]}],
+  "groups": [{"commonName": "staff", "description": "Staff"}]
+}
+`
+
+// decodeTestConfig decodes a config file, and returns its settings
+func decodeTestConfig(t *testing.T, configFile, format string) config {
+	cfg := config{}
+	if err := decodeConfigFiles(&cfg, configFile, format); err != nil {
+		t.Fatal(err)
+	}
+	return config{Backend: cfg.Backend, LDAP: cfg.LDAP, LDAPS: cfg.LDAPS, Users: cfg.Users, Groups: cfg.Groups}
+}
+
+func TestConfigFormats(t *testing.T) {
+	want := decodeTestConfig(t, writeConfigFiles(t, []string{"config.toml"}, testConfigTOML), "")
+	if len(want.Users) != 1 || want.Users[0].Yubikeys[0].Name != "keychain" || want.Groups[0].Description != "Staff" || !want.Backend.HideDisabled {
+		t.Fatalf("TOML config %+v", want)
+	}
+	tests := []struct {
+		name   string
+		file   string
+		data   string
+		format string
+	}{
+		{"YAML", "config.yaml", testConfigYAML, ""},
+		{"YML", "config.yml", testConfigYAML, ""},
+		{"JSON", "config.json", testConfigJSON, ""},
+		{"format option", "config.conf", testConfigYAML, "yaml"},
+	}
+	for _, test := range tests {
+		if cfg := decodeTestConfig(t, writeConfigFiles(t, []string{test.file}, test.data), test.format); !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: config\n%+v\nwant\n%+v", test.name, cfg, want)
+		}
+	}
+}
+
+func TestConfigFileFormat(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string
+		want   string
+		err    string
+	}{
+		{"config.toml", "", "toml", ""},
+		{"config.YAML", "", "yaml", ""},
+		{"config.json", "", "json", ""},
+		{"config.json", "toml", "toml", ""},
+		{"config.conf", "", "", "unknown config file extension"},
+		{"config.toml", "ini", "", "Unknown config format 'ini'"},
+	}
+	for _, test := range tests {
+		format, err := configFileFormat(test.file, test.format)
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && (err != nil || format != test.want) {
+			t.Errorf("%s (%s): %q %v, want %q %q", test.file, test.format, format, err, test.want, test.err)
+		}
+	}
+}
+
+func TestConvertConfig(t *testing.T) {
+	configFile := writeConfigFiles(t, []string{"config.toml"}, testConfigTOML)
+	want := decodeTestConfig(t, configFile, "")
+	dir := filepath.Dir(configFile)
+	// TOML to YAML to JSON and back, keeping ${ENV_VAR} references as they are
+	input := configFile
+	for _, format := range []string{"yaml", "json", "toml"} {
+		output := filepath.Join(dir, "converted."+format)
+		if err := convertConfig(input, "", format, output); err != nil {
+			t.Fatalf("%s: %s", format, err.Error())
+		}
+		if cfg := decodeTestConfig(t, output, ""); !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: config\n%+v\nwant\n%+v", format, cfg, want)
+		}
+		input = output
+	}
+}
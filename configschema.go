@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+)
+
+// allowed values of settings, by path in the schema
+var configSchemaEnums = map[string][]string{
+	"logLevel":               {"debug", "info", "notice", "warning", "error"},
+	"logFormat":              {"text", "json", "logfmt"},
+	"listeners[].type":       {"tcp", "tls", "unix"},
+	"remoteSyslog.network":   {"udp", "tcp", "tls"},
+	"awsUsers.format":        {"toml", "yaml", "json"},
+	"backend.datastore":      {"config", "sql"},
+	"sql.driver":             {"sqlite", "postgres"},
+	"yubikey.validation":     {"yubicloud", "servers", "local"},
+	"otp.mode":               {"password", "challenge"},
+	"otp.position":           {"suffix", "prefix"},
+	"bindPolicies[].require": {"default", "otp", "password", "app_password"},
+	"remoteSyslog.facility":  nil, // filled in from syslogFacilities
+}
+
+// configSchema returns a JSON Schema of the config file, for editors that
+// validate YAML and JSON config files
+func configSchema() map[string]interface{} {
+	schema := configSchemaOf(reflect.TypeOf(config{}), "")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "authnds configuration"
+	return schema
+}
+
+func configSchemaOf(t reflect.Type, path string) map[string]interface{} {
+	schema := map[string]interface{}{}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if len(field.PkgPath) > 0 {
+				continue
+			}
+			name := configKeyName(field.Name)
+			if len(path) == 0 && name == "configFile" {
+				// set from the command line
+				continue
+			}
+			fieldPath := name
+			if len(path) > 0 {
+				fieldPath = path + "." + name
+			}
+			properties[name] = configSchemaOf(field.Type, fieldPath)
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = configSchemaOf(t.Elem(), path+"[]")
+	case reflect.String:
+		schema["type"] = "string"
+		if enum, ok := configSchemaEnums[path]; ok {
+			if path == "remoteSyslog.facility" {
+				for facility := range syslogFacilities {
+					enum = append(enum, facility)
+				}
+				sort.Strings(enum)
+			}
+			schema["enum"] = enum
+		}
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		schema["type"] = "integer"
+	}
+	return schema
+}
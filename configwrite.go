@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/metala/ldap"
+)
+
+// configFileStore saves LDAP writes to the TOML config files the users and
+// groups were loaded from. Only the [[users]] and [[groups]] tables that
+// changed are rewritten, so the comments and layout of the rest of each file
+// are kept; comments inside a rewritten table are lost. New entries are
+// appended to the file of the last entry of the same kind. Values written
+// over LDAP are saved so that they load back as they were written, rather
+// than as ${VAR} or file: references.
+type configFileStore struct {
+	cfg *config
+}
+
+// tableEdit replaces the index-th [[table]] of a file with text, or removes
+// it when text is empty
+type tableEdit struct {
+	table string
+	index int
+	text  string
+}
+
+func (s configFileStore) apply(changes directoryChanges) error {
+	edits := map[string][]tableEdit{}
+	appends := map[string][]string{}
+	raw := map[string]*config{}
+
+	// edit queues the change of an entry loaded from src
+	edit := func(table string, name string, src configSource, entry, expanded interface{}) error {
+		if src.index < 0 || !s.editable(src.file) {
+			return writeErrorf(ldap.LDAPResultUnwillingToPerform, "'%s' is defined in %s, which can't be changed over LDAP", name, src.file)
+		}
+		text := ""
+		if !reflect.ValueOf(entry).IsNil() {
+			if _, ok := raw[src.file]; !ok {
+				decoded, err := readRawConfig(src.file)
+				if err != nil {
+					return err
+				}
+				raw[src.file] = decoded
+			}
+			original := reflect.ValueOf(raw[src.file].Users)
+			if table == "groups" {
+				original = reflect.ValueOf(raw[src.file].Groups)
+			}
+			if src.index >= original.Len() {
+				return fmt.Errorf("%s changed since it was loaded", src.file)
+			}
+			var err error
+			text, err = encodeConfigTable(table, reflect.ValueOf(entry).Elem(), reflect.ValueOf(expanded), original.Index(src.index))
+			if err != nil {
+				return err
+			}
+		}
+		edits[src.file] = append(edits[src.file], tableEdit{table, src.index, text})
+		return nil
+	}
+	// add queues a new entry
+	add := func(table string, name string, entry interface{}, sources []configSource) error {
+		file := s.newEntryFile(sources)
+		if len(file) == 0 {
+			return writeErrorf(ldap.LDAPResultUnwillingToPerform, "there is no TOML config file to add '%s' to", name)
+		}
+		text, err := encodeConfigTable(table, reflect.ValueOf(entry).Elem(), reflect.Value{}, reflect.Value{})
+		if err != nil {
+			return err
+		}
+		appends[file] = append(appends[file], text)
+		return nil
+	}
+
+	for _, change := range changes.groups {
+		if len(change.name) == 0 {
+			if err := add("groups", change.group.CommonName, change.group, s.cfg.groupSources); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, g := range s.cfg.Groups {
+			if g.CommonName == change.name {
+				if err := edit("groups", g.CommonName, s.cfg.groupSource(i), change.group, g); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	for _, change := range changes.users {
+		if len(change.name) == 0 {
+			if err := add("users", change.user.CommonName, change.user, s.cfg.userSources); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, u := range s.cfg.Users {
+			if u.CommonName == change.name {
+				if err := edit("users", u.CommonName, s.cfg.userSource(i), change.user, u); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	files := []string{}
+	for file := range edits {
+		files = append(files, file)
+	}
+	for file := range appends {
+		if _, ok := edits[file]; !ok {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	// the whole new config must load before any file is replaced
+	rewritten := []*rewrittenFile{}
+	pending := map[string][]byte{}
+	for _, file := range files {
+		f, err := rewriteConfigFile(file, edits[file], appends[file])
+		if err != nil {
+			return err
+		}
+		rewritten = append(rewritten, f)
+		pending[file] = f.content
+	}
+	if _, err := loadPendingConfig(s.cfg.ConfigFile, s.cfg.format, pending); err != nil {
+		return writeErrorf(ldap.LDAPResultConstraintViolation, "the changed config would not load: %s", err.Error())
+	}
+	return replaceConfigFiles(rewritten)
+}
+
+// editable reports whether file is a TOML file of the config
+func (s configFileStore) editable(file string) bool {
+	if findIndex(s.cfg.files, file) == -1 {
+		return false
+	}
+	format, err := configFileFormat(file, s.cfg.format)
+	return err == nil && format == "toml"
+}
+
+// newEntryFile returns the file new entries are added to: the last editable
+// file of sources, else the config file itself
+func (s configFileStore) newEntryFile(sources []configSource) string {
+	for i := len(sources) - 1; i >= 0; i-- {
+		if s.editable(sources[i].file) {
+			return sources[i].file
+		}
+	}
+	if fi, err := os.Stat(s.cfg.ConfigFile); err == nil && !fi.IsDir() && s.editable(s.cfg.ConfigFile) {
+		return s.cfg.ConfigFile
+	}
+	return ""
+}
+
+// readRawConfig decodes a config file without expanding its values
+func readRawConfig(file string) (*config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := &config{}
+	if _, err := decodeConfigData(raw, data, "toml"); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return raw, nil
+}
+
+// encodeConfigTable writes an entry as a [[table]] in the style of
+// config.toml.example, leaving out unset values. Values that are unchanged
+// from expanded keep their raw text, so ${VAR} and file: references are not
+// replaced by what they expand to; the others were written over LDAP.
+func encodeConfigTable(table string, entry, expanded, raw reflect.Value) (string, error) {
+	var out strings.Builder
+	out.WriteString("[[" + table + "]]\n")
+	t := entry.Type()
+	for i := 0; i < t.NumField(); i++ {
+		value, literal := entry.Field(i), true
+		if raw.IsValid() && reflect.DeepEqual(value.Interface(), expanded.Field(i).Interface()) {
+			value, literal = raw.Field(i), false
+		}
+		if value.IsZero() || value.Kind() == reflect.Slice && value.Len() == 0 {
+			continue
+		}
+		var text string
+		var err error
+		if literal && raw.IsValid() && value.Kind() == reflect.Slice {
+			text, err = encodeConfigList(value, expanded.Field(i), raw.Field(i))
+		} else {
+			text, err = tomlValue(value, literal)
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "  %s = %s\n", configKeyName(t.Field(i).Name), text)
+	}
+	return out.String(), nil
+}
+
+// encodeConfigList formats a list that changed, keeping the raw text of the
+// items that were already in it
+func encodeConfigList(list, expanded, raw reflect.Value) (string, error) {
+	values := []string{}
+	for i := 0; i < list.Len(); i++ {
+		item, literal := list.Index(i), true
+		for j := 0; j < expanded.Len() && j < raw.Len(); j++ {
+			if reflect.DeepEqual(item.Interface(), expanded.Index(j).Interface()) {
+				item, literal = raw.Index(j), false
+				break
+			}
+		}
+		text, err := tomlValue(item, literal)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, text)
+	}
+	return "[" + strings.Join(values, ", ") + "]", nil
+}
+
+// tomlValue formats a string, bool, int or []string setting, or a list of
+// tables such as yubikeys as inline tables. The strings of a literal value
+// are escaped so that they aren't expanded when the config is loaded.
+func tomlValue(v reflect.Value, literal bool) (string, error) {
+	switch v.Kind() {
+	case reflect.Struct:
+		values := []string{}
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).IsZero() {
+				text, err := tomlValue(v.Field(i), literal)
+				if err != nil {
+					return "", err
+				}
+				values = append(values, configKeyName(v.Type().Field(i).Name)+" = "+text)
+			}
+		}
+		return "{" + strings.Join(values, ", ") + "}", nil
+	case reflect.String:
+		if !literal {
+			return tomlString(v.String()), nil
+		}
+		s, err := literalConfigString(v.String())
+		return tomlString(s), err
+	case reflect.Bool:
+		return fmt.Sprintf("%t", v.Bool()), nil
+	case reflect.Slice:
+		values := []string{}
+		for i := 0; i < v.Len(); i++ {
+			text, err := tomlValue(v.Index(i), literal)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, text)
+		}
+		return "[" + strings.Join(values, ", ") + "]", nil
+	}
+	return fmt.Sprintf("%d", v.Int()), nil
+}
+
+// literalConfigString escapes a string so that expandString returns it
+// unchanged: ${ becomes $${. There's no escape for a leading file:, so such
+// values are refused.
+func literalConfigString(s string) (string, error) {
+	if strings.HasPrefix(s, secretFilePrefix) {
+		return "", writeErrorf(ldap.LDAPResultUnwillingToPerform, "values starting with '%s' can't be written over LDAP", secretFilePrefix)
+	}
+	return strings.ReplaceAll(s, "${", "$${"), nil
+}
+
+// tomlString quotes s as a TOML basic string
+func tomlString(s string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\t':
+			out.WriteString(`\t`)
+		case '\r':
+			out.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&out, `\u%04X`, r)
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
+
+// configTableSpans returns the first and last+1 lines of every [[table]] of a
+// TOML file, by table name. Comments and blank lines at the end of a table
+// are left out, as they usually belong to the next one.
+func configTableSpans(lines []string) map[string][][2]int {
+	spans := map[string][][2]int{}
+	isHeader := func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "[")
+	}
+	headerName := func(line string) string {
+		return strings.ToLower(strings.Trim(strings.SplitN(strings.TrimSpace(line), "#", 2)[0], "[] \t"))
+	}
+	isFiller := func(line string) bool {
+		text := strings.TrimSpace(line)
+		return len(text) == 0 || strings.HasPrefix(text, "#")
+	}
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		if !strings.HasPrefix(text, "[[") {
+			continue
+		}
+		name := headerName(line)
+		end := i + 1
+		// [[users.yubikeys]] and the like are part of the entry
+		for end < len(lines) && (!isHeader(lines[end]) || strings.HasPrefix(headerName(lines[end]), name+".")) {
+			end++
+		}
+		for end > i+1 && isFiller(lines[end-1]) {
+			end--
+		}
+		spans[name] = append(spans[name], [2]int{i, end})
+	}
+	return spans
+}
+
+// rewrittenFile is the new content of a config file, and what to restore
+// if the config doesn't reload
+type rewrittenFile struct {
+	path     string
+	mode     os.FileMode
+	original []byte
+	content  []byte
+}
+
+// rewriteConfigFile applies the edits to a TOML file and appends new tables,
+// returning the new content without writing it
+func rewriteConfigFile(file string, edits []tableEdit, appends []string) (*rewrittenFile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	spans := configTableSpans(lines)
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	replacements := []replacement{}
+	for _, e := range edits {
+		if e.index >= len(spans[e.table]) {
+			return nil, fmt.Errorf("%s changed since it was loaded", file)
+		}
+		span := spans[e.table][e.index]
+		replacements = append(replacements, replacement{span[0], span[1], e.text})
+	}
+	// from the bottom up, so the spans above stay valid
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].start > replacements[j].start })
+	for _, r := range replacements {
+		text := []string{}
+		if len(r.text) > 0 {
+			text = strings.Split(strings.TrimSuffix(r.text, "\n"), "\n")
+		} else if r.end < len(lines) && len(strings.TrimSpace(lines[r.end])) == 0 && r.start > 0 && len(strings.TrimSpace(lines[r.start-1])) == 0 {
+			// don't leave two blank lines where the table was
+			r.end++
+		}
+		lines = append(lines[:r.start], append(text, lines[r.end:]...)...)
+	}
+
+	content := strings.Join(lines, "\n")
+	for _, text := range appends {
+		if !strings.HasSuffix(content, "\n") && len(content) > 0 {
+			content += "\n"
+		}
+		if !strings.HasSuffix(content, "\n\n") && len(content) > 0 {
+			content += "\n"
+		}
+		content += text
+	}
+	return &rewrittenFile{file, fi.Mode().Perm(), data, []byte(content)}, nil
+}
+
+// replaceConfigFiles replaces each file with its new content and reloads the
+// config. Every file is written next to the one it replaces first, so none is
+// replaced unless all could be written; the original contents are restored
+// if a file can't be replaced or the config doesn't reload.
+func replaceConfigFiles(files []*rewrittenFile) error {
+	for i, f := range files {
+		if err := ioutil.WriteFile(f.path+".tmp", f.content, f.mode); err != nil {
+			for _, written := range files[:i] {
+				os.Remove(written.path + ".tmp")
+			}
+			return err
+		}
+	}
+	var err error
+	replaced := 0
+	for _, f := range files {
+		if err = os.Rename(f.path+".tmp", f.path); err != nil {
+			break
+		}
+		replaced++
+	}
+	if err == nil {
+		if err = reloadWrittenConfig(); err == nil {
+			return nil
+		}
+	}
+	for _, f := range files[replaced:] {
+		os.Remove(f.path + ".tmp")
+	}
+	for _, f := range files[:replaced] {
+		if restoreErr := writeFileAtomic(f.path, f.original, f.mode); restoreErr != nil {
+			log.Errorf("Unable to restore %s: %s", f.path, restoreErr.Error())
+		}
+	}
+	return err
+}
+
+// writeFileAtomic replaces file with data
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/metala/ldap"
+)
+
+const testWriteConfig = `# authnds
+include = ["users.toml"]
+
+[backend]
+  baseDN = "dc=example,dc=com"
+[ldap]
+  enabled = true
+  listen = "127.0.0.1:3899"
+[ldaps]
+  enabled = false
+
+# everyone
+[[groups]]
+  commonName = "staff" # inline comment
+  description = "${AUTHNDS_TEST_TEAM}"
+
+# the end
+`
+
+const testWriteUsers = `# users
+
+[[users]]
+  commonName = "alice"
+  givenName = "${AUTHNDS_TEST_NAME}"
+  userPassword = "file:${AUTHNDS_TEST_HASH_FILE}"
+  sshKeys = ["${AUTHNDS_TEST_KEY}", "ssh-ed25519 AAAA bob@laptop"]
+  groupNames = ["staff"]
+
+# bob's entry
+[[users]]
+  commonName = "bob"
+  mail = "bob@example.com"
+`
+
+// replaceValues returns the change of a Modify request that replaces attr
+func replaceValues(attr string, values ...string) []ldapModification {
+	return []ldapModification{{"replace", ldapAttribute{attr, values}}}
+}
+
+func TestConfigFileStore(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "hash")
+	if err := ioutil.WriteFile(secretFile, []byte(testPasswordHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTHNDS_TEST_NAME", "Alice")
+	t.Setenv("AUTHNDS_TEST_TEAM", "Everyone")
+	t.Setenv("AUTHNDS_TEST_KEY", "ssh-ed25519 AAAA alice@laptop")
+	t.Setenv("AUTHNDS_TEST_HASH_FILE", secretFile)
+	reload := reloadWrittenConfig
+	t.Cleanup(func() { reloadWrittenConfig = reload })
+
+	tests := []struct {
+		name      string
+		edit      func(e *directoryEdit) error
+		reloadErr error
+		code      ldap.LDAPResultCode // of the refused write
+		config    string
+		users     string
+		mail      string // of alice once reloaded
+	}{
+		{
+			name: "modify",
+			edit: func(e *directoryEdit) error {
+				return e.modify("users", "alice", replaceValues("mail", "alice@example.com"))
+			},
+			config: testWriteConfig,
+			users: `# users
+
+[[users]]
+  commonName = "alice"
+  givenName = "${AUTHNDS_TEST_NAME}"
+  userPassword = "file:${AUTHNDS_TEST_HASH_FILE}"
+  mail = "alice@example.com"
+  sshKeys = ["${AUTHNDS_TEST_KEY}", "ssh-ed25519 AAAA bob@laptop"]
+  groupNames = ["staff"]
+
+# bob's entry
+[[users]]
+  commonName = "bob"
+  mail = "bob@example.com"
+`,
+			mail: "alice@example.com",
+		},
+		{
+			name: "values aren't expanded",
+			edit: func(e *directoryEdit) error {
+				if err := e.modify("users", "alice", replaceValues("mail", "${AUTHNDS_TEST_NAME}@example.com")); err != nil {
+					return err
+				}
+				return e.modify("users", "alice", []ldapModification{{"add", ldapAttribute{"sshPublicKey", []string{"ssh-ed25519 CCCC $${carol}"}}}})
+			},
+			config: testWriteConfig,
+			users: `# users
+
+[[users]]
+  commonName = "alice"
+  givenName = "${AUTHNDS_TEST_NAME}"
+  userPassword = "file:${AUTHNDS_TEST_HASH_FILE}"
+  mail = "$${AUTHNDS_TEST_NAME}@example.com"
+  sshKeys = ["${AUTHNDS_TEST_KEY}", "ssh-ed25519 AAAA bob@laptop", "ssh-ed25519 CCCC $$${carol}"]
+  groupNames = ["staff"]
+
+# bob's entry
+[[users]]
+  commonName = "bob"
+  mail = "bob@example.com"
+`,
+			mail: "${AUTHNDS_TEST_NAME}@example.com",
+		},
+		{
+			name: "secret file",
+			edit: func(e *directoryEdit) error {
+				return e.modify("users", "bob", replaceValues("mail", "file:"+secretFile))
+			},
+			code:   ldap.LDAPResultUnwillingToPerform,
+			config: testWriteConfig,
+			users:  testWriteUsers,
+		},
+		{
+			name: "delete",
+			edit: func(e *directoryEdit) error {
+				return e.remove("users", "bob")
+			},
+			config: testWriteConfig,
+			users: `# users
+
+[[users]]
+  commonName = "alice"
+  givenName = "${AUTHNDS_TEST_NAME}"
+  userPassword = "file:${AUTHNDS_TEST_HASH_FILE}"
+  sshKeys = ["${AUTHNDS_TEST_KEY}", "ssh-ed25519 AAAA bob@laptop"]
+  groupNames = ["staff"]
+
+# bob's entry
+`,
+		},
+		{
+			name: "add",
+			edit: func(e *directoryEdit) error {
+				if err := e.add("users", "carol", []ldapAttribute{{"mail", []string{"carol@example.com"}}, {"memberOf", []string{"cn=staff,ou=groups,dc=example,dc=com"}}}); err != nil {
+					return err
+				}
+				return e.add("groups", "admins", []ldapAttribute{{"description", []string{"Administrators"}}})
+			},
+			config: testWriteConfig + `
+[[groups]]
+  commonName = "admins"
+  description = "Administrators"
+`,
+			users: testWriteUsers + `
+[[users]]
+  commonName = "carol"
+  mail = "carol@example.com"
+  groupNames = ["staff"]
+`,
+		},
+		{
+			name: "rename a group",
+			edit: func(e *directoryEdit) error {
+				return e.rename("groups", "staff", "cn=team", "")
+			},
+			config: `# authnds
+include = ["users.toml"]
+
+[backend]
+  baseDN = "dc=example,dc=com"
+[ldap]
+  enabled = true
+  listen = "127.0.0.1:3899"
+[ldaps]
+  enabled = false
+
+# everyone
+[[groups]]
+  commonName = "team"
+  description = "${AUTHNDS_TEST_TEAM}"
+
+# the end
+`,
+			users: `# users
+
+[[users]]
+  commonName = "alice"
+  givenName = "${AUTHNDS_TEST_NAME}"
+  userPassword = "file:${AUTHNDS_TEST_HASH_FILE}"
+  sshKeys = ["${AUTHNDS_TEST_KEY}", "ssh-ed25519 AAAA bob@laptop"]
+  groupNames = ["team"]
+
+# bob's entry
+[[users]]
+  commonName = "bob"
+  mail = "bob@example.com"
+`,
+		},
+		{
+			name: "failed reload",
+			edit: func(e *directoryEdit) error {
+				return e.rename("groups", "staff", "cn=team", "")
+			},
+			reloadErr: fmt.Errorf("reload failed"),
+			code:      ldap.LDAPResultOperationsError,
+			config:    testWriteConfig,
+			users:     testWriteUsers,
+		},
+		{
+			// both files are left as they were
+			name: "invalid config",
+			edit: func(e *directoryEdit) error {
+				if err := e.rename("groups", "staff", "cn=team", ""); err != nil {
+					return err
+				}
+				if err := e.modify("users", "alice", replaceValues("uidNumber", "5000")); err != nil {
+					return err
+				}
+				return e.modify("users", "bob", replaceValues("uidNumber", "5000"))
+			},
+			code:   ldap.LDAPResultConstraintViolation,
+			config: testWriteConfig,
+			users:  testWriteUsers,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := writeConfigFiles(t, []string{"config.toml", "users.toml"}, testWriteConfig, testWriteUsers)
+			usersFile := filepath.Join(filepath.Dir(configFile), "users.toml")
+			cfg, err := loadConfig(configFile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reloaded *config
+			reloadWrittenConfig = func() error {
+				if test.reloadErr != nil {
+					return test.reloadErr
+				}
+				reloaded, err = loadConfig(configFile, "")
+				return err
+			}
+
+			e := newDirectoryEdit(cfg)
+			if err := test.edit(e); err != nil {
+				t.Fatal(err)
+			}
+			err = configFileStore{cfg}.apply(e.changes())
+			code := ldap.LDAPResultCode(ldap.LDAPResultSuccess)
+			if refused, ok := err.(*writeError); ok {
+				code = refused.code
+			} else if err != nil {
+				code = ldap.LDAPResultOperationsError
+			}
+			if code != test.code {
+				t.Errorf("apply: %v, want %d", err, test.code)
+			}
+
+			for file, want := range map[string]string{configFile: test.config, usersFile: test.users} {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != want {
+					t.Errorf("%s:\n%s\nwant:\n%s", filepath.Base(file), data, want)
+				}
+			}
+			if tmp, _ := filepath.Glob(filepath.Join(filepath.Dir(configFile), "*.tmp")); len(tmp) > 0 {
+				t.Errorf("left behind: %v", tmp)
+			}
+			if len(test.mail) > 0 {
+				if reloaded == nil || reloaded.Users[0].Mail != test.mail {
+					t.Errorf("reloaded %v", reloaded)
+				}
+			}
+		})
+	}
+}
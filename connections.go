@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lastConnID uint64
+
+// connAddr is the remote address of an accepted connection, tagged with a
+// connection ID and the name of its listener. The ldap library only passes a
+// net.Conn to handlers, which may be a *tls.Conn wrapping our connection, but
+// RemoteAddr is always forwarded to the connection we accepted.
+type connAddr struct {
+	net.Addr
+	id       uint64
+	listener string
+}
+
+// connInfo returns the connection ID and listener name of a connection
+func connInfo(conn net.Conn) (uint64, string) {
+	if addr, ok := conn.RemoteAddr().(connAddr); ok {
+		return addr.id, addr.listener
+	}
+	return 0, ""
+}
+
+// connSource returns the source IP and port of a connection; both are empty
+// for Unix domain sockets
+func connSource(conn net.Conn) (string, string) {
+	addr := conn.RemoteAddr()
+	if a, ok := addr.(connAddr); ok {
+		addr = a.Addr
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String(), strconv.Itoa(tcpAddr.Port)
+	}
+	return "", ""
+}
+
+// trackedListener assigns connection IDs and counts open connections
+type trackedListener struct {
+	net.Listener
+	name  string
+	gauge prometheus.Gauge
+}
+
+func newTrackedListener(ln net.Listener, name string) net.Listener {
+	return trackedListener{ln, name, metricOpenConnections.WithLabelValues(name)}
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	l.gauge.Inc()
+	return &trackedConn{
+		Conn:  conn,
+		addr:  connAddr{conn.RemoteAddr(), atomic.AddUint64(&lastConnID, 1), l.name},
+		gauge: l.gauge,
+	}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	addr  connAddr
+	gauge prometheus.Gauge
+	once  sync.Once
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.gauge.Dec)
+	return c.Conn.Close()
+}
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metala/ldap"
+)
+
+// LDAP writes: members of backend.adminGroup may add, modify, rename and
+// delete users and groups, and users may change their own userPassword. A
+// write is applied to a copy of the users and groups, checked like the config
+// file, then saved by the datastore.
+
+// directoryStore saves the changes of an LDAP write. Once apply returns, the
+// new users and groups are being served.
+type directoryStore interface {
+	apply(changes directoryChanges) error
+}
+
+// directoryChanges lists the entries changed by an LDAP write. name is the
+// name of the entry before the write, or "" for a new entry; a nil entry was
+// deleted.
+type directoryChanges struct {
+	users  []userChange
+	groups []groupChange
+}
+
+type userChange struct {
+	name string
+	user *configUser
+}
+
+type groupChange struct {
+	name  string
+	group *configGroup
+}
+
+// writeError refuses a write with an LDAP result code
+type writeError struct {
+	code    ldap.LDAPResultCode
+	message string
+}
+
+func (e *writeError) Error() string {
+	return e.message
+}
+
+func writeErrorf(code ldap.LDAPResultCode, format string, args ...interface{}) *writeError {
+	return &writeError{code, fmt.Sprintf(format, args...)}
+}
+
+// userAttribute reads and writes an LDAP attribute of a user
+type userAttribute struct {
+	get func(e *directoryEdit, u *configUser) []string
+	set func(e *directoryEdit, u *configUser, values []string) error
+	dn  bool // values are DNs, compared case-insensitively
+}
+
+// groupAttribute reads and writes an LDAP attribute of the i-th group
+type groupAttribute struct {
+	get func(e *directoryEdit, i int) []string
+	set func(e *directoryEdit, i int, values []string) error
+	dn  bool
+}
+
+// The writable attributes, by lower-case name. uid, fullName and objectClass
+// are derived from the other attributes: objectClass is accepted and ignored,
+// writing the others is refused.
+var userAttributes = map[string]userAttribute{
+	"cn":            rdnUserAttribute,
+	"uid":           rdnUserAttribute,
+	"givenname":     stringUserAttribute("givenName", func(u *configUser) *string { return &u.GivenName }),
+	"sn":            stringUserAttribute("sn", func(u *configUser) *string { return &u.Surname }),
+	"displayname":   stringUserAttribute("displayName", func(u *configUser) *string { return &u.DisplayName }),
+	"mail":          stringUserAttribute("mail", func(u *configUser) *string { return &u.Mail }),
+	"homedirectory": stringUserAttribute("homeDirectory", func(u *configUser) *string { return &u.Homedir }),
+	"loginshell":    stringUserAttribute("loginShell", func(u *configUser) *string { return &u.LoginShell }),
+	"uidnumber":     intUserAttribute("uidNumber", func(u *configUser) *int { return &u.PosixUserID }),
+	"gidnumber":     intUserAttribute("gidNumber", func(u *configUser) *int { return &u.PosixGroupID }),
+	"sshpublickey": {
+		get: func(e *directoryEdit, u *configUser) []string { return u.SSHKeys },
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			u.SSHKeys = values
+			return nil
+		},
+	},
+	"userpassword": {
+		get: func(e *directoryEdit, u *configUser) []string { return nonEmpty(u.UserPassword) },
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			value, err := singleValue("userPassword", values)
+			if err != nil {
+				return err
+			}
+			return e.setPassword(u, value)
+		},
+	},
+	"accountstatus": {
+		get: func(e *directoryEdit, u *configUser) []string {
+			if u.Disabled {
+				return []string{"inactive"}
+			}
+			return []string{"active"}
+		},
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			value, err := singleValue("accountStatus", values)
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(value) {
+			case "", "active":
+				u.Disabled = false
+			case "inactive":
+				u.Disabled = true
+			default:
+				return writeErrorf(ldap.LDAPResultInvalidAttributeSyntax, "accountStatus must be 'active' or 'inactive'")
+			}
+			return nil
+		},
+	},
+	"logindisabled": {
+		get: func(e *directoryEdit, u *configUser) []string {
+			if u.Disabled {
+				return []string{"TRUE"}
+			}
+			return []string{"FALSE"}
+		},
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			value, err := singleValue("loginDisabled", values)
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(value) {
+			case "", "FALSE":
+				u.Disabled = false
+			case "TRUE":
+				u.Disabled = true
+			default:
+				return writeErrorf(ldap.LDAPResultInvalidAttributeSyntax, "loginDisabled must be 'TRUE' or 'FALSE'")
+			}
+			return nil
+		},
+	},
+	"memberof": {
+		get: func(e *directoryEdit, u *configUser) []string {
+			dns := []string{}
+			for _, name := range u.GroupNames {
+				dns = append(dns, configGroup{CommonName: name}.distingushedName(e.cfg.Backend.BaseDN))
+			}
+			return dns
+		},
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			names := []string{}
+			for _, dn := range values {
+				i, err := e.entryIndex("groups", dn)
+				if err != nil {
+					return err
+				}
+				names = append(names, e.groups[i].CommonName)
+			}
+			u.GroupNames = names
+			return nil
+		},
+		dn: true,
+	},
+}
+
+var groupAttributes = map[string]groupAttribute{
+	"cn": {
+		get: func(e *directoryEdit, i int) []string { return []string{e.groups[i].CommonName} },
+		set: func(e *directoryEdit, i int, values []string) error {
+			return checkRDNValue(e.groups[i].CommonName, values)
+		},
+	},
+	"description": {
+		get: func(e *directoryEdit, i int) []string { return nonEmpty(e.groups[i].Description) },
+		set: func(e *directoryEdit, i int, values []string) (err error) {
+			e.groups[i].Description, err = singleValue("description", values)
+			return err
+		},
+	},
+	"member": {
+		get: func(e *directoryEdit, i int) []string {
+			dns := []string{}
+			for _, u := range e.users {
+				if findIndex(u.GroupNames, e.groups[i].CommonName) != -1 {
+					dns = append(dns, u.distingushedName(e.cfg.Backend.BaseDN))
+				}
+			}
+			return dns
+		},
+		set: func(e *directoryEdit, i int, values []string) error {
+			members := map[int]bool{}
+			for _, dn := range values {
+				j, err := e.entryIndex("users", dn)
+				if err != nil {
+					return err
+				}
+				members[j] = true
+			}
+			name := e.groups[i].CommonName
+			for j := range e.users {
+				u := &e.users[j]
+				isMember := findIndex(u.GroupNames, name) != -1
+				if members[j] && !isMember {
+					u.GroupNames = append(u.GroupNames, name)
+				} else if !members[j] && isMember {
+					u.GroupNames = removeString(u.GroupNames, name)
+				}
+			}
+			return nil
+		},
+		dn: true,
+	},
+}
+
+var rdnUserAttribute = userAttribute{
+	get: func(e *directoryEdit, u *configUser) []string { return []string{u.CommonName} },
+	set: func(e *directoryEdit, u *configUser, values []string) error {
+		return checkRDNValue(u.CommonName, values)
+	},
+}
+
+func stringUserAttribute(name string, field func(u *configUser) *string) userAttribute {
+	return userAttribute{
+		get: func(e *directoryEdit, u *configUser) []string { return nonEmpty(*field(u)) },
+		set: func(e *directoryEdit, u *configUser, values []string) (err error) {
+			*field(u), err = singleValue(name, values)
+			return err
+		},
+	}
+}
+
+func intUserAttribute(name string, field func(u *configUser) *int) userAttribute {
+	return userAttribute{
+		get: func(e *directoryEdit, u *configUser) []string {
+			if *field(u) == 0 {
+				return nil
+			}
+			return []string{strconv.Itoa(*field(u))}
+		},
+		set: func(e *directoryEdit, u *configUser, values []string) error {
+			value, err := singleValue(name, values)
+			if err != nil || len(value) == 0 {
+				*field(u) = 0
+				return err
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return writeErrorf(ldap.LDAPResultInvalidAttributeSyntax, "'%s' is not a valid number", value)
+			}
+			*field(u) = n
+			return nil
+		},
+	}
+}
+
+func nonEmpty(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return []string{value}
+}
+
+func singleValue(name string, values []string) (string, error) {
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+		return values[0], nil
+	}
+	return "", writeErrorf(ldap.LDAPResultConstraintViolation, "%s is single-valued", name)
+}
+
+// checkRDNValue refuses to change the cn (and uid) of an entry: that is a
+// rename, which takes a ModifyDN request
+func checkRDNValue(name string, values []string) error {
+	if len(values) != 1 || !strings.EqualFold(values[0], name) {
+		return writeErrorf(ldap.LDAPResultNotAllowedOnRDN, "the cn of '%s' can only be changed with a ModifyDN request", name)
+	}
+	return nil
+}
+
+func removeString(list []string, value string) []string {
+	kept := []string{}
+	for _, s := range list {
+		if s != value {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// hashUserPassword stores a clear-text userPassword as {SSHA256}; values that
+// are already hashed are stored as they are
+func hashUserPassword(value string) (string, error) {
+	if len(value) == 0 || strings.HasPrefix(value, "{") {
+		return value, nil
+	}
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hashed := hashPasswordSalt(sha256.New(), []byte(value), salt)
+	return "{SSHA256}" + base64.StdEncoding.EncodeToString(append(hashed, salt...)), nil
+}
+
+// sameDN compares two DNs, ignoring case and the spaces around separators
+func sameDN(a, b string) bool {
+	ra, rb := strings.Split(a, ","), strings.Split(b, ",")
+	if len(ra) != len(rb) {
+		return false
+	}
+	for i := range ra {
+		pa, pb := strings.SplitN(ra[i], "=", 2), strings.SplitN(rb[i], "=", 2)
+		if len(pa) != len(pb) {
+			return false
+		}
+		for j := range pa {
+			if !strings.EqualFold(strings.TrimSpace(pa[j]), strings.TrimSpace(pb[j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseEntryDN splits cn=<name>,ou=<users|groups>,<baseDN>
+func parseEntryDN(dn string, baseDN string) (ou string, cn string, ok bool) {
+	rdns := strings.SplitN(dn, ",", 3)
+	if len(rdns) != 3 || !sameDN(rdns[2], baseDN) {
+		return "", "", false
+	}
+	cnPair, ouPair := strings.SplitN(rdns[0], "=", 2), strings.SplitN(rdns[1], "=", 2)
+	if len(cnPair) != 2 || len(ouPair) != 2 ||
+		!strings.EqualFold(strings.TrimSpace(cnPair[0]), "cn") || !strings.EqualFold(strings.TrimSpace(ouPair[0]), "ou") {
+		return "", "", false
+	}
+	ou = strings.ToLower(strings.TrimSpace(ouPair[1]))
+	cn = strings.TrimSpace(cnPair[1])
+	if (ou != "users" && ou != "groups") || len(cn) == 0 {
+		return "", "", false
+	}
+	return ou, cn, true
+}
+
+// directoryEdit applies a write to copies of the users and groups of cfg,
+// remembering which user and group each copy started as (-1 for new ones)
+type directoryEdit struct {
+	cfg         *config
+	boundUser   string // the name of the user writing
+	users       []configUser
+	groups      []configGroup
+	userOrigin  []int
+	groupOrigin []int
+}
+
+func newDirectoryEdit(cfg *config) *directoryEdit {
+	e := &directoryEdit{cfg: cfg}
+	for i, u := range cfg.Users {
+		u.SSHKeys = append([]string(nil), u.SSHKeys...)
+		u.GroupNames = append([]string(nil), u.GroupNames...)
+		u.PassAppSHA256 = append([]string(nil), u.PassAppSHA256...)
+		u.AppPasswords = append([]configUserAppPassword(nil), u.AppPasswords...)
+		u.OTPSecrets = append([]configUserOTPSecret(nil), u.OTPSecrets...)
+		u.Yubikeys = append([]configUserYubikey(nil), u.Yubikeys...)
+		u.HOTPSecrets = append([]configUserOTPSecret(nil), u.HOTPSecrets...)
+		u.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+		u.PasswordHistory = append([]string(nil), u.PasswordHistory...)
+		e.users = append(e.users, u)
+		e.userOrigin = append(e.userOrigin, i)
+	}
+	for i, g := range cfg.Groups {
+		e.groups = append(e.groups, g)
+		e.groupOrigin = append(e.groupOrigin, i)
+	}
+	return e
+}
+
+func (e *directoryEdit) findUser(name string) int {
+	for i, u := range e.users {
+		if strings.EqualFold(u.CommonName, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *directoryEdit) findGroup(name string) int {
+	for i, g := range e.groups {
+		if strings.EqualFold(g.CommonName, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// entryIndex returns the index of the user or group (as ou) that dn names
+func (e *directoryEdit) entryIndex(ou string, dn string) (int, error) {
+	entryOU, cn, ok := parseEntryDN(dn, e.cfg.Backend.BaseDN)
+	if !ok || entryOU != ou {
+		return -1, writeErrorf(ldap.LDAPResultInvalidAttributeSyntax, "'%s' is not the DN of one of the %s", dn, ou)
+	}
+	i := e.findUser(cn)
+	if ou == "groups" {
+		i = e.findGroup(cn)
+	}
+	if i == -1 {
+		return -1, writeErrorf(ldap.LDAPResultConstraintViolation, "'%s' does not exist", dn)
+	}
+	return i, nil
+}
+
+// modifyValues applies a change to the current values of an attribute
+func modifyValues(current []string, m ldapModification, dn bool) ([]string, error) {
+	index := func(values []string, value string) int {
+		for i, v := range values {
+			if v == value || dn && sameDN(v, value) {
+				return i
+			}
+		}
+		return -1
+	}
+	switch m.operation {
+	case "add":
+		values := append([]string(nil), current...)
+		for _, value := range m.values {
+			if index(values, value) != -1 {
+				return nil, writeErrorf(ldap.LDAPResultAttributeOrValueExists, "%s already has the value '%s'", m.name, value)
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case "delete":
+		if len(current) == 0 {
+			return nil, writeErrorf(ldap.LDAPResultNoSuchAttribute, "%s is not set", m.name)
+		}
+		if len(m.values) == 0 {
+			return nil, nil
+		}
+		values := append([]string(nil), current...)
+		for _, value := range m.values {
+			i := index(values, value)
+			if i == -1 {
+				return nil, writeErrorf(ldap.LDAPResultNoSuchAttribute, "%s does not have the value '%s'", m.name, value)
+			}
+			values = append(values[:i], values[i+1:]...)
+		}
+		return values, nil
+	}
+	return m.values, nil
+}
+
+// add adds a user or group with the attributes of an Add request
+func (e *directoryEdit) add(ou string, cn string, attrs []ldapAttribute) error {
+	if e.findUser(cn) != -1 && ou == "users" || e.findGroup(cn) != -1 && ou == "groups" {
+		return writeErrorf(ldap.LDAPResultEntryAlreadyExists, "'%s' already exists", cn)
+	}
+	// values of an attribute may be spread over several attributes of the request
+	values := map[string][]string{}
+	names := []string{}
+	for _, attr := range attrs {
+		name := strings.ToLower(attr.name)
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = append(values[name], attr.values...)
+	}
+
+	if ou == "users" {
+		e.users = append(e.users, configUser{CommonName: cn})
+		e.userOrigin = append(e.userOrigin, -1)
+		u := &e.users[len(e.users)-1]
+		for _, name := range names {
+			if err := e.setUserAttribute(u, name, values[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	e.groups = append(e.groups, configGroup{CommonName: cn})
+	e.groupOrigin = append(e.groupOrigin, -1)
+	for _, name := range names {
+		if err := e.setGroupAttribute(len(e.groups)-1, name, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *directoryEdit) setUserAttribute(u *configUser, name string, values []string) error {
+	if name == "objectclass" {
+		return nil
+	}
+	attr, ok := userAttributes[name]
+	if !ok {
+		return writeErrorf(ldap.LDAPResultUndefinedAttributeType, "users have no writable attribute '%s'", name)
+	}
+	return attr.set(e, u, values)
+}
+
+func (e *directoryEdit) setGroupAttribute(i int, name string, values []string) error {
+	if name == "objectclass" {
+		return nil
+	}
+	attr, ok := groupAttributes[name]
+	if !ok {
+		return writeErrorf(ldap.LDAPResultUndefinedAttributeType, "groups have no writable attribute '%s'", name)
+	}
+	return attr.set(e, i, values)
+}
+
+// modify applies the changes of a Modify request to a user or group
+func (e *directoryEdit) modify(ou string, cn string, changes []ldapModification) error {
+	i := e.findUser(cn)
+	if ou == "groups" {
+		i = e.findGroup(cn)
+	}
+	if i == -1 {
+		return writeErrorf(ldap.LDAPResultNoSuchObject, "'%s' does not exist", cn)
+	}
+	for _, change := range changes {
+		name := strings.ToLower(change.name)
+		if name == "objectclass" {
+			continue
+		}
+		var current []string
+		dn := false
+		if ou == "users" {
+			attr, ok := userAttributes[name]
+			if !ok {
+				return writeErrorf(ldap.LDAPResultUndefinedAttributeType, "users have no writable attribute '%s'", change.name)
+			}
+			current, dn = attr.get(e, &e.users[i]), attr.dn
+		} else {
+			attr, ok := groupAttributes[name]
+			if !ok {
+				return writeErrorf(ldap.LDAPResultUndefinedAttributeType, "groups have no writable attribute '%s'", change.name)
+			}
+			current, dn = attr.get(e, i), attr.dn
+		}
+		values, err := modifyValues(current, change, dn)
+		if err != nil {
+			return err
+		}
+		if ou == "users" {
+			err = e.setUserAttribute(&e.users[i], name, values)
+		} else {
+			err = e.setGroupAttribute(i, name, values)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a user, or a group along with its memberships
+func (e *directoryEdit) remove(ou string, cn string) error {
+	if ou == "users" {
+		i := e.findUser(cn)
+		if i == -1 {
+			return writeErrorf(ldap.LDAPResultNoSuchObject, "'%s' does not exist", cn)
+		}
+		e.users = append(e.users[:i], e.users[i+1:]...)
+		e.userOrigin = append(e.userOrigin[:i], e.userOrigin[i+1:]...)
+		return nil
+	}
+	i := e.findGroup(cn)
+	if i == -1 {
+		return writeErrorf(ldap.LDAPResultNoSuchObject, "'%s' does not exist", cn)
+	}
+	name := e.groups[i].CommonName
+	e.groups = append(e.groups[:i], e.groups[i+1:]...)
+	e.groupOrigin = append(e.groupOrigin[:i], e.groupOrigin[i+1:]...)
+	for j := range e.users {
+		if findIndex(e.users[j].GroupNames, name) != -1 {
+			e.users[j].GroupNames = removeString(e.users[j].GroupNames, name)
+		}
+	}
+	return nil
+}
+
+// rename changes the cn of a user or group. Entries can't be moved to
+// another ou.
+func (e *directoryEdit) rename(ou string, cn string, newRDN string, newSuperior string) error {
+	if len(newSuperior) > 0 && !sameDN(newSuperior, fmt.Sprintf("ou=%s,%s", ou, e.cfg.Backend.BaseDN)) {
+		return writeErrorf(ldap.LDAPResultUnwillingToPerform, "entries can't be moved to '%s'", newSuperior)
+	}
+	pair := strings.SplitN(newRDN, "=", 2)
+	if len(pair) != 2 || !strings.EqualFold(strings.TrimSpace(pair[0]), "cn") || len(strings.TrimSpace(pair[1])) == 0 {
+		return writeErrorf(ldap.LDAPResultNamingViolation, "the new RDN must be cn=<name>")
+	}
+	newName := strings.TrimSpace(pair[1])
+
+	if ou == "users" {
+		i := e.findUser(cn)
+		if i == -1 {
+			return writeErrorf(ldap.LDAPResultNoSuchObject, "'%s' does not exist", cn)
+		}
+		if j := e.findUser(newName); j != -1 && j != i {
+			return writeErrorf(ldap.LDAPResultEntryAlreadyExists, "'%s' already exists", newName)
+		}
+		e.users[i].CommonName = newName
+		return nil
+	}
+	i := e.findGroup(cn)
+	if i == -1 {
+		return writeErrorf(ldap.LDAPResultNoSuchObject, "'%s' does not exist", cn)
+	}
+	if j := e.findGroup(newName); j != -1 && j != i {
+		return writeErrorf(ldap.LDAPResultEntryAlreadyExists, "'%s' already exists", newName)
+	}
+	oldName := e.groups[i].CommonName
+	e.groups[i].CommonName = newName
+	for j := range e.users {
+		for k, name := range e.users[j].GroupNames {
+			if name == oldName {
+				e.users[j].GroupNames[k] = newName
+			}
+		}
+	}
+	return nil
+}
+
+// check validates the edited users and groups like those of the config file
+func (e *directoryEdit) check() configProblems {
+	checked := *e.cfg
+	checked.Users, checked.Groups = e.users, e.groups
+	checked.userSources, checked.groupSources = nil, nil
+	for _, origin := range e.userOrigin {
+		src := configSource{e.cfg.ConfigFile, -1}
+		if origin != -1 {
+			src = e.cfg.userSource(origin)
+		}
+		checked.userSources = append(checked.userSources, src)
+	}
+	for _, origin := range e.groupOrigin {
+		src := configSource{e.cfg.ConfigFile, -1}
+		if origin != -1 {
+			src = e.cfg.groupSource(origin)
+		}
+		checked.groupSources = append(checked.groupSources, src)
+	}
+	return checkConfig(&checked)
+}
+
+// normalizedUser treats empty and missing lists alike, for comparisons
+func normalizedUser(u configUser) configUser {
+	for _, list := range []*[]string{&u.SSHKeys, &u.GroupNames, &u.PassAppSHA256, &u.RecoveryCodes, &u.PasswordHistory} {
+		if len(*list) == 0 {
+			*list = nil
+		}
+	}
+	if len(u.OTPSecrets) == 0 {
+		u.OTPSecrets = nil
+	}
+	if len(u.Yubikeys) == 0 {
+		u.Yubikeys = nil
+	}
+	if len(u.HOTPSecrets) == 0 {
+		u.HOTPSecrets = nil
+	}
+	if len(u.AppPasswords) == 0 {
+		u.AppPasswords = nil
+	}
+	return u
+}
+
+// changes returns the users and groups that were added, changed or deleted
+func (e *directoryEdit) changes() directoryChanges {
+	changes := directoryChanges{}
+	kept := map[int]bool{}
+	for i := range e.users {
+		u := normalizedUser(e.users[i])
+		origin := e.userOrigin[i]
+		if origin == -1 {
+			changes.users = append(changes.users, userChange{"", &u})
+			continue
+		}
+		kept[origin] = true
+		if !reflect.DeepEqual(normalizedUser(e.cfg.Users[origin]), u) {
+			changes.users = append(changes.users, userChange{e.cfg.Users[origin].CommonName, &u})
+		}
+	}
+	for i, u := range e.cfg.Users {
+		if !kept[i] {
+			changes.users = append(changes.users, userChange{u.CommonName, nil})
+		}
+	}
+
+	kept = map[int]bool{}
+	for i := range e.groups {
+		g := e.groups[i]
+		origin := e.groupOrigin[i]
+		if origin == -1 {
+			changes.groups = append(changes.groups, groupChange{"", &g})
+			continue
+		}
+		kept[origin] = true
+		if e.cfg.Groups[origin] != g {
+			changes.groups = append(changes.groups, groupChange{e.cfg.Groups[origin].CommonName, &g})
+		}
+	}
+	for i, g := range e.cfg.Groups {
+		if !kept[i] {
+			changes.groups = append(changes.groups, groupChange{g.CommonName, nil})
+		}
+	}
+	return changes
+}
+
+// writeAccess returns the name of the bound user, and whether it may write:
+// it must be an enabled member of backend.adminGroup
+func (h configHandler) writeAccess(boundDN string) (string, bool) {
+	return h.groupAccess(boundDN, h.cfg.Backend.AdminGroup)
+}
+
+// groupAccess returns the name of the bound user, and whether it is an
+// enabled member of group, which grants a right when set
+func (h configHandler) groupAccess(boundDN, group string) (string, bool) {
+	ou, cn, ok := parseEntryDN(boundDN, h.cfg.Backend.BaseDN)
+	if !ok || ou != "users" {
+		return "", false
+	}
+	for _, u := range h.cfg.Users {
+		if strings.EqualFold(u.CommonName, cn) {
+			member := len(group) > 0 && findIndex(u.GroupNames, group) != -1
+			return u.CommonName, member && u.active(time.Now())
+		}
+	}
+	return "", false
+}
+
+// selfServiceFactors reports whether a user bound with factors may change
+// their own userPassword: with their password, and an OTP other than a
+// recovery code when they have one, not with an app password
+func (h configHandler) selfServiceFactors(user string, factors []string) bool {
+	password, otp := false, false
+	for _, factor := range factors {
+		switch factor {
+		case "password":
+			password = true
+		case "app_password", "recovery_code":
+			return false
+		default:
+			otp = true
+		}
+	}
+	for _, u := range h.cfg.Users {
+		if strings.EqualFold(u.CommonName, user) {
+			return password && (otp || !u.hasOTP())
+		}
+	}
+	return false
+}
+
+// write runs an LDAP write: it checks the bound user may write, applies edit
+// to a copy of the directory, validates and saves the result. passwordChange
+// tells a write that only changes userPassword, which users may do to their
+// own entry when bound with their password, and must do first when their
+// password must be changed.
+func (h configHandler) write(operation, boundDN, dn string, passwordChange bool, conn net.Conn, edit func(e *directoryEdit, ou, cn string) error) (resultCode ldap.LDAPResultCode, err error) {
+	clog := newConnLogger(conn)
+	rec := newAuditRecord(operation, boundDN, conn)
+	rec.DN = dn
+	defer func() {
+		observeWrite(operation, resultCode)
+		rec.write(resultCode)
+	}()
+	clog.Infof("Write request: %s '%s' as '%s' from %s", operation, dn, boundDN, conn.RemoteAddr().String())
+
+	user, ok := h.writeAccess(boundDN)
+	rec.User = user
+	mustChange := sessionMustChangePassword(conn)
+	ownPassword := passwordChange && len(user) > 0 && sameDN(dn, boundDN) &&
+		(mustChange || h.selfServiceFactors(user, sessionFactors(conn)))
+	if mustChange && !ownPassword {
+		clog.Warningf("Write Error: %s '%s': '%s' must change their password first", operation, dn, boundDN)
+		rec.fail(writeOutcomeDenied, "password must be changed")
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	if !ok && passwordChange && len(user) > 0 && sameDN(dn, boundDN) && !ownPassword {
+		clog.Warningf("Write Error: %s '%s': '%s' must bind with their password to change it", operation, dn, boundDN)
+		rec.fail(writeOutcomeDenied, "not bound with the password")
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	if !ok && !ownPassword {
+		clog.Warningf("Write Error: %s '%s': '%s' is not a member of the admin group", operation, dn, boundDN)
+		rec.fail(writeOutcomeDenied, "not a member of the admin group")
+		return ldap.LDAPResultInsufficientAccessRights, nil
+	}
+	ou, cn, ok := parseEntryDN(dn, h.cfg.Backend.BaseDN)
+	if !ok {
+		clog.Warningf("Write Error: %s '%s': not a user or group", operation, dn)
+		rec.fail(writeOutcomeRejected, "not a user or group DN")
+		if operation == "add" {
+			return ldap.LDAPResultUnwillingToPerform, nil
+		}
+		return ldap.LDAPResultNoSuchObject, nil
+	}
+
+	e := newDirectoryEdit(h.cfg)
+	e.boundUser = user
+	err = edit(e, ou, cn)
+	if err == nil {
+		if problems := e.check(); len(problems) > 0 {
+			err = writeErrorf(ldap.LDAPResultConstraintViolation, "%s", problems[0].message)
+		}
+	}
+	if err == nil {
+		err = h.store.apply(e.changes())
+	}
+	if err != nil {
+		if refused, ok := err.(*writeError); ok {
+			clog.Warningf("Write Error: %s '%s': %s", operation, dn, refused.message)
+			rec.fail(writeOutcomeRejected, refused.message)
+			return refused.code, nil
+		}
+		clog.Errorf("Write Error: %s '%s': unable to save: %s", operation, dn, err.Error())
+		rec.fail(writeOutcomeFailed, err.Error())
+		return ldap.LDAPResultOperationsError, nil
+	}
+
+	clog.Noticef("Write success: %s '%s' as '%s'", operation, dn, boundDN)
+	if ownPassword {
+		sessionPasswordChanged(conn)
+	}
+	rec.Outcome = writeOutcomeSuccess
+	return ldap.LDAPResultSuccess, nil
+}
+
+func (h configHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	dn, attrs := addRequestFields(req)
+	return h.write("add", boundDN, dn, false, conn, func(e *directoryEdit, ou, cn string) error {
+		return e.add(ou, cn, attrs)
+	})
+}
+
+func (h configHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	dn, changes := modifyRequestFields(req)
+	passwordChange := len(changes) > 0
+	for _, change := range changes {
+		if !strings.EqualFold(change.name, "userPassword") {
+			passwordChange = false
+		}
+	}
+	return h.write("modify", boundDN, dn, passwordChange, conn, func(e *directoryEdit, ou, cn string) error {
+		return e.modify(ou, cn, changes)
+	})
+}
+
+func (h configHandler) Delete(boundDN string, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.write("delete", boundDN, deleteDN, false, conn, func(e *directoryEdit, ou, cn string) error {
+		return e.remove(ou, cn)
+	})
+}
+
+func (h configHandler) ModifyDN(boundDN string, req ldap.ModifyDNRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	dn, newRDN, _, newSuperior := modifyDNRequestFields(req)
+	return h.write("modifydn", boundDN, dn, false, conn, func(e *directoryEdit, ou, cn string) error {
+		return e.rename(ou, cn, newRDN, newSuperior)
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+// add sends an Add request; attrs are "name: value" pairs
+func (c *testClient) add(dn string, attrs ...string) ldap.LDAPResultCode {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationAddRequest, nil, "Add Request")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Entry"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attr := range attrs {
+		pair := strings.SplitN(attr, ": ", 2)
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, pair[0], "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, pair[1], "Value"))
+		a.AppendChild(values)
+		list.AppendChild(a)
+	}
+	op.AppendChild(list)
+	return resultCode(c.request(op))
+}
+
+// del sends a Delete request
+func (c *testClient) del(dn string) ldap.LDAPResultCode {
+	return resultCode(c.request(ber.NewString(ber.ClassApplication, ber.TypePrimitive, ldap.ApplicationDelRequest, dn, "Del Request")))
+}
+
+// modifyDN sends a ModifyDN request that keeps the entry under its parent
+func (c *testClient) modifyDN(dn, newRDN string) ldap.LDAPResultCode {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationModifyDNRequest, nil, "Modify DN Request")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Entry"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, newRDN, "New RDN"))
+	op.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Delete Old RDN"))
+	return resultCode(c.request(op))
+}
+
+// changeNames describes changes as "user old>new", with an empty name for a
+// new or deleted entry
+func changeNames(changes []directoryChanges) []string {
+	names := []string{}
+	for _, c := range changes {
+		for _, u := range c.users {
+			name := ""
+			if u.user != nil {
+				name = u.user.CommonName
+			}
+			names = append(names, fmt.Sprintf("user %s>%s", u.name, name))
+		}
+		for _, g := range c.groups {
+			name := ""
+			if g.group != nil {
+				name = g.group.CommonName
+			}
+			names = append(names, fmt.Sprintf("group %s>%s", g.name, name))
+		}
+	}
+	return names
+}
+
+func TestDirectoryWrites(t *testing.T) {
+	h := newTestHandler(&config{
+		Backend: configBackend{AdminGroup: "admins"},
+		Users: []configUser{
+			{CommonName: "admin", UserPassword: testPasswordHash, GroupNames: []string{"admins"}},
+			{CommonName: "alice", UserPassword: testPasswordHash, GroupNames: []string{"devs"}},
+			{CommonName: "bob", UserPassword: testPasswordHash},
+		},
+		Groups: []configGroup{{CommonName: "admins"}, {CommonName: "devs"}},
+	})
+	applied := []directoryChanges{}
+	h.store = testStore{&applied}
+	audit := captureAudit(t)
+	addr := startTestServer(t, h)
+	clients := map[string]*testClient{}
+	for _, user := range []string{"admin", "alice"} {
+		clients[user] = dialTestServer(t, addr)
+		if code := resultCode(clients[user].bind(userDN(user), "secret")); code != ldap.LDAPResultSuccess {
+			t.Fatalf("Bind as %s: %d", user, code)
+		}
+	}
+	groupDN := func(name string) string {
+		return "cn=" + name + ",ou=groups," + testBaseDN
+	}
+
+	// the store doesn't apply the changes: each write starts from the config
+	tests := []struct {
+		name      string
+		bound     string
+		operation string
+		write     func(c *testClient) ldap.LDAPResultCode
+		code      ldap.LDAPResultCode
+		reason    string
+		changes   []string
+	}{
+		{"add a user", "admin", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add(userDN("carol"), "objectClass: posixAccount", "mail: carol@example.com", "memberOf: "+groupDN("devs"))
+		}, ldap.LDAPResultSuccess, "", []string{"user >carol"}},
+		{"add an existing user", "admin", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add(userDN("bob"), "mail: bob@example.com")
+		}, ldap.LDAPResultEntryAlreadyExists, "'bob' already exists", nil},
+		{"add an unknown attribute", "admin", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add(userDN("carol"), "title: engineer")
+		}, ldap.LDAPResultUndefinedAttributeType, "users have no writable attribute 'title'", nil},
+		{"add a group", "admin", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add(groupDN("ops"), "description: Operations", "member: "+userDN("bob"))
+		}, ldap.LDAPResultSuccess, "", []string{"user bob>bob", "group >ops"}},
+		{"add outside of the directory", "admin", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add("cn=carol," + testBaseDN)
+		}, ldap.LDAPResultUnwillingToPerform, "not a user or group DN", nil},
+		{"add as a user", "alice", "add", func(c *testClient) ldap.LDAPResultCode {
+			return c.add(userDN("carol"))
+		}, ldap.LDAPResultInsufficientAccessRights, "not a member of the admin group", nil},
+		{"delete a user", "admin", "delete", func(c *testClient) ldap.LDAPResultCode {
+			return c.del(userDN("bob"))
+		}, ldap.LDAPResultSuccess, "", []string{"user bob>"}},
+		{"delete a group", "admin", "delete", func(c *testClient) ldap.LDAPResultCode {
+			return c.del(groupDN("devs"))
+		}, ldap.LDAPResultSuccess, "", []string{"user alice>alice", "group devs>"}},
+		{"delete a missing user", "admin", "delete", func(c *testClient) ldap.LDAPResultCode {
+			return c.del(userDN("carol"))
+		}, ldap.LDAPResultNoSuchObject, "'carol' does not exist", nil},
+		{"delete as a user", "alice", "delete", func(c *testClient) ldap.LDAPResultCode {
+			return c.del(userDN("bob"))
+		}, ldap.LDAPResultInsufficientAccessRights, "not a member of the admin group", nil},
+		{"rename a user", "admin", "modifydn", func(c *testClient) ldap.LDAPResultCode {
+			return c.modifyDN(userDN("bob"), "cn=robert")
+		}, ldap.LDAPResultSuccess, "", []string{"user bob>robert"}},
+		{"rename a group", "admin", "modifydn", func(c *testClient) ldap.LDAPResultCode {
+			return c.modifyDN(groupDN("devs"), "CN=developers")
+		}, ldap.LDAPResultSuccess, "", []string{"user alice>alice", "group devs>developers"}},
+		{"rename to an existing user", "admin", "modifydn", func(c *testClient) ldap.LDAPResultCode {
+			return c.modifyDN(userDN("bob"), "cn=alice")
+		}, ldap.LDAPResultEntryAlreadyExists, "'alice' already exists", nil},
+		{"rename with another RDN", "admin", "modifydn", func(c *testClient) ldap.LDAPResultCode {
+			return c.modifyDN(userDN("bob"), "uid=robert")
+		}, ldap.LDAPResultNamingViolation, "the new RDN must be cn=<name>", nil},
+		{"rename as a user", "alice", "modifydn", func(c *testClient) ldap.LDAPResultCode {
+			return c.modifyDN(userDN("alice"), "cn=alicia")
+		}, ldap.LDAPResultInsufficientAccessRights, "not a member of the admin group", nil},
+	}
+	for _, test := range tests {
+		applied = applied[:0]
+		audit()
+		if code := test.write(clients[test.bound]); code != test.code {
+			t.Errorf("%s: %d, want %d", test.name, code, test.code)
+		}
+		records := []auditRecord{}
+		for _, rec := range audit() {
+			if rec.Operation == test.operation {
+				records = append(records, rec)
+			}
+		}
+		if len(records) != 1 || records[0].Reason != test.reason {
+			t.Errorf("%s: audit %+v, want reason %q", test.name, records, test.reason)
+		}
+		if changes := changeNames(applied); strings.Join(changes, ",") != strings.Join(test.changes, ",") {
+			t.Errorf("%s: changes %q, want %q", test.name, changes, test.changes)
+		}
+	}
+}
+
+func TestChangeOwnPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		bound      string
+		factors    []string
+		mustChange bool
+		target     string
+		code       ldap.LDAPResultCode
+		reason     string
+	}{
+		{"password", "alice", []string{"password"}, false, "alice", ldap.LDAPResultSuccess, ""},
+		{"password and OTP", "olivia", []string{"password", "totp"}, false, "olivia", ldap.LDAPResultSuccess, ""},
+		{"password and push", "olivia", []string{"password", "push"}, false, "olivia", ldap.LDAPResultSuccess, ""},
+		{"password without the OTP", "olivia", []string{"password"}, false, "olivia", ldap.LDAPResultInsufficientAccessRights, "not bound with the password"},
+		{"recovery code", "olivia", []string{"password", "recovery_code"}, false, "olivia", ldap.LDAPResultInsufficientAccessRights, "not bound with the password"},
+		{"app password", "alice", []string{"app_password"}, false, "alice", ldap.LDAPResultInsufficientAccessRights, "not bound with the password"},
+		{"app password, must change", "alice", []string{"app_password"}, true, "alice", ldap.LDAPResultSuccess, ""},
+		{"grace login", "olivia", []string{"password", "totp"}, true, "olivia", ldap.LDAPResultSuccess, ""},
+		{"another user", "alice", []string{"password"}, false, "olivia", ldap.LDAPResultInsufficientAccessRights, "not a member of the admin group"},
+		{"admin", "admin", []string{"password"}, false, "alice", ldap.LDAPResultSuccess, ""},
+	}
+	audit := captureAudit(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHandler(&config{
+				Backend: configBackend{AdminGroup: "admins"},
+				Users: []configUser{
+					{CommonName: "admin", UserPassword: testPasswordHash, GroupNames: []string{"admins"}},
+					{CommonName: "alice", UserPassword: testPasswordHash},
+					{CommonName: "olivia", UserPassword: testPasswordHash, OTPSecret: "JBSWY3DPEHPK3PXP"},
+				},
+				Groups: []configGroup{{CommonName: "admins"}},
+			})
+			applied := []directoryChanges{}
+			h.store = testStore{&applied}
+			conn := newTestConn(t)
+			bindTestSession(t, conn, test.bound, test.factors, test.mustChange)
+
+			req := ldap.NewModifyRequest(userDN(test.target))
+			req.Replace("userPassword", []string{"n3w-Password"})
+			code, err := h.Modify(userDN(test.bound), *req, conn)
+			if code != test.code || err != nil {
+				t.Fatalf("Modify: %d %v, want %d", code, err, test.code)
+			}
+			if records := audit(); len(records) != 1 || records[0].Reason != test.reason {
+				t.Errorf("audit %+v, want reason %q", records, test.reason)
+			}
+			if test.code != ldap.LDAPResultSuccess {
+				if len(applied) > 0 {
+					t.Errorf("refused change applied: %+v", applied)
+				}
+				return
+			}
+			if len(applied) != 1 || len(applied[0].users) != 1 {
+				t.Fatalf("changes %+v", applied)
+			}
+			if ok, _ := checkPassword(applied[0].users[0].user.UserPassword, "n3w-Password"); !ok {
+				t.Error("userPassword not changed")
+			}
+			if sessionMustChangePassword(conn) {
+				t.Error("the password must still be changed")
+			}
+		})
+	}
+}
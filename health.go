@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default for configHTTP.CertWarningDays
+const defaultCertWarningDays = 14
+
+// How long a Yubico reachability probe result is reused
+const yubicoProbeInterval = time.Minute
+
+// healthStatus collects the state reported by /healthz and /readyz
+type healthStatus struct {
+	mu           sync.RWMutex
+	configLoaded bool
+	reloadFailed bool
+	listeners    map[string]bool
+	certExpiry   map[string]time.Time
+	certErrors   map[string]string
+
+	yubicoMu       sync.Mutex
+	yubikey        yubikeyValidator
+	yubicoErr      error
+	yubicoProbedAt time.Time
+}
+
+var health = &healthStatus{
+	listeners:  map[string]bool{},
+	certExpiry: map[string]time.Time{},
+	certErrors: map[string]string{},
+}
+
+// healthCheck is the result of a single check
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func (hs *healthStatus) setConfigLoaded(ok bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if ok {
+		hs.configLoaded = true
+	}
+	hs.reloadFailed = !ok
+}
+
+func (hs *healthStatus) setListener(name string, up bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.listeners[name] = up
+}
+
+func (hs *healthStatus) setCertExpiry(listener string, notAfter time.Time) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.certExpiry[listener] = notAfter
+}
+
+func (hs *healthStatus) setCertError(listener string, err error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.certErrors[listener] = err.Error()
+}
+
+func (hs *healthStatus) setYubikey(yubikey yubikeyValidator) {
+	hs.yubicoMu.Lock()
+	defer hs.yubicoMu.Unlock()
+	hs.yubikey = yubikey
+}
+
+// liveness checks whether the config is loaded and all listeners are serving
+func (hs *healthStatus) liveness() map[string]healthCheck {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	checks := map[string]healthCheck{}
+	switch {
+	case !hs.configLoaded:
+		checks["config"] = healthCheck{false, "not loaded"}
+	case hs.reloadFailed:
+		// The previous configuration is still in use
+		checks["config"] = healthCheck{true, "last reload failed"}
+	default:
+		checks["config"] = healthCheck{true, ""}
+	}
+	for name, up := range hs.listeners {
+		if up {
+			checks["listener:"+name] = healthCheck{true, ""}
+		} else {
+			checks["listener:"+name] = healthCheck{false, "not serving"}
+		}
+	}
+	return checks
+}
+
+// readiness extends liveness with certificate expiry and Yubico reachability.
+// A certificate that expires within certWarningDays is reported, but only an
+// expired or unreadable one fails.
+func (hs *healthStatus) readiness(certWarningDays int) map[string]healthCheck {
+	checks := hs.liveness()
+
+	hs.mu.RLock()
+	now := time.Now()
+	warning := time.Duration(certWarningDays) * 24 * time.Hour
+	for name, notAfter := range hs.certExpiry {
+		switch {
+		case now.After(notAfter):
+			checks["certificate:"+name] = healthCheck{false, "expired on " + notAfter.Format(time.RFC3339)}
+		case notAfter.Sub(now) < warning:
+			checks["certificate:"+name] = healthCheck{true, fmt.Sprintf("expires on %s, within %d days", notAfter.Format(time.RFC3339), certWarningDays)}
+		default:
+			checks["certificate:"+name] = healthCheck{true, "expires on " + notAfter.Format(time.RFC3339)}
+		}
+	}
+	for name, message := range hs.certErrors {
+		checks["certificate:"+name] = healthCheck{false, "unreadable: " + message}
+	}
+	hs.mu.RUnlock()
+
+	if probed, err := hs.probeYubico(); probed {
+		if err != nil {
+			checks["yubico"] = healthCheck{false, err.Error()}
+		} else {
+			checks["yubico"] = healthCheck{true, ""}
+		}
+	}
+	return checks
+}
+
+// probeYubico checks that at least one Yubico validation server responds.
+// The result is cached for yubicoProbeInterval.
+func (hs *healthStatus) probeYubico() (bool, error) {
+	hs.yubicoMu.Lock()
+	defer hs.yubicoMu.Unlock()
+	if hs.yubikey == nil || len(hs.yubikey.servers()) == 0 {
+		return false, nil
+	}
+	if time.Since(hs.yubicoProbedAt) < yubicoProbeInterval {
+		return true, hs.yubicoErr
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	hs.yubicoErr = fmt.Errorf("no validation server reachable")
+	for _, server := range hs.yubikey.servers() {
+		resp, err := client.Get(server)
+		if err != nil {
+			log.Debugf("Yubico validation server %s unreachable: %s", server, err.Error())
+			continue
+		}
+		resp.Body.Close()
+		hs.yubicoErr = nil
+		break
+	}
+	hs.yubicoProbedAt = time.Now()
+	return true, hs.yubicoErr
+}
+
+// serveHealth writes a health report, failing with 503 if any check failed
+func serveHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	report := healthReport{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "failed"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// runHealthcheck probes /healthz of a running instance, for use as a Docker
+// HEALTHCHECK. It reads only the [http] settings of the config files, so it
+// doesn't depend on secrets, remote users or databases being reachable.
+func runHealthcheck(configFile, format string) error {
+	cfg := config{}
+	if err := decodeConfigFiles(&cfg, configFile, format); err != nil {
+		return err
+	}
+	if !cfg.HTTP.Enabled || len(cfg.HTTP.Listen) == 0 {
+		return fmt.Errorf("the HTTP listener is not enabled: please set http.enabled and http.listen")
+	}
+	listen, err := expandString(cfg.HTTP.Listen)
+	if err != nil {
+		return fmt.Errorf("Setting 'http.listen': %s", err.Error())
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + localAddress(listen) + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	report := healthReport{}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		failed := []string{}
+		for name, check := range report.Checks {
+			if !check.OK {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, check.Message))
+			}
+		}
+		sort.Strings(failed)
+		return fmt.Errorf("%s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// localAddress turns a wildcard listen address into one that can be dialed
+func localAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessCertificates(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		err      error
+		ok       bool
+		message  string
+	}{
+		{"valid", now.AddDate(0, 0, 90), nil, true, "expires on"},
+		{"expires soon", now.AddDate(0, 0, 3), nil, true, "within 14 days"},
+		{"expired", now.AddDate(0, 0, -1), nil, false, "expired on"},
+		{"unreadable", time.Time{}, fmt.Errorf("x509: malformed certificate"), false, "unreadable: x509: malformed certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hs := &healthStatus{listeners: map[string]bool{}, certExpiry: map[string]time.Time{}, certErrors: map[string]string{}}
+			hs.setConfigLoaded(true)
+			if test.err != nil {
+				hs.setCertError("ldaps", test.err)
+			} else {
+				hs.setCertExpiry("ldaps", test.notAfter)
+			}
+			check := hs.readiness(defaultCertWarningDays)["certificate:ldaps"]
+			if check.OK != test.ok || !strings.Contains(check.Message, test.message) {
+				t.Errorf("%+v, want ok %v and %q", check, test.ok, test.message)
+			}
+		})
+	}
+}
+
+func TestRunHealthcheck(t *testing.T) {
+	status := http.StatusOK
+	probed := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed = r.URL.Path
+		serveHealth(w, map[string]healthCheck{"config": {status == http.StatusOK, "not loaded"}})
+	}))
+	defer server.Close()
+	listen := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name   string
+		config string
+		status int
+		err    string
+	}{
+		{"healthy", "[http]\n  enabled = true\n  listen = \"" + listen + "\"\n", http.StatusOK, ""},
+		{"unhealthy", "[http]\n  enabled = true\n  listen = \"" + listen + "\"\n", http.StatusServiceUnavailable, "config: not loaded"},
+		{"HTTP disabled", "[http]\n  listen = \"" + listen + "\"\n", http.StatusOK, "the HTTP listener is not enabled"},
+		// nothing but [http] is read: unset secrets and invalid settings don't matter
+		{"other settings", "yubikeySecret = \"${AUTHNDS_UNSET_VARIABLE}\"\n[sql]\n  driver = \"none\"\n" +
+			"[http]\n  enabled = true\n  listen = \"" + listen + "\"\n", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.toml")
+			if err := ioutil.WriteFile(configFile, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			status, probed = test.status, ""
+			err := runHealthcheck(configFile, "")
+			if len(test.err) == 0 && err != nil || len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+			if err == nil && probed != "/healthz" {
+				t.Errorf("probed %q", probed)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Timeouts of the HTTP server, which also serves the push callbacks of
+// services outside the network
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	httpWriteTimeout      = 30 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// backendConfig returns the config a backend was built from: the most
+// recently loaded one for a reloadable backend
+func backendConfig(b Backend) *config {
+	switch h := b.(type) {
+	case *reloadableBackend:
+		return backendConfig(h.backend())
+	case *sqlHandler:
+		return h.cfg
+	case configHandler:
+		return h.cfg
+	}
+	return nil
+}
+
+// startHTTP serves the optional HTTP admin endpoints
+func startHTTP(httpConfig *configHTTP, backend Backend) {
+	log.Noticef("HTTP server listening on %s", httpConfig.Listen)
+	server := &http.Server{
+		Addr:              httpConfig.Listen,
+		Handler:           newHTTPMux(httpConfig, backend),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("HTTP Server Failed: %s", err.Error())
+	}
+}
+
+// newHTTPMux routes the HTTP endpoints. httpConfig is the startup config;
+// the admin token is read from the current config, so it changes on reload.
+func newHTTPMux(httpConfig *configHTTP, backend Backend) *http.ServeMux {
+	adminToken := func() string {
+		if cfg := backendConfig(backend); cfg != nil {
+			return cfg.HTTP.AdminToken
+		}
+		return httpConfig.AdminToken
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, health.liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, health.readiness(httpConfig.CertWarningDays))
+	})
+	mux.HandleFunc("/sessions", adminOnly(adminToken, serveSessions))
+	mux.HandleFunc("/sessions/", adminOnly(adminToken, serveSessions))
+	mux.HandleFunc("/push/", servePush)
+	mux.HandleFunc("/app-passwords", adminOnly(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		serveAppPasswords(w, r, backend)
+	}))
+	return mux
+}
+
+// adminOnly serves an admin endpoint to requests with the bearer token, and
+// refuses all requests without a token configured
+func adminOnly(adminToken func() string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		token := adminToken()
+		if len(token) == 0 {
+			serveJSONError(w, http.StatusForbidden, "admin endpoints are disabled: set http.adminToken")
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			log.Warningf("HTTP admin request for %s from '%s' refused: invalid bearer token", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="authnds"`)
+			serveJSONError(w, http.StatusUnauthorized, "invalid bearer token")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"no token configured", "", "Bearer ", http.StatusForbidden},
+		{"no token configured, none sent", "", "", http.StatusForbidden},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"empty bearer", "s3cret", "Bearer ", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer s3crex", http.StatusUnauthorized},
+		{"basic auth", "s3cret", "Basic czNjcmV0", http.StatusUnauthorized},
+		{"right token", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			served := false
+			handler := adminOnly(func() string { return test.token }, func(w http.ResponseWriter, r *http.Request) {
+				served = true
+			})
+			r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+			if len(test.header) > 0 {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+			if served != (test.status == http.StatusOK) {
+				t.Errorf("handler served: %v", served)
+			}
+		})
+	}
+}
+
+func TestAdminTokenReload(t *testing.T) {
+	cfg := &config{HTTP: configHTTP{AdminToken: "s3cret"}}
+	backend := newReloadableBackend(newTestHandler(cfg))
+	mux := newHTTPMux(&cfg.HTTP, backend)
+	tests := []struct {
+		name   string
+		token  string // of the reloaded config, "" for the startup one
+		header string
+		status int
+	}{
+		{"startup token", "", "Bearer s3cret", http.StatusOK},
+		{"old token", "n3w", "Bearer s3cret", http.StatusUnauthorized},
+		{"new token", "n3w", "Bearer n3w", http.StatusOK},
+	}
+	for _, test := range tests {
+		if len(test.token) > 0 {
+			backend.swap(newTestHandler(&config{HTTP: configHTTP{AdminToken: test.token}}))
+		}
+		r := httptest.NewRequest(http.MethodGet, "/app-passwords", nil)
+		r.Header.Set("Authorization", test.header)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
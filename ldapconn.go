@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+const (
+	oidStartTLS              = "1.3.6.1.4.1.1466.20037"
+	oidWhoAmI                = "1.3.6.1.4.1.4203.1.11.3"
+	oidNoticeOfDisconnection = "1.3.6.1.4.1.1466.20036"
+)
+
+// The ldap library answers extended operations with a bare result code: it
+// can't return the authorization identity of a WhoAmI (RFC 4532), and it only
+// passes them to a handler on listeners that offer StartTLS. ldapConn sits
+// between the library and the client connection and answers every extended
+// operation itself, StartTLS included. Everything else is passed on to the
+// library unchanged, but for the Bind answering an OTP challenge, which is
+// turned into a Bind as the user challenged. Bind responses are given the
+// Password Policy control the library can't send. It also keeps the session
+// of the connection up to date, and enforces its timeouts.
+//
+// The library reads a request, answers it and only then reads the next one,
+// so requests are answered in order, and ldapConn never writes while the
+// library does.
+
+// ldapListener wraps the accepted connections of a listener in an ldapConn
+type ldapListener struct {
+	net.Listener
+	tlsConfig  *tls.Config // offers StartTLS when set
+	enforceTLS bool
+	secure     bool // connections are TLS from the start
+}
+
+// newLDAPListener wraps the listener ln opened for l; StartTLS is offered on
+// tcp listeners with a certificate
+func newLDAPListener(ln net.Listener, l *configListener, tlsConfig *tls.Config) net.Listener {
+	ll := ldapListener{Listener: ln, secure: l.Type == "tls"}
+	if l.Type == "tcp" && tlsConfig != nil {
+		ll.tlsConfig = tlsConfig
+		ll.enforceTLS = l.EnforceTLS
+	}
+	return ll
+}
+
+func (l ldapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	c := &ldapConn{
+		conn:       conn,
+		tlsConfig:  l.tlsConfig,
+		enforceTLS: l.enforceTLS,
+	}
+	c.session = sessions.open(c, l.secure)
+	return c, nil
+}
+
+// ldapConn is the connection the ldap library serves
+type ldapConn struct {
+	tlsConfig  *tls.Config
+	enforceTLS bool
+	session    *session
+
+	// used by the goroutine of the library only
+	pending   bytes.Buffer // request read for the library
+	binding   bool         // a Bind request waits for its response
+	bindingDN string
+	ppolicy   bool // the Bind asked for the Password Policy control
+
+	mu      sync.Mutex
+	conn    net.Conn   // replaced by a *tls.Conn on StartTLS
+	writeMu sync.Mutex // a session may be killed while the library writes
+}
+
+// transport returns the connection requests are read from
+func (c *ldapConn) transport() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Read returns the next request for the library. A session that times out
+// while waiting for one is sent a Notice of Disconnection, and is closed.
+func (c *ldapConn) Read(p []byte) (int, error) {
+	for c.pending.Len() == 0 {
+		deadline, reason := sessions.deadline(c.session)
+		if err := c.transport().SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		var raw bytes.Buffer
+		packet, err := ber.ReadPacket(io.TeeReader(c.transport(), &raw))
+		if c.session.isEnded() {
+			// killed
+			return 0, io.EOF
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && raw.Len() == 0 {
+				sessions.end(c.session, reason)
+				c.disconnect("Session timed out")
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if fixed, err := fixControls(packet); err != nil {
+			newConnLogger(c).Warningf("Closing the connection from %s: %s", c.RemoteAddr().String(), err.Error())
+			return 0, io.EOF
+		} else if fixed {
+			raw.Reset()
+			raw.Write(packet.Bytes())
+		}
+		if c.answerChallenge(packet) {
+			raw.Reset()
+			raw.Write(packet.Bytes())
+		}
+		answered, err := c.handle(packet)
+		if err != nil {
+			return 0, err
+		}
+		if !answered {
+			c.pending.Write(raw.Bytes())
+		}
+	}
+	return c.pending.Read(p)
+}
+
+// Write sends a response of the library. Bind responses are checked to track
+// the bound DN the way the library does: a successful Bind replaces it, a
+// failed one leaves it unchanged. They carry the Password Policy control of
+// the Bind handler, if the client asked for it.
+func (c *ldapConn) Write(p []byte) (int, error) {
+	out := p
+	if c.binding {
+		if packet, err := ber.DecodePacketErr(p); err == nil && len(packet.Children) > 1 {
+			response := packet.Children[1]
+			if response.ClassType == ber.ClassApplication && response.Tag == ldap.ApplicationBindResponse {
+				c.binding = false
+				ok := len(response.Children) > 0 && response.Children[0].Value == int64(ldap.LDAPResultSuccess)
+				if ppolicy := c.session.takePasswordPolicy(); ppolicy != nil && c.ppolicy && len(packet.Children) == 2 {
+					controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+					controls.AppendChild(ppolicy.control())
+					packet.AppendChild(controls)
+					out = packet.Bytes()
+				}
+				c.session.bound(c.bindingDN, ok)
+			}
+		}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.transport().Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the session, unless it ended already
+func (c *ldapConn) Close() error {
+	sessions.end(c.session, sessionEndClose)
+	return c.transport().Close()
+}
+
+// disconnect sends a Notice of Disconnection (RFC 4511) and closes the
+// connection, from any goroutine
+func (c *ldapConn) disconnect(message string) {
+	c.respond(0, ldap.LDAPResultUnavailable, message, oidNoticeOfDisconnection, nil)
+	c.transport().Close()
+}
+
+func (c *ldapConn) LocalAddr() net.Addr {
+	return c.transport().LocalAddr()
+}
+
+// RemoteAddr is forwarded to the accepted connection, see connAddr
+func (c *ldapConn) RemoteAddr() net.Addr {
+	return c.transport().RemoteAddr()
+}
+
+func (c *ldapConn) SetDeadline(t time.Time) error {
+	return c.transport().SetDeadline(t)
+}
+
+func (c *ldapConn) SetReadDeadline(t time.Time) error {
+	return c.transport().SetReadDeadline(t)
+}
+
+func (c *ldapConn) SetWriteDeadline(t time.Time) error {
+	return c.transport().SetWriteDeadline(t)
+}
+
+// handle looks at a request before the library does, and answers it when
+// it's an extended operation. An error closes the connection.
+func (c *ldapConn) handle(packet *ber.Packet) (bool, error) {
+	if len(packet.Children) < 2 {
+		// the library drops the connection
+		return false, nil
+	}
+	messageID, _ := packet.Children[0].Value.(int64)
+	req := packet.Children[1]
+	if req.ClassType != ber.ClassApplication {
+		return false, nil
+	}
+	clog := newConnLogger(c)
+	c.session.count(req.Tag)
+
+	secure := c.session.isTLS()
+	if c.enforceTLS && !secure && (req.Tag != ldap.ApplicationExtendedRequest || extendedRequestName(req) != oidStartTLS) {
+		clog.Warningf("Request before StartTLS from %s, closing the connection", c.RemoteAddr().String())
+		if err := c.respond(messageID, ldap.LDAPResultProtocolError, "Upgrade to TLS is required", "", nil); err != nil {
+			return true, err
+		}
+		return true, io.EOF
+	}
+
+	switch req.Tag {
+	case ldap.ApplicationBindRequest:
+		c.binding = false
+		if len(req.Children) > 1 {
+			c.binding = true
+			c.bindingDN, _ = req.Children[1].Value.(string)
+			c.ppolicy = hasControl(packet, oidPasswordPolicy)
+		}
+		return false, nil
+	case ldap.ApplicationUnbindRequest:
+		sessions.end(c.session, sessionEndUnbind)
+		return false, nil
+	case ldap.ApplicationExtendedRequest:
+	default:
+		return false, nil
+	}
+
+	name := extendedRequestName(req)
+	if hasCriticalControl(packet) {
+		clog.Warningf("Extended request %s with a critical control from %s", name, c.RemoteAddr().String())
+		return true, c.respond(messageID, ldap.LDAPResultUnavailableCriticalExtension, "Controls are not supported with extended operations", "", nil)
+	}
+	switch name {
+	case oidStartTLS:
+		if c.tlsConfig == nil {
+			return true, c.respond(messageID, ldap.LDAPResultProtocolError, "StartTLS is not offered on this listener", "", nil)
+		}
+		if secure {
+			return true, c.respond(messageID, ldap.LDAPResultOperationsError, "TLS is already established", "", nil)
+		}
+		if err := c.respond(messageID, ldap.LDAPResultSuccess, "", oidStartTLS, nil); err != nil {
+			return true, err
+		}
+		c.mu.Lock()
+		c.conn = tls.Server(c.conn, c.tlsConfig)
+		c.mu.Unlock()
+		c.session.startedTLS()
+		clog.Debugf("StartTLS from %s", c.RemoteAddr().String())
+		return true, nil
+	case oidWhoAmI:
+		// RFC 4532: "dn:" and the bound DN, or an empty value for anonymous
+		authzID := ""
+		boundDN := c.session.bindDN()
+		if len(boundDN) > 0 {
+			authzID = "dn:" + boundDN
+		}
+		clog.Infof("WhoAmI request as '%s' from %s", boundDN, c.RemoteAddr().String())
+		return true, c.respond(messageID, ldap.LDAPResultSuccess, "", "", &authzID)
+	}
+	clog.Warningf("Unsupported extended request %s from %s", name, c.RemoteAddr().String())
+	return true, c.respond(messageID, ldap.LDAPResultProtocolError, "Unsupported extended operation: "+name, "", nil)
+}
+
+// answerChallenge ends the pending OTP challenge of the session on a Bind.
+// When the Bind answers it, it becomes a Bind as the user challenged, so the
+// library binds the connection as that user; it reports whether the request
+// changed.
+func (c *ldapConn) answerChallenge(packet *ber.Packet) bool {
+	if len(packet.Children) < 2 {
+		return false
+	}
+	req := packet.Children[1]
+	if req.ClassType != ber.ClassApplication || req.Tag != ldap.ApplicationBindRequest || len(req.Children) < 2 {
+		return false
+	}
+	name, _ := req.Children[1].Value.(string)
+	userDN, ok := c.session.takeChallenge(name)
+	if !ok {
+		return false
+	}
+	req.Children[1] = ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, userDN, "Bind DN")
+	encodeChildren(packet)
+	newConnLogger(c).Debugf("Bind to '%s' answers the OTP challenge of '%s'", name, userDN)
+	return true
+}
+
+// respond sends an extended response, with an optional name and value
+func (c *ldapConn) respond(messageID int64, code ldap.LDAPResultCode, message, name string, value *string) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedResponse, nil, "Extended Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	if len(name) > 0 {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, name, "Response Name"))
+	}
+	if value != nil {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, *value, "Response Value"))
+	}
+	packet.AppendChild(response)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.transport().Write(packet.Bytes())
+	return err
+}
+
+// extendedRequestName returns the OID of an extended request
+func extendedRequestName(req *ber.Packet) string {
+	if len(req.Children) == 0 {
+		return ""
+	}
+	return req.Children[0].Data.String()
+}
+
+// fixControls makes the controls of a request safe for the ldap library,
+// which panics, and takes the whole server down, on controls it can't decode.
+// Controls sent without a value are given an empty one, and it reports
+// whether the request changed; other malformed controls are an error.
+func fixControls(packet *ber.Packet) (bool, error) {
+	if len(packet.Children) < 3 {
+		return false, nil
+	}
+	fixed := false
+	for _, control := range packet.Children[2].Children {
+		if len(control.Children) == 0 || len(control.Children) > 3 {
+			return false, fmt.Errorf("malformed control")
+		}
+		controlType, ok := control.Children[0].Value.(string)
+		if !ok {
+			return false, fmt.Errorf("malformed control")
+		}
+		if len(control.Children) == 2 {
+			if _, ok := control.Children[1].Value.(bool); ok {
+				control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Control Value"))
+				fixed = true
+			}
+		}
+		if len(control.Children) == 3 {
+			if _, ok := control.Children[1].Value.(bool); !ok {
+				return false, fmt.Errorf("malformed control %s", controlType)
+			}
+		}
+		value, ok := control.Children[len(control.Children)-1].Value.(string)
+		if !ok {
+			return false, fmt.Errorf("malformed control %s", controlType)
+		}
+		if controlType == ldap.ControlTypePaging {
+			paging, err := ber.DecodePacketErr([]byte(value))
+			if err != nil || len(paging.Children) < 2 {
+				return false, fmt.Errorf("malformed control %s", controlType)
+			}
+			if _, ok := paging.Children[0].Value.(int64); !ok {
+				return false, fmt.Errorf("malformed control %s", controlType)
+			}
+		}
+	}
+	if fixed {
+		encodeChildren(packet)
+	}
+	return fixed, nil
+}
+
+// encodeChildren encodes a constructed packet again from its children,
+// after they changed
+func encodeChildren(p *ber.Packet) {
+	if p.TagType != ber.TypeConstructed {
+		return
+	}
+	p.Data.Reset()
+	for _, child := range p.Children {
+		encodeChildren(child)
+		p.Data.Write(child.Bytes())
+	}
+}
+
+// hasControl reports whether a request carries a control of type oid
+func hasControl(packet *ber.Packet, oid string) bool {
+	if len(packet.Children) < 3 {
+		return false
+	}
+	for _, control := range packet.Children[2].Children {
+		if len(control.Children) > 0 && control.Children[0].Value == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCriticalControl reports whether a request carries a critical control
+func hasCriticalControl(packet *ber.Packet) bool {
+	if len(packet.Children) < 3 {
+		return false
+	}
+	for _, control := range packet.Children[2].Children {
+		if len(control.Children) > 1 && control.Children[1].Value == true {
+			return true
+		}
+	}
+	return false
+}
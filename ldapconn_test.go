@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+// testListener counts the connections it accepted until they're closed
+type testListener struct {
+	net.Listener
+	conns *sync.WaitGroup
+}
+
+func (l testListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	l.conns.Add(1)
+	return &testServerConn{Conn: conn, closed: l.conns.Done}, nil
+}
+
+type testServerConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *testServerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
+
+// startTestServer serves h on a TCP listener of the loopback interface, as
+// startListeners does, and returns its address. The test ends once the
+// server closed its connections, so they don't log into the next test.
+func startTestServer(t *testing.T, h Backend) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		ln.Close()
+		conns.Wait()
+	})
+	s := newLDAPServer(h)
+	go s.Serve(newLDAPListener(newTrackedListener(testListener{ln, conns}, "test"), &configListener{Name: "test", Type: "tcp"}, nil))
+	return ln.Addr().String()
+}
+
+// testClient sends raw LDAP requests, for the operations and controls the
+// client of the ldap library doesn't have
+type testClient struct {
+	t         *testing.T
+	conn      net.Conn
+	messageID int64
+}
+
+func dialTestServer(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+// request sends an operation with controls, and returns the response to it
+func (c *testClient) request(op *ber.Packet, controls ...*ber.Packet) *ber.Packet {
+	c.messageID++
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.messageID, "Message ID"))
+	packet.AppendChild(op)
+	if len(controls) > 0 {
+		list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			list.AppendChild(control)
+		}
+		packet.AppendChild(list)
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		response, err := ber.ReadPacket(c.conn)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if id, _ := response.Children[0].Value.(int64); id == c.messageID && response.Children[1].Tag != ldap.ApplicationSearchResultEntry {
+			return response
+		}
+	}
+}
+
+// resultCode returns the result code of a response
+func resultCode(response *ber.Packet) ldap.LDAPResultCode {
+	code, _ := response.Children[1].Children[0].Value.(int64)
+	return ldap.LDAPResultCode(code)
+}
+
+// bind sends a simple Bind, and returns its response
+func (c *testClient) bind(dn, password string, controls ...*ber.Packet) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "User Name"))
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Password"))
+	return c.request(op, controls...)
+}
+
+// whoAmI sends a WhoAmI extended request, and returns its result code and
+// authorization identity
+func (c *testClient) whoAmI() (ldap.LDAPResultCode, string) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Extended Request")
+	op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, oidWhoAmI, "Request Name"))
+	response := c.request(op)
+	authzID := ""
+	for _, child := range response.Children[1].Children {
+		if child.ClassType == ber.ClassContext && child.Tag == 11 {
+			authzID = child.Data.String()
+		}
+	}
+	return resultCode(response), authzID
+}
+
+func TestWhoAmI(t *testing.T) {
+	h := newTestHandler(&config{Users: []configUser{{CommonName: "alice", UserPassword: testPasswordHash}, {CommonName: "bob", UserPassword: testPasswordHash}}})
+	c := dialTestServer(t, startTestServer(t, h))
+	tests := []struct {
+		name     string
+		dn       string
+		password string
+		authzID  string
+	}{
+		{"bound", userDN("alice"), "secret", "dn:" + userDN("alice")},
+		// the ldap library keeps the connection bound as before, and so do
+		// the session and WhoAmI
+		{"failed bind", userDN("bob"), "guess", "dn:" + userDN("alice")},
+		{"bound as another user", userDN("bob"), "secret", "dn:" + userDN("bob")},
+	}
+	if code, authzID := c.whoAmI(); code != ldap.LDAPResultSuccess || len(authzID) > 0 {
+		t.Errorf("anonymous: WhoAmI %d %q", code, authzID)
+	}
+	for _, test := range tests {
+		if code := resultCode(c.bind(test.dn, test.password)); (code == ldap.LDAPResultSuccess) != (test.password == "secret") {
+			t.Fatalf("%s: Bind %d", test.name, code)
+		}
+		if code, authzID := c.whoAmI(); code != ldap.LDAPResultSuccess || authzID != test.authzID {
+			t.Errorf("%s: WhoAmI %d %q, want %q", test.name, code, authzID, test.authzID)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/metala/ldap"
+)
+
+const (
+	// RFC 4370 proxied authorization control
+	controlTypeProxiedAuthz = "2.16.840.1.113730.3.4.18"
+	// RFC 4370 result code, missing from the ldap library
+	ldapResultAuthorizationDenied ldap.LDAPResultCode = 123
+)
+
+// The ldap library hands Add, Modify, ModifyDN and Compare requests to the
+// handlers as structs with unexported fields and no getters. reflect may
+// read, but not set, unexported fields, which is all the handlers need.
+
+// ldapAttribute is an attribute of an Add request, or of a Modify change
+type ldapAttribute struct {
+	name   string
+	values []string
+}
+
+// ldapModification is a single change of a Modify request: "add", "delete"
+// or "replace" values of an attribute
+type ldapModification struct {
+	operation string
+	ldapAttribute
+}
+
+// ldapAttributes reads a []ldap.Attribute or []ldap.PartialAttribute
+func ldapAttributes(list reflect.Value) []ldapAttribute {
+	attrs := []ldapAttribute{}
+	for i := 0; i < list.Len(); i++ {
+		attr := ldapAttribute{name: list.Index(i).FieldByName("attrType").String()}
+		values := list.Index(i).FieldByName("attrVals")
+		for j := 0; j < values.Len(); j++ {
+			attr.values = append(attr.values, values.Index(j).String())
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// addRequestFields returns the DN and attributes of the entry to add
+func addRequestFields(req ldap.AddRequest) (string, []ldapAttribute) {
+	v := reflect.ValueOf(req)
+	return v.FieldByName("dn").String(), ldapAttributes(v.FieldByName("attributes"))
+}
+
+// modifyRequestFields returns the DN and the changes of a Modify request.
+// The library groups the changes by operation and loses their order, so they
+// are returned as deletes, then adds, then replaces: the usual "delete the old
+// value, add the new one" still works.
+func modifyRequestFields(req ldap.ModifyRequest) (string, []ldapModification) {
+	v := reflect.ValueOf(req)
+	changes := []ldapModification{}
+	for _, op := range []struct{ field, operation string }{
+		{"deleteAttributes", "delete"},
+		{"addAttributes", "add"},
+		{"replaceAttributes", "replace"},
+	} {
+		for _, attr := range ldapAttributes(v.FieldByName(op.field)) {
+			changes = append(changes, ldapModification{op.operation, attr})
+		}
+	}
+	return v.FieldByName("dn").String(), changes
+}
+
+// modifyDNRequestFields returns the DN, the new RDN and the new superior (or
+// "") of a ModifyDN request
+func modifyDNRequestFields(req ldap.ModifyDNRequest) (dn string, newRDN string, deleteOldRDN bool, newSuperior string) {
+	v := reflect.ValueOf(req)
+	return v.FieldByName("dn").String(), v.FieldByName("newrdn").String(), v.FieldByName("deleteoldrdn").Bool(), v.FieldByName("newSuperior").String()
+}
+
+// compareRequestFields returns the DN, attribute and value of a Compare
+// request. The library decodes a single assertion.
+func compareRequestFields(req ldap.CompareRequest) (dn string, attribute string, value string) {
+	v := reflect.ValueOf(req)
+	ava := v.FieldByName("ava")
+	if ava.Len() > 0 {
+		attribute = ava.Index(0).FieldByName("attributeDesc").String()
+		value = ava.Index(0).FieldByName("assertionValue").String()
+	}
+	return v.FieldByName("dn").String(), attribute, value
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/metala/ldap"
+)
+
+const systemdListenPrefix = "systemd:"
+
+// systemd passes activated sockets starting at this file descriptor
+const systemdListenFdsStart = 3
+
+// validateListener checks a single [[listeners]] entry
+func validateListener(l *configListener) error {
+	if len(l.Listen) == 0 {
+		return fmt.Errorf("Listener '%s' has no 'listen' address", l.Name)
+	}
+	switch l.Type {
+	case "tcp":
+		if l.EnforceTLS && (len(l.Cert) == 0 || len(l.Key) == 0) {
+			return fmt.Errorf("Listener '%s' enforces TLS but no certificate or key were specified: please use the 'cert' and 'key' options", l.Name)
+		}
+	case "tls":
+		if len(l.Cert) == 0 || len(l.Key) == 0 {
+			return fmt.Errorf("Listener '%s' uses TLS but no certificate or key were specified: please use the 'cert' and 'key' options", l.Name)
+		}
+	case "unix":
+		if len(l.Mode) > 0 {
+			if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil {
+				return fmt.Errorf("Listener '%s' has an invalid socket mode '%s': please use an octal mode such as \"0660\"", l.Name, l.Mode)
+			}
+		}
+	default:
+		return fmt.Errorf("Listener '%s' has unknown type '%s': please use one of 'tcp', 'tls' or 'unix'", l.Name, l.Type)
+	}
+	return nil
+}
+
+// legacyListeners converts the [ldap] and [ldaps] sections into listeners
+func legacyListeners(cfg *config) []configListener {
+	listeners := []configListener{}
+	if cfg.LDAP.Enabled {
+		l := configListener{Name: "ldap", Type: "tcp", Listen: cfg.LDAP.Listen}
+		if cfg.LDAPS.EnforceTLS {
+			// StartTLS on the plain listener, as the single server used to do
+			l.EnforceTLS = true
+			l.Cert = cfg.LDAPS.Cert
+			l.Key = cfg.LDAPS.Key
+		}
+		listeners = append(listeners, l)
+	}
+	if cfg.LDAPS.Enabled {
+		listeners = append(listeners, configListener{
+			Name:   "ldaps",
+			Type:   "tls",
+			Listen: cfg.LDAPS.Listen,
+			Cert:   cfg.LDAPS.Cert,
+			Key:    cfg.LDAPS.Key,
+		})
+	}
+	return listeners
+}
+
+// listenerTLSConfig loads the certificate of a listener, if any
+func listenerTLSConfig(l *configListener, serverName string) (*tls.Config, error) {
+	if len(l.Cert) == 0 || len(l.Key) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load TLS configuration for listener '%s': %s", l.Name, err.Error())
+	}
+	return &tls.Config{
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// openListener opens the socket of a listener and wraps it in TLS when needed
+func openListener(l *configListener, tlsConfig *tls.Config, activated map[string]net.Listener) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if strings.HasPrefix(l.Listen, systemdListenPrefix) {
+		name := strings.TrimPrefix(l.Listen, systemdListenPrefix)
+		var ok bool
+		if ln, ok = activated[name]; !ok {
+			return nil, fmt.Errorf("Listener '%s': no socket '%s' was passed by systemd", l.Name, name)
+		}
+	} else if l.Type == "unix" {
+		if ln, err = listenUnix(l); err != nil {
+			return nil, err
+		}
+	} else if ln, err = net.Listen("tcp", l.Listen); err != nil {
+		return nil, err
+	}
+
+	ln = newTrackedListener(ln, l.Name)
+	if l.Type == "tls" {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return newLDAPListener(ln, l, tlsConfig), nil
+}
+
+// listenUnix creates a Unix domain socket and applies its mode and ownership
+func listenUnix(l *configListener) (net.Listener, error) {
+	// Remove a stale socket left behind by an unclean shutdown
+	if fi, err := os.Stat(l.Listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(l.Listen); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", l.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(l.Mode) > 0 {
+		mode, _ := strconv.ParseUint(l.Mode, 8, 32)
+		if err := os.Chmod(l.Listen, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if len(l.Owner) > 0 || len(l.Group) > 0 {
+		uid, gid := -1, -1
+		if len(l.Owner) > 0 {
+			u, err := user.Lookup(l.Owner)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if len(l.Group) > 0 {
+			g, err := user.LookupGroup(l.Group)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err := os.Chown(l.Listen, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// keyed by both their FileDescriptorName and their index
+func systemdListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds == 0 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < nfds; i++ {
+		fd := systemdListenFdsStart + i
+		name := strconv.Itoa(i)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use systemd socket #%d (%s): %s", i, name, err.Error())
+		}
+		listeners[name] = ln
+		listeners[strconv.Itoa(i)] = ln
+	}
+	return listeners, nil
+}
+
+// newLDAPServer creates the LDAP server serving a single listener. StartTLS
+// and the other extended operations are answered by ldapConn.
+func newLDAPServer(handler Backend) *ldap.Server {
+	s := ldap.NewServer()
+	s.EnforceLDAP = true
+	s.BindFunc("", handler)
+	s.SearchFunc("", handler)
+	s.AddFunc("", handler)
+	s.ModifyFunc("", handler)
+	s.DeleteFunc("", handler)
+	s.ModifyDNFunc("", handler)
+	s.CompareFunc("", handler)
+	s.CloseFunc("", handler)
+	return s
+}
+
+// startListeners opens every listener and serves it in the background;
+// errors from any of them are sent to the returned channel
+func startListeners(cfg *config, handler Backend) (<-chan error, error) {
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(chan error, len(cfg.Listeners))
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		tlsConfig, err := listenerTLSConfig(l, cfg.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		observeCertificateExpiry(l.Name, tlsConfig)
+		ln, err := openListener(l, tlsConfig, activated)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open listener '%s': %s", l.Name, err.Error())
+		}
+
+		s := newLDAPServer(handler)
+		log.Noticef("%s listener '%s' listening on %s", strings.ToUpper(l.Type), l.Name, l.Listen)
+		health.setListener(l.Name, true)
+		go func(name string) {
+			if err := s.Serve(ln); err != nil {
+				health.setListener(name, false)
+				errs <- fmt.Errorf("Listener '%s' failed: %s", name, err.Error())
+			}
+		}(l.Name)
+	}
+	return errs, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadListeners(t *testing.T) {
+	const header = "[backend]\n  baseDN = \"dc=example,dc=com\"\n"
+	tests := []struct {
+		name      string
+		config    string
+		listeners []string // name/type of each listener
+		err       string
+	}{
+		{
+			name:      "defaults",
+			config:    header + "[[listeners]]\n  listen = \"127.0.0.1:389\"\n[[listeners]]\n  name = \"local\"\n  type = \"unix\"\n  listen = \"/run/authnds/ldapi\"\n  mode = \"0660\"\n",
+			listeners: []string{"listener0/tcp", "local/unix"},
+		},
+		{
+			name:      "systemd",
+			config:    header + "[[listeners]]\n  name = \"ldaps\"\n  type = \"tls\"\n  listen = \"systemd:ldaps\"\n  cert = \"cert.pem\"\n  key = \"key.pem\"\n",
+			listeners: []string{"ldaps/tls"},
+		},
+		{
+			name:   "duplicate name",
+			config: header + "[[listeners]]\n  name = \"ldap\"\n  listen = \"127.0.0.1:389\"\n[[listeners]]\n  name = \"ldap\"\n  listen = \"127.0.0.1:1389\"\n",
+			err:    "Listener name 'ldap' is used more than once",
+		},
+		{
+			name:   "no address",
+			config: header + "[[listeners]]\n  name = \"ldap\"\n",
+			err:    "Listener 'ldap' has no 'listen' address",
+		},
+		{
+			name:   "TLS without a certificate",
+			config: header + "[[listeners]]\n  name = \"ldaps\"\n  type = \"tls\"\n  listen = \"127.0.0.1:636\"\n",
+			err:    "Listener 'ldaps' uses TLS but no certificate or key were specified",
+		},
+		{
+			name:   "StartTLS without a certificate",
+			config: header + "[[listeners]]\n  name = \"ldap\"\n  listen = \"127.0.0.1:389\"\n  enforceTLS = true\n",
+			err:    "Listener 'ldap' enforces TLS but no certificate or key were specified",
+		},
+		{
+			name:   "invalid mode",
+			config: header + "[[listeners]]\n  name = \"local\"\n  type = \"unix\"\n  listen = \"/run/authnds/ldapi\"\n  mode = \"rw\"\n",
+			err:    "Listener 'local' has an invalid socket mode 'rw'",
+		},
+		{
+			name:   "unknown type",
+			config: header + "[[listeners]]\n  name = \"udp\"\n  type = \"udp\"\n  listen = \"127.0.0.1:389\"\n",
+			err:    "Listener 'udp' has unknown type 'udp'",
+		},
+		{
+			name:   "with [ldap]",
+			config: header + "[ldap]\n  enabled = true\n  listen = \"127.0.0.1:389\"\n[[listeners]]\n  listen = \"127.0.0.1:1389\"\n",
+			err:    "Both [[listeners]] and [frontend], [ldap] or [ldaps] server-config in use",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfigFiles(t, []string{"config.toml"}, test.config), "")
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			listeners := []string{}
+			for _, l := range cfg.Listeners {
+				listeners = append(listeners, l.Name+"/"+l.Type)
+			}
+			if strings.Join(listeners, ",") != strings.Join(test.listeners, ",") {
+				t.Errorf("listeners %v, want %v", listeners, test.listeners)
+			}
+		})
+	}
+}
+
+func TestLegacyListeners(t *testing.T) {
+	tests := []struct {
+		name      string
+		ldap      configLDAP
+		ldaps     configLDAPS
+		listeners []configListener
+	}{
+		{
+			name:      "LDAP",
+			ldap:      configLDAP{Enabled: true, Listen: "0.0.0.0:389"},
+			listeners: []configListener{{Name: "ldap", Type: "tcp", Listen: "0.0.0.0:389"}},
+		},
+		{
+			name:  "LDAP and LDAPS",
+			ldap:  configLDAP{Enabled: true, Listen: "0.0.0.0:389"},
+			ldaps: configLDAPS{Enabled: true, Listen: "0.0.0.0:636", Cert: "cert.pem", Key: "key.pem"},
+			listeners: []configListener{
+				{Name: "ldap", Type: "tcp", Listen: "0.0.0.0:389"},
+				{Name: "ldaps", Type: "tls", Listen: "0.0.0.0:636", Cert: "cert.pem", Key: "key.pem"},
+			},
+		},
+		{
+			name:      "StartTLS",
+			ldap:      configLDAP{Enabled: true, Listen: "0.0.0.0:389"},
+			ldaps:     configLDAPS{EnforceTLS: true, Cert: "cert.pem", Key: "key.pem"},
+			listeners: []configListener{{Name: "ldap", Type: "tcp", Listen: "0.0.0.0:389", Cert: "cert.pem", Key: "key.pem", EnforceTLS: true}},
+		},
+	}
+	for _, test := range tests {
+		listeners := legacyListeners(&config{LDAP: test.ldap, LDAPS: test.ldaps})
+		if len(listeners) != len(test.listeners) {
+			t.Errorf("%s: listeners %+v, want %+v", test.name, listeners, test.listeners)
+			continue
+		}
+		for i := range listeners {
+			if listeners[i] != test.listeners[i] {
+				t.Errorf("%s: listener %+v, want %+v", test.name, listeners[i], test.listeners[i])
+			}
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ldapi")
+	l := &configListener{Name: "local", Type: "unix", Listen: socket, Mode: "0600"}
+	// a socket left behind by an unclean shutdown is replaced
+	for _, run := range []string{"first", "stale socket"} {
+		ln, err := listenUnix(l)
+		if err != nil {
+			t.Fatalf("%s: %s", run, err.Error())
+		}
+		fi, err := os.Stat(socket)
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: socket %v %v, want mode 0600", run, fi, err)
+		}
+		if conn, err := net.Dial("unix", socket); err != nil {
+			t.Errorf("%s: %s", run, err.Error())
+		} else {
+			conn.Close()
+		}
+		// leave the socket file, as a crash would
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+	}
+}
+
+func TestSystemdListenersOfAnotherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("listeners %v %v, want none", listeners, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Error("LISTEN_FDS was not unset")
+	}
+}
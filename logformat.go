@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	textLogFormat        = "%{color}%{time:15:04:05.000000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}"
+	textNoColorLogFormat = "%{time:15:04:05.000000} %{shortfunc} ▶ %{level:.4s} %{id:03x} %{message}"
+	// the header of a syslog message carries the time
+	textSyslogLogFormat = "%{shortfunc} ▶ %{level:.4s} %{id:03x} %{message}"
+)
+
+// connLog logs on behalf of a connection; the extra call depth makes
+// %{shortfunc} report the caller of connLogger instead of connLogger itself
+var connLog = &logging.Logger{Module: programName, ExtraCalldepth: 1}
+
+// connMessage is a log message tagged with the ID of its connection. The text
+// format prints the ID in front of the message, the structured formats emit it
+// as a separate field.
+type connMessage struct {
+	connID uint64
+	text   string
+}
+
+func (m connMessage) String() string {
+	return fmt.Sprintf("[conn %d] %s", m.connID, m.text)
+}
+
+// connLogger logs messages tagged with the connection ID of conn
+type connLogger uint64
+
+func newConnLogger(conn net.Conn) connLogger {
+	id, _ := connInfo(conn)
+	return connLogger(id)
+}
+
+func (l connLogger) message(format string, args ...interface{}) connMessage {
+	return connMessage{uint64(l), fmt.Sprintf(format, args...)}
+}
+
+func (l connLogger) Debugf(format string, args ...interface{}) {
+	connLog.Debug(l.message(format, args...))
+}
+
+func (l connLogger) Infof(format string, args ...interface{}) {
+	connLog.Info(l.message(format, args...))
+}
+
+func (l connLogger) Noticef(format string, args ...interface{}) {
+	connLog.Notice(l.message(format, args...))
+}
+
+func (l connLogger) Warningf(format string, args ...interface{}) {
+	connLog.Warning(l.message(format, args...))
+}
+
+func (l connLogger) Errorf(format string, args ...interface{}) {
+	connLog.Error(l.message(format, args...))
+}
+
+// structuredFormatter formats records as JSON or logfmt
+type structuredFormatter struct {
+	json bool
+}
+
+func (f structuredFormatter) Format(calldepth int, r *logging.Record, output io.Writer) error {
+	// field order matters for logfmt, so keep names and values side by side
+	names := []string{"time", "level", "module", "func"}
+	values := []interface{}{r.Time.Format(time.RFC3339Nano), strings.ToLower(r.Level.String()), r.Module, callerName(calldepth + 1)}
+
+	message := ""
+	if len(r.Args) == 1 {
+		if m, ok := r.Args[0].(connMessage); ok {
+			names = append(names, "connId")
+			values = append(values, m.connID)
+			message = m.text
+		}
+	}
+	if len(names) == 4 {
+		message = r.Message()
+	}
+	names = append(names, "msg")
+	values = append(values, message)
+
+	if f.json {
+		fields := map[string]interface{}{}
+		for i, name := range names {
+			fields[name] = values[i]
+		}
+		line, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		_, err = output.Write(line)
+		return err
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + logfmtValue(fmt.Sprint(values[i]))
+	}
+	_, err := io.WriteString(output, strings.Join(pairs, " "))
+	return err
+}
+
+// logfmtValue quotes a value if it contains spaces, quotes or '='
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// callerName returns the short name of the function that logged a record
+func callerName(calldepth int) string {
+	pc, _, _, ok := runtime.Caller(calldepth + 1)
+	if !ok {
+		return "???"
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "???"
+	}
+	name := f.Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// newLogFormatter returns the formatter for the logFormat option
+func newLogFormatter(logFormat string, color bool) (logging.Formatter, error) {
+	switch logFormat {
+	case "", "text":
+		if color {
+			return logging.MustStringFormatter(textLogFormat), nil
+		}
+		return logging.MustStringFormatter(textNoColorLogFormat), nil
+	case "json":
+		return structuredFormatter{json: true}, nil
+	case "logfmt":
+		return structuredFormatter{json: false}, nil
+	}
+	return nil, fmt.Errorf("Unknown logFormat '%s': please use one of 'text', 'json' or 'logfmt'", logFormat)
+}
+
+// newSyslogLogFormatter returns the formatter of remote syslog messages: the
+// formatter of the logFormat option, but for the text format, which leaves
+// the time to the syslog header
+func newSyslogLogFormatter(logFormat string, formatter logging.Formatter) logging.Formatter {
+	if len(logFormat) == 0 || logFormat == "text" {
+		return logging.MustStringFormatter(textSyslogLogFormat)
+	}
+	return formatter
+}
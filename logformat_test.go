@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// formatLog formats a message of connection connID, 0 for none
+func formatLog(formatter logging.Formatter, connID uint64, message string) string {
+	out := &bytes.Buffer{}
+	logger := logging.MustGetLogger("logtest")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(logging.NewLogBackend(out, "", 0), formatter)))
+	if connID > 0 {
+		logger.Warning(connMessage{connID, message})
+	} else {
+		logger.Warning(message)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func TestLogFormats(t *testing.T) {
+	tests := []struct {
+		format  string
+		syslog  bool
+		connID  uint64
+		message string
+		want    string // a regular expression
+	}{
+		{"", false, 0, "started", `^\d\d:\d\d:\d\d\.\d{6} formatLog ▶ WARN [0-9a-f]{3} started$`},
+		{"text", false, 7, "Bind request", `^\d\d:\d\d:\d\d\.\d{6} formatLog ▶ WARN [0-9a-f]{3} \[conn 7\] Bind request$`},
+		{"text", true, 7, "Bind request", `^formatLog ▶ WARN [0-9a-f]{3} \[conn 7\] Bind request$`},
+		{"logfmt", false, 0, "started", `^time=\S+ level=warning module=logtest func=formatLog msg=started$`},
+		{"logfmt", false, 7, "a=b c", `^time=\S+ level=warning module=logtest func=formatLog connId=7 msg="a=b c"$`},
+		{"logfmt", true, 7, "done", `^time=\S+ level=warning module=logtest func=formatLog connId=7 msg=done$`},
+	}
+	for _, test := range tests {
+		formatter, err := newLogFormatter(test.format, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.syslog {
+			formatter = newSyslogLogFormatter(test.format, formatter)
+		}
+		if line := formatLog(formatter, test.connID, test.message); !regexp.MustCompile(test.want).MatchString(line) {
+			t.Errorf("%s (syslog %v): %q, want %s", test.format, test.syslog, line, test.want)
+		}
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	formatter, err := newLogFormatter("json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(formatLog(formatter, 7, "Bind request")), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]interface{}{"level": "warning", "module": "logtest", "func": "formatLog", "connId": 7.0, "msg": "Bind request"} {
+		if fields[name] != want {
+			t.Errorf("%s: %v, want %v", name, fields[name], want)
+		}
+	}
+}
+
+func TestLoadLogConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		syslog configRemoteSyslog
+		err    string
+	}{
+		{"defaults", "logFormat = \"json\"\n" + testConfigHeader + "[remoteSyslog]\n  enabled = true\n  address = \"syslog:514\"\n", configRemoteSyslog{Enabled: true, Network: "udp", Address: "syslog:514", Facility: "daemon"}, ""},
+		{"TLS", testConfigHeader + "[remoteSyslog]\n  enabled = true\n  network = \"tls\"\n  address = \"syslog:6514\"\n  facility = \"auth\"\n", configRemoteSyslog{Enabled: true, Network: "tls", Address: "syslog:6514", Facility: "auth"}, ""},
+		{"unknown format", "logFormat = \"xml\"\n" + testConfigHeader, configRemoteSyslog{}, "Unknown logFormat 'xml'"},
+		{"no address", testConfigHeader + "[remoteSyslog]\n  enabled = true\n", configRemoteSyslog{}, "No remote syslog address was specified"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfigFiles(t, []string{"config.toml"}, test.config), "")
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.RemoteSyslog != test.syslog {
+				t.Errorf("remoteSyslog %+v, want %+v", cfg.RemoteSyslog, test.syslog)
+			}
+		})
+	}
+}
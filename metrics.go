@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/metala/ldap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Bind outcomes, used as the "outcome" label of metricBindAttempts
+const (
+	bindOutcomeSuccess           = "success"
+	bindOutcomeAppPassword       = "app_password"
+	bindOutcomeAppPasswordDenied = "app_password_denied"
+	bindOutcomeBadPassword       = "bad_password"
+	bindOutcomeBadOTP            = "bad_otp"
+	bindOutcomeOTPRequired       = "otp_required"
+	bindOutcomePolicy            = "policy_denied"
+	bindOutcomePasswordExpired   = "password_expired"
+	bindOutcomeAccountInactive   = "account_inactive"
+	bindOutcomeAccountDisabled   = "account_disabled"
+	bindOutcomeUnknownUser       = "unknown_user"
+)
+
+// Outcomes of Add, Modify, Delete and ModifyDN requests in the audit stream
+const (
+	writeOutcomeSuccess  = "success"
+	writeOutcomeDenied   = "denied"
+	writeOutcomeRejected = "rejected"
+	writeOutcomeFailed   = "failed"
+)
+
+var (
+	metricBindAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: programName,
+		Name:      "bind_attempts_total",
+		Help:      "Bind requests by outcome.",
+	}, []string{"outcome"})
+	metricBindDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: programName,
+		Name:      "bind_duration_seconds",
+		Help:      "Time spent handling bind requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricSearches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: programName,
+		Name:      "search_requests_total",
+		Help:      "Search requests by filter objectClass and result code.",
+	}, []string{"object_class", "result_code"})
+	metricSearchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: programName,
+		Name:      "search_duration_seconds",
+		Help:      "Time spent handling search requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: programName,
+		Name:      "write_requests_total",
+		Help:      "Add, modify, delete and modifydn requests by operation and result code.",
+	}, []string{"operation", "result_code"})
+	metricCompares = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: programName,
+		Name:      "compare_requests_total",
+		Help:      "Compare requests by result code.",
+	}, []string{"result_code"})
+	metricOpenConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: programName,
+		Name:      "open_connections",
+		Help:      "Currently open client connections by listener.",
+	}, []string{"listener"})
+	metricSessionsEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: programName,
+		Name:      "sessions_ended_total",
+		Help:      "Ended client sessions by reason.",
+	}, []string{"reason"})
+	metricConfigReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: programName,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	metricConfigReloadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: programName,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+	metricCertificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: programName,
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the TLS certificate served by a listener.",
+	}, []string{"listener"})
+)
+
+// observeConfigReload records the outcome of a config (re)load
+func observeConfigReload(ok bool) {
+	health.setConfigLoaded(ok)
+	if ok {
+		metricConfigReloadSuccess.Set(1)
+		metricConfigReloadTime.SetToCurrentTime()
+	} else {
+		metricConfigReloadSuccess.Set(0)
+	}
+}
+
+// observeCertificateExpiry records the expiry of the certificate of a listener
+func observeCertificateExpiry(listener string, tlsConfig *tls.Config) {
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+		return
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		log.Warningf("Unable to parse certificate of listener '%s': %s", listener, err.Error())
+		health.setCertError(listener, err)
+		return
+	}
+	metricCertificateExpiry.WithLabelValues(listener).Set(float64(cert.NotAfter.Unix()))
+	health.setCertExpiry(listener, cert.NotAfter)
+}
+
+// countBind records the outcome of a bind request
+func countBind(outcome string) {
+	metricBindAttempts.WithLabelValues(outcome).Inc()
+}
+
+// observeBindDuration records the time spent handling a bind request
+func observeBindDuration(start time.Time) {
+	metricBindDuration.Observe(time.Since(start).Seconds())
+}
+
+// observeSearch records a search request, its objectClass and result. The
+// objectClass comes from the client, so only those that Search serves are
+// kept apart, to bound the number of series.
+func observeSearch(objectClass string, resultCode ldap.LDAPResultCode, start time.Time) {
+	metricSearches.WithLabelValues(searchObjectClassLabel(objectClass), ldap.LDAPResultCodeMap[resultCode]).Inc()
+	metricSearchDuration.Observe(time.Since(start).Seconds())
+}
+
+// searchObjectClassLabel returns the object_class label of the lower-case
+// filter objectClass of a search: "*" for any objectClass, "other" for one
+// that Search doesn't serve
+func searchObjectClassLabel(objectClass string) string {
+	switch objectClass {
+	case "posixaccount", "inetorgperson", "person", "posixgroup", "groupofnames":
+		return objectClass
+	case "":
+		return "*"
+	}
+	return "other"
+}
+
+// observeWrite records an Add, Modify, Delete or ModifyDN request
+func observeWrite(operation string, resultCode ldap.LDAPResultCode) {
+	metricWrites.WithLabelValues(operation, ldap.LDAPResultCodeMap[resultCode]).Inc()
+}
+
+// observeCompare records a compare request
+func observeCompare(resultCode ldap.LDAPResultCode) {
+	metricCompares.WithLabelValues(ldap.LDAPResultCodeMap[resultCode]).Inc()
+}
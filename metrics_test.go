@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/metala/ldap"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSearchObjectClassLabel(t *testing.T) {
+	h := newTestHandler(&config{Users: []configUser{{CommonName: "alice", UserPassword: testPasswordHash}}})
+	tests := []struct {
+		filter string
+		label  string
+		result string
+	}{
+		{"(objectClass=posixAccount)", "posixaccount", "Success"},
+		{"(&(objectClass=posixGroup)(cn=staff))", "posixgroup", "Success"},
+		{"(cn=alice)", "*", "Success"},
+		{"(objectClass=inetOrgPerson)", "inetorgperson", "Success"},
+		{"(objectClass=person)", "person", "Success"},
+		{"(&(objectClass=groupOfNames)(member=*))", "groupofnames", "Success"},
+		{"(objectClass=random1234)", "other", "Operations Error"},
+		{"(objectClass=", "other", "Operations Error"},
+	}
+	for _, test := range tests {
+		counter := metricSearches.WithLabelValues(test.label, test.result)
+		before := testutil.ToFloat64(counter)
+		h.Search(userDN("alice"), ldap.SearchRequest{BaseDN: testBaseDN, Scope: ldap.ScopeWholeSubtree, Filter: test.filter}, newTestConn(t))
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("%s: counted %v searches as %s/%s, want 1", test.filter, after-before, test.label, test.result)
+		}
+	}
+}
+
+func TestSearchMetrics(t *testing.T) {
+	h := newTestHandler(&config{
+		Users:  []configUser{{CommonName: "alice", UserPassword: testPasswordHash}},
+		Groups: []configGroup{{CommonName: "staff"}},
+	})
+	l, err := ldap.Dial("tcp", startTestServer(t, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Bind(userDN("alice"), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter  string
+		label   string
+		result  string
+		entries int
+	}{
+		{"(objectClass=inetOrgPerson)", "inetorgperson", "Success", 1},
+		{"(objectClass=groupOfNames)", "groupofnames", "Success", 1},
+		{"(objectClass=*)", "*", "Success", 2},
+		{"(objectClass=device)", "other", "Operations Error", 0},
+	}
+	for _, test := range tests {
+		counter := metricSearches.WithLabelValues(test.label, test.result)
+		before := testutil.ToFloat64(counter)
+		result, err := l.Search(ldap.NewSearchRequest(testBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, test.filter, []string{"cn"}, nil))
+		if test.entries > 0 && (err != nil || len(result.Entries) != test.entries) {
+			t.Errorf("%s: %v %v, want %d entries", test.filter, result, err, test.entries)
+		}
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("%s: counted %v searches as %s/%s, want 1", test.filter, after-before, test.label, test.result)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp/hotp"
+)
+
+// Default of otp.hotpWindow
+const defaultHOTPWindow = 10
+
+// Values of otp.mode and otp.position
+const (
+	otpModePassword   = "password"
+	otpModeChallenge  = "challenge"
+	otpPositionSuffix = "suffix"
+	otpPositionPrefix = "prefix"
+)
+
+// How long a challenge waits for the bind with the OTP
+const otpChallengeTimeout = 2 * time.Minute
+
+// A recovery code is two groups of 5 characters, e.g. "k3m9p-x2hqa", from an
+// alphabet without look-alike characters
+const (
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryCodeLength   = 11
+)
+
+// otpState is what the state file keeps between binds
+type otpState struct {
+	// the next HOTP counter, by user and device
+	HOTPCounters map[string]map[string]uint64 `json:"hotpCounters"`
+	// the hashes of the recovery codes used, by user
+	UsedRecoveryCodes map[string][]string `json:"usedRecoveryCodes"`
+	// when app passwords were last used, by user and name
+	AppPasswordsUsed map[string]map[string]time.Time `json:"appPasswordsUsed"`
+	// the grace logins used since the password expired, by user
+	GraceLogins map[string]graceLogins `json:"graceLogins"`
+}
+
+// graceLogins counts the binds with an expired password; expires tells a
+// password from the next one
+type graceLogins struct {
+	Expires time.Time `json:"expires"`
+	Used    int       `json:"used"`
+}
+
+// otpStateStore keeps the HOTP counters, used recovery codes, the last use
+// of the app passwords and the grace logins of all users.
+// Like the Yubikey counters, a change is saved before a bind may succeed, so
+// no code can be used twice, even after a restart.
+type otpStateStore struct {
+	mu     sync.Mutex
+	file   string
+	window uint64
+	state  otpState
+	// when app password uses were last saved
+	usesSaved time.Time
+}
+
+var otpStates = &otpStateStore{}
+
+// validateOTPConfig checks the [otp] settings against the users of the
+// config file
+func validateOTPConfig(cfg *config) error {
+	if cfg.OTP.HOTPWindow < 0 {
+		return fmt.Errorf("Invalid otp.hotpWindow %d", cfg.OTP.HOTPWindow)
+	}
+	switch cfg.OTP.Mode {
+	case "":
+		cfg.OTP.Mode = otpModePassword
+	case otpModePassword, otpModeChallenge:
+	default:
+		return fmt.Errorf("Invalid otp.mode '%s': expected '%s' or '%s'", cfg.OTP.Mode, otpModePassword, otpModeChallenge)
+	}
+	switch cfg.OTP.Position {
+	case "":
+		cfg.OTP.Position = otpPositionSuffix
+	case otpPositionSuffix, otpPositionPrefix:
+	default:
+		return fmt.Errorf("Invalid otp.position '%s': expected '%s' or '%s'", cfg.OTP.Position, otpPositionSuffix, otpPositionPrefix)
+	}
+	if len(cfg.OTP.ChallengeDN) == 0 {
+		cfg.OTP.ChallengeDN = "cn=otp," + cfg.Backend.BaseDN
+	}
+	cfg.OTP.ChallengeDN = strings.ToLower(cfg.OTP.ChallengeDN)
+	if err := validateDN(cfg.OTP.ChallengeDN); err != nil && cfg.OTP.Mode == otpModeChallenge {
+		return fmt.Errorf("Invalid otp.challengeDN '%s': %s", cfg.OTP.ChallengeDN, err.Error())
+	}
+	if len(cfg.OTP.StateFile) == 0 {
+		for _, u := range cfg.Users {
+			if len(u.HOTPSecrets) > 0 || len(u.RecoveryCodes) > 0 {
+				return fmt.Errorf("User '%s' has HOTP secrets or recovery codes, which require an otp.stateFile", u.CommonName)
+			}
+		}
+	}
+	return nil
+}
+
+// configure applies the [otp] settings of a (re)loaded config. The state is
+// read when the file changes.
+func (s *otpStateStore) configure(otpConfig *configOTP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window = defaultHOTPWindow
+	if otpConfig.HOTPWindow > 0 {
+		s.window = uint64(otpConfig.HOTPWindow)
+	}
+	if otpConfig.StateFile == s.file {
+		return nil
+	}
+	state := otpState{
+		HOTPCounters:      map[string]map[string]uint64{},
+		UsedRecoveryCodes: map[string][]string{},
+		AppPasswordsUsed:  map[string]map[string]time.Time{},
+		GraceLogins:       map[string]graceLogins{},
+	}
+	if len(otpConfig.StateFile) > 0 {
+		data, err := ioutil.ReadFile(otpConfig.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("Invalid OTP state file %s: %s", otpConfig.StateFile, err.Error())
+			}
+		}
+	}
+	s.file, s.state = otpConfig.StateFile, state
+	return nil
+}
+
+// verifyHOTP checks code against the HOTP devices of a user, each from its
+// counter up to the window ahead, and moves the counter past the code. It
+// returns the name of the device the code is from, if any; a code from a
+// disabled device is refused and leaves its counter alone.
+func (s *otpStateStore) verifyHOTP(user string, devices []configUserOTPSecret, code string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.file) == 0 {
+		return "", false, fmt.Errorf("otp.stateFile is not set")
+	}
+	counters := s.state.HOTPCounters[user]
+	for _, disabled := range []bool{false, true} {
+		for _, device := range devices {
+			if device.Disabled != disabled {
+				continue
+			}
+			next := counters[device.Name]
+			for counter := next; counter < next+s.window; counter++ {
+				if !hotp.Validate(code, counter, device.Secret) {
+					continue
+				}
+				if disabled {
+					return device.Name, false, nil
+				}
+				if counters == nil {
+					counters = map[string]uint64{}
+					s.state.HOTPCounters[user] = counters
+				}
+				counters[device.Name] = counter + 1
+				if err := s.save(); err != nil {
+					counters[device.Name] = next
+					return device.Name, false, fmt.Errorf("unable to save OTP state: %s", err.Error())
+				}
+				return device.Name, true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// findRecoveryCode returns the hash of an unused recovery code of a user
+// that matches code
+func (s *otpStateStore) findRecoveryCode(user string, hashes []string, code string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := s.state.UsedRecoveryCodes[user]
+	for _, hash := range hashes {
+		if findIndex(used, hash) != -1 {
+			continue
+		}
+		if ok, _ := checkPassword(hash, strings.ToLower(code)); ok {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+// useRecoveryCode marks a recovery code found by findRecoveryCode as used,
+// and returns how many codes the user has left. It fails if a concurrent
+// bind used the code first.
+func (s *otpStateStore) useRecoveryCode(user string, hashes []string, hash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.file) == 0 {
+		return 0, fmt.Errorf("otp.stateFile is not set")
+	}
+	previous := s.state.UsedRecoveryCodes[user]
+	if findIndex(previous, hash) != -1 {
+		return 0, fmt.Errorf("recovery code was already used")
+	}
+	// forget codes that were replaced since
+	used := []string{}
+	for _, h := range previous {
+		if findIndex(hashes, h) != -1 {
+			used = append(used, h)
+		}
+	}
+	s.state.UsedRecoveryCodes[user] = append(used, hash)
+	if err := s.save(); err != nil {
+		s.state.UsedRecoveryCodes[user] = previous
+		return 0, fmt.Errorf("unable to save OTP state: %s", err.Error())
+	}
+	return len(hashes) - len(used) - 1, nil
+}
+
+// appPasswordUsed records the use of an app password. Uses are saved at most
+// every appPasswordUseInterval, if there is a state file.
+func (s *otpStateStore) appPasswordUsed(user, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.AppPasswordsUsed == nil {
+		// without a state file, uses are kept in memory only
+		s.state.AppPasswordsUsed = map[string]map[string]time.Time{}
+	}
+	uses := s.state.AppPasswordsUsed[user]
+	if uses == nil {
+		uses = map[string]time.Time{}
+		s.state.AppPasswordsUsed[user] = uses
+	}
+	now := time.Now().UTC().Round(time.Second)
+	uses[name] = now
+	if len(s.file) == 0 || now.Sub(s.usesSaved) < appPasswordUseInterval {
+		return nil
+	}
+	s.usesSaved = now
+	return s.save()
+}
+
+// appPasswordLastUsed returns when an app password was last used, the zero
+// time if it never was
+func (s *otpStateStore) appPasswordLastUsed(user, name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.AppPasswordsUsed[user][name]
+}
+
+// graceLoginsLeft returns how many of allowed grace logins a user has left
+// with the password that expired at expires
+func (s *otpStateStore) graceLoginsLeft(user string, expires time.Time, allowed int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grace, ok := s.state.GraceLogins[user]
+	if !ok || !grace.Expires.Equal(expires) {
+		return allowed
+	}
+	return allowed - grace.Used
+}
+
+// useGraceLogin counts a bind with the expired password of a user, and
+// returns how many grace logins are left. It fails when none is.
+func (s *otpStateStore) useGraceLogin(user string, expires time.Time, allowed int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.GraceLogins == nil {
+		// without a state file, grace logins are counted in memory only
+		s.state.GraceLogins = map[string]graceLogins{}
+	}
+	previous, ok := s.state.GraceLogins[user]
+	grace := previous
+	if !ok || !grace.Expires.Equal(expires) {
+		grace = graceLogins{Expires: expires}
+	}
+	if grace.Used >= allowed {
+		return 0, fmt.Errorf("no grace login left")
+	}
+	grace.Used++
+	s.state.GraceLogins[user] = grace
+	if len(s.file) == 0 {
+		return allowed - grace.Used, nil
+	}
+	if err := s.save(); err != nil {
+		if ok {
+			s.state.GraceLogins[user] = previous
+		} else {
+			delete(s.state.GraceLogins, user)
+		}
+		return 0, fmt.Errorf("unable to save OTP state: %s", err.Error())
+	}
+	return allowed - grace.Used, nil
+}
+
+func (s *otpStateStore) save() error {
+	return saveJSONFile(s.file, s.state)
+}
+
+// saveJSONFile writes v to a file readable only by us, replacing it
+// atomically
+func saveJSONFile(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// otpSplitter takes an OTP of n characters from a bind password, and returns
+// the password without it
+type otpSplitter func(password string, n int) (rest, otp string, ok bool)
+
+// exactOTP takes a bind password that is an OTP alone
+func exactOTP(password string, n int) (string, string, bool) {
+	return "", password, len(password) == n
+}
+
+// newOTPSplitter takes the OTP where otp.position and otp.separator put it:
+// at the end of the password by default. The password can't be empty.
+func newOTPSplitter(otpConfig *configOTP) otpSplitter {
+	separator := otpConfig.Separator
+	if otpConfig.Position == otpPositionPrefix {
+		return func(password string, n int) (string, string, bool) {
+			if len(password) <= n+len(separator) || !strings.HasPrefix(password[n:], separator) {
+				return password, "", false
+			}
+			return password[n+len(separator):], password[:n], true
+		}
+	}
+	return func(password string, n int) (string, string, bool) {
+		if len(password) <= n+len(separator) || !strings.HasSuffix(password[:len(password)-n], separator) {
+			return password, "", false
+		}
+		return password[:len(password)-n-len(separator)], password[len(password)-n:], true
+	}
+}
+
+// isRecoveryCode reports whether s looks like a recovery code
+func isRecoveryCode(s string) bool {
+	if len(s) != recoveryCodeLength || s[5] != '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if i != 5 && strings.IndexByte(recoveryCodeAlphabet, s[i]|0x20) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// newRecoveryCode returns a random recovery code
+func newRecoveryCode() (string, error) {
+	return randomCode(2, 5)
+}
+
+// randomCode returns groups of random characters of the recovery code
+// alphabet, separated by dashes
+func randomCode(groups, size int) (string, error) {
+	code := make([]byte, 0, groups*(size+1))
+	max := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for len(code) < groups*(size+1)-1 {
+		if len(code)%(size+1) == size {
+			code = append(code, '-')
+			continue
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, recoveryCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// generateOTP runs the generate-otp command, which prints a new HOTP secret
+// or a set of recovery codes, with the settings to add to a user
+func generateOTP(args map[string]interface{}) error {
+	if args["hotp"].(bool) {
+		user, _ := args["--user"].(string)
+		if len(user) == 0 {
+			user = "user"
+		}
+		name := args["--name"].(string)
+		key, err := hotp.Generate(hotp.GenerateOpts{Issuer: programName, AccountName: user, SecretSize: 20})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Secret: %s\n", key.Secret())
+		fmt.Printf("URI:    %s&counter=0\n\n", key.URL())
+		fmt.Printf("Add to the user:\n  [[users.hotpSecrets]]\n    name = %s\n    secret = %s\n", tomlString(name), tomlString(key.Secret()))
+		return nil
+	}
+
+	count, err := strconv.Atoi(args["--count"].(string))
+	if err != nil || count < 1 {
+		return fmt.Errorf("Invalid --count '%s'", args["--count"].(string))
+	}
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < count; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return err
+		}
+		hash, err := hashUserPassword(code)
+		if err != nil {
+			return err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, tomlString(hash))
+	}
+	fmt.Printf("Recovery codes, each valid once; give them to the user:\n  %s\n\n", strings.Join(codes, "\n  "))
+	fmt.Printf("Add to the user, replacing any previous codes:\n  recoveryCodes = [%s]\n", strings.Join(hashes, ", "))
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metala/ldap"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+// useOTPStateFile keeps the OTP state in a temporary file until the test
+// ends, and returns its path
+func useOTPStateFile(t *testing.T) string {
+	stateFile := filepath.Join(t.TempDir(), "otp-state.json")
+	if err := otpStates.configure(&configOTP{StateFile: stateFile}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { otpStates.configure(&configOTP{}) })
+	return stateFile
+}
+
+func TestValidateOTPConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		otp   configOTP
+		users []configUser
+		err   string
+	}{
+		{"defaults", configOTP{}, nil, ""},
+		{"negative HOTP window", configOTP{HOTPWindow: -1}, nil, "Invalid otp.hotpWindow -1"},
+		{"HOTP with a state file", configOTP{StateFile: "otp-state.json"}, []configUser{{CommonName: "alice", HOTPSecrets: []configUserOTPSecret{{Name: "token", Secret: "JBSWY3DPEHPK3PXP"}}}}, ""},
+		{"HOTP without a state file", configOTP{}, []configUser{{CommonName: "alice", HOTPSecrets: []configUserOTPSecret{{Name: "token", Secret: "JBSWY3DPEHPK3PXP"}}}}, "User 'alice' has HOTP secrets or recovery codes, which require an otp.stateFile"},
+		{"recovery codes without a state file", configOTP{}, []configUser{{CommonName: "bob", RecoveryCodes: []string{testPasswordHash}}}, "User 'bob' has HOTP secrets or recovery codes"},
+		{"challenge mode", configOTP{Mode: otpModeChallenge, Position: otpPositionPrefix, Separator: "+", ChallengeDN: "cn=OTP,dc=example,dc=com"}, nil, ""},
+		{"unknown mode", configOTP{Mode: "push"}, nil, "Invalid otp.mode 'push'"},
+		{"unknown position", configOTP{Position: "middle"}, nil, "Invalid otp.position 'middle'"},
+		{"invalid challenge DN", configOTP{Mode: otpModeChallenge, ChallengeDN: "otp"}, nil, "Invalid otp.challengeDN 'otp'"},
+		// the challenge DN is only used in challenge mode
+		{"invalid unused challenge DN", configOTP{ChallengeDN: "otp"}, nil, ""},
+	}
+	for _, test := range tests {
+		cfg := &config{Backend: configBackend{BaseDN: testBaseDN}, OTP: test.otp, Users: test.users}
+		err := validateOTPConfig(cfg)
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && err != nil {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// the defaults
+	cfg := &config{Backend: configBackend{BaseDN: "dc=Example,dc=com"}}
+	if err := validateOTPConfig(cfg); err != nil || cfg.OTP.Mode != otpModePassword || cfg.OTP.Position != otpPositionSuffix || cfg.OTP.ChallengeDN != "cn=otp,dc=example,dc=com" {
+		t.Errorf("defaults: %+v %v", cfg.OTP, err)
+	}
+}
+
+func TestOTPSplitter(t *testing.T) {
+	tests := []struct {
+		position  string
+		separator string
+		password  string
+		rest      string
+		otp       string
+	}{
+		{otpPositionSuffix, "", "secret123456", "secret", "123456"},
+		{otpPositionSuffix, "", "123456", "", ""},
+		{otpPositionSuffix, "", "12345", "", ""},
+		{otpPositionSuffix, "+", "secret1+123456", "secret1", "123456"},
+		{otpPositionSuffix, "+", "secret1123456", "", ""},
+		{otpPositionSuffix, "+", "+123456", "", ""},
+		{otpPositionPrefix, "", "123456secret", "secret", "123456"},
+		{otpPositionPrefix, "", "123456", "", ""},
+		{otpPositionPrefix, "::", "123456::secret1", "secret1", "123456"},
+		{otpPositionPrefix, "::", "123456:secret1", "", ""},
+		{otpPositionPrefix, "::", "123456::", "", ""},
+	}
+	for _, test := range tests {
+		split := newOTPSplitter(&configOTP{Position: test.position, Separator: test.separator})
+		rest, otp, ok := split(test.password, 6)
+		if ok != (len(test.otp) > 0) || ok && (rest != test.rest || otp != test.otp) || !ok && rest != test.password {
+			t.Errorf("%s %q %q: %q %q %v, want %q %q", test.position, test.separator, test.password, rest, otp, ok, test.rest, test.otp)
+		}
+	}
+}
+
+func TestBindOTPPosition(t *testing.T) {
+	const otpSecret = "JBSWY3DPEHPK3PXP"
+	audit := captureAudit(t)
+	code, err := totp.GenerateCode(otpSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		position  string
+		separator string
+		password  string
+		outcome   string
+		reason    string
+	}{
+		{otpPositionSuffix, "", "secret" + code, bindOutcomeSuccess, ""},
+		{otpPositionSuffix, "", code + "secret", bindOutcomeBadOTP, "invalid totp OTP"},
+		{otpPositionPrefix, "", code + "secret", bindOutcomeSuccess, ""},
+		{otpPositionSuffix, "/", "secret/" + code, bindOutcomeSuccess, ""},
+		{otpPositionSuffix, "/", "secret" + code, bindOutcomeBadOTP, "OTP missing"},
+		{otpPositionPrefix, "/", code + "/secret", bindOutcomeSuccess, ""},
+		{otpPositionPrefix, "/", code + "/guess", bindOutcomeBadPassword, "invalid password"},
+	}
+	for _, test := range tests {
+		cfg := &config{
+			Backend: configBackend{BaseDN: testBaseDN},
+			OTP:     configOTP{Position: test.position, Separator: test.separator},
+			Users:   []configUser{{CommonName: "alice", UserPassword: testPasswordHash, OTPSecret: otpSecret}},
+		}
+		if err := validateOTPConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		result, rec := bind(t, newTestHandler(cfg), audit, userDN("alice"), test.password, newTestConn(t))
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome || rec.Reason != test.reason {
+			t.Errorf("%s %q %q: %d %+v, want outcome %q reason %q", test.position, test.separator, test.password, result, rec, test.outcome, test.reason)
+		}
+	}
+}
+
+func TestOTPChallenge(t *testing.T) {
+	const otpSecret = "JBSWY3DPEHPK3PXP"
+	audit := captureAudit(t)
+	cfg := &config{
+		Backend: configBackend{BaseDN: testBaseDN},
+		OTP:     configOTP{Mode: otpModeChallenge},
+		Users: []configUser{
+			{CommonName: "alice", UserPassword: testPasswordHash, OTPSecret: otpSecret},
+			{CommonName: "bob", UserPassword: testPasswordHash},
+		},
+	}
+	if err := validateOTPConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, newTestHandler(cfg))
+	code, err := totp.GenerateCode(otpSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeDN := "cn=otp," + testBaseDN
+
+	type step struct {
+		dn       string
+		password string
+		code     ldap.LDAPResultCode
+		outcome  string
+		authzID  string // after the Bind
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"password then OTP", []step{
+			{userDN("alice"), "secret", ldap.LDAPResultInvalidCredentials, bindOutcomeOTPRequired, ""},
+			{challengeDN, code, ldap.LDAPResultSuccess, bindOutcomeSuccess, "dn:" + userDN("alice")},
+		}},
+		{"wrong OTP", []step{
+			{userDN("alice"), "secret", ldap.LDAPResultInvalidCredentials, bindOutcomeOTPRequired, ""},
+			{challengeDN, invalidTOTP(otpSecret), ldap.LDAPResultInvalidCredentials, bindOutcomeBadOTP, ""},
+			// the challenge is over
+			{challengeDN, code, ldap.LDAPResultInvalidCredentials, bindOutcomeUnknownUser, ""},
+		}},
+		// Bind returns the error of a wrong password, which the ldap library
+		// turns into operationsError, as in password mode
+		{"wrong password", []step{
+			{userDN("alice"), "guess", ldap.LDAPResultOperationsError, bindOutcomeBadPassword, ""},
+			{challengeDN, code, ldap.LDAPResultInvalidCredentials, bindOutcomeUnknownUser, ""},
+		}},
+		{"OTP in the password", []step{
+			{userDN("alice"), "secret" + code, ldap.LDAPResultOperationsError, bindOutcomeBadPassword, ""},
+		}},
+		{"user without an OTP", []step{
+			{userDN("bob"), "secret", ldap.LDAPResultSuccess, bindOutcomeSuccess, "dn:" + userDN("bob")},
+		}},
+	}
+	for _, test := range tests {
+		c := dialTestServer(t, addr)
+		for i, step := range test.steps {
+			if result := resultCode(c.bind(step.dn, step.password)); result != step.code {
+				t.Errorf("%s #%d: Bind %d, want %d", test.name, i, result, step.code)
+			}
+			if records := bindRecords(audit()); len(records) != 1 || records[0].Outcome != step.outcome {
+				t.Errorf("%s #%d: audit %+v, want outcome %q", test.name, i, records, step.outcome)
+			}
+			if _, authzID := c.whoAmI(); authzID != step.authzID {
+				t.Errorf("%s #%d: WhoAmI %q, want %q", test.name, i, authzID, step.authzID)
+			}
+		}
+	}
+}
+
+func TestBindHOTP(t *testing.T) {
+	const (
+		tokenSecret = "JBSWY3DPEHPK3PXP"
+		oldSecret   = "KRSXG5CTMVRXEZLU"
+	)
+	stateFile := useOTPStateFile(t)
+	audit := captureAudit(t)
+	h := newTestHandler(&config{Users: []configUser{{
+		CommonName:   "alice",
+		UserPassword: testPasswordHash,
+		HOTPSecrets:  []configUserOTPSecret{{Name: "token", Secret: tokenSecret}, {Name: "old token", Secret: oldSecret, Disabled: true}},
+	}}})
+	code := func(secret string, counter uint64) string {
+		code, err := hotp.GenerateCode(secret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		outcome  string
+		reason   string
+		device   string
+	}{
+		{"first code", "secret" + code(tokenSecret, 0), bindOutcomeSuccess, "", "token"},
+		{"replayed", "secret" + code(tokenSecret, 0), bindOutcomeBadOTP, "invalid hotp OTP", ""},
+		// the counter catches up with codes generated without a bind
+		{"within the window", "secret" + code(tokenSecret, 5), bindOutcomeSuccess, "", "token"},
+		{"skipped by the window", "secret" + code(tokenSecret, 4), bindOutcomeBadOTP, "invalid hotp OTP", ""},
+		{"beyond the window", "secret" + code(tokenSecret, 6+defaultHOTPWindow), bindOutcomeBadOTP, "invalid hotp OTP", ""},
+		{"disabled device", "secret" + code(oldSecret, 0), bindOutcomeBadOTP, "disabled hotp device", "old token"},
+		{"next code", "secret" + code(tokenSecret, 6), bindOutcomeSuccess, "", "token"},
+	}
+	for _, test := range tests {
+		result, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome || rec.Reason != test.reason || rec.Device != test.device {
+			t.Errorf("%s: %d %+v, want outcome %q reason %q device %q", test.name, result, rec, test.outcome, test.reason, test.device)
+		}
+	}
+
+	// the counters survive a restart
+	restarted := &otpStateStore{}
+	if err := restarted.configure(&configOTP{StateFile: stateFile}); err != nil {
+		t.Fatal(err)
+	}
+	if counter := restarted.state.HOTPCounters["alice"]["token"]; counter != 7 {
+		t.Errorf("saved counter %d, want 7", counter)
+	}
+}
+
+func TestBindRecoveryCode(t *testing.T) {
+	stateFile := useOTPStateFile(t)
+	audit := captureAudit(t)
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < 2; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := hashUserPassword(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes, hashes = append(codes, code), append(hashes, hash)
+	}
+	h := newTestHandler(&config{Users: []configUser{{CommonName: "alice", UserPassword: testPasswordHash, RecoveryCodes: hashes}}})
+
+	tests := []struct {
+		name     string
+		password string
+		outcome  string
+		reason   string
+	}{
+		{"recovery code", "secret" + codes[0], bindOutcomeSuccess, ""},
+		{"used twice", "secret" + codes[0], bindOutcomeBadOTP, "invalid recovery_code OTP"},
+		// a code isn't used up by a bind with the wrong password
+		{"wrong password", "guess" + codes[1], bindOutcomeBadPassword, "invalid password"},
+		{"upper case", "secret" + strings.ToUpper(codes[1]), bindOutcomeSuccess, ""},
+		{"not a recovery code", "secret" + "zzzzz-zzzzz", bindOutcomeBadOTP, "invalid recovery_code OTP"},
+		{"OTP missing", "secret", bindOutcomeBadOTP, "OTP missing"},
+	}
+	for _, test := range tests {
+		result, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		factors := ""
+		if test.outcome == bindOutcomeSuccess {
+			factors = "password,recovery_code"
+		}
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome || rec.Reason != test.reason || strings.Join(rec.Factors, ",") != factors {
+			t.Errorf("%s: %d %+v, want outcome %q reason %q", test.name, result, rec, test.outcome, test.reason)
+		}
+	}
+
+	restarted := &otpStateStore{}
+	if err := restarted.configure(&configOTP{StateFile: stateFile}); err != nil {
+		t.Fatal(err)
+	}
+	if used := restarted.state.UsedRecoveryCodes["alice"]; strings.Join(used, ",") != strings.Join(hashes, ",") {
+		t.Errorf("saved used codes %v, want %v", used, hashes)
+	}
+}
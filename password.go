@@ -16,16 +16,17 @@ func hashPasswordSalt(hasher hash.Hash, password, salt []byte) []byte {
 	return hasher.Sum(nil)
 }
 
-func checkPassword(userPassword, password string) (bool, error) {
-	if !strings.HasPrefix(userPassword, "{") {
-		return false, fmt.Errorf("Incorrect format")
+// parsePassword splits a "{SCHEME}base64(hash+salt)" userPassword value
+func parsePassword(userPassword string) (hash.Hash, []byte, []byte, error) {
+	if !strings.HasPrefix(userPassword, "{") || !strings.Contains(userPassword, "}") {
+		return nil, nil, nil, fmt.Errorf("Incorrect format")
 	}
 
 	parts := strings.SplitN(userPassword[1:], "}", 2)
 	scheme, b64hashsalt := parts[0], parts[1]
 	hashsalt, err := base64.StdEncoding.DecodeString(b64hashsalt)
 	if err != nil {
-		return false, fmt.Errorf("Unable to decode base64-encoded password")
+		return nil, nil, nil, fmt.Errorf("Unable to decode base64-encoded password")
 	}
 
 	var hasher hash.Hash
@@ -34,10 +35,21 @@ func checkPassword(userPassword, password string) (bool, error) {
 	} else if scheme == "SSHA" {
 		hasher = sha1.New()
 	} else {
-		return false, fmt.Errorf("Unsupported encoding '%s'", scheme)
+		return nil, nil, nil, fmt.Errorf("Unsupported encoding '%s'", scheme)
+	}
+
+	if len(hashsalt) < hasher.Size() {
+		return nil, nil, nil, fmt.Errorf("Password hash is too short for '%s'", scheme)
+	}
+	return hasher, hashsalt[0:hasher.Size()], hashsalt[hasher.Size():], nil
+}
+
+func checkPassword(userPassword, password string) (bool, error) {
+	hasher, passwordHash, salt, err := parsePassword(userPassword)
+	if err != nil {
+		return false, err
 	}
 
-	passwordHash, salt := hashsalt[0:hasher.Size()], hashsalt[hasher.Size():]
 	res := hashPasswordSalt(hasher, []byte(password), salt)
 	if !bytes.Equal(res, passwordHash) {
 		return false, fmt.Errorf("Invalid password")
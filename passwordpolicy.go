@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+// The Password Policy control (draft-behera-ldap-password-policy): a client
+// sends it with a Bind to be told in the response when its password expires,
+// how many grace logins it has left, or why it was refused.
+const oidPasswordPolicy = "1.3.6.1.4.1.42.2.27.8.5.1"
+
+// The warnings and errors of the Password Policy response control
+const (
+	ppolicyNone = -1
+	// warnings
+	ppolicyTimeBeforeExpiration = 0
+	ppolicyGraceAuthNsRemaining = 1
+	// errors
+	ppolicyPasswordExpired  = 0
+	ppolicyChangeAfterReset = 2
+)
+
+// The character classes counted by passwordPolicy.complexity
+var passwordClasses = []func(r rune) bool{
+	unicode.IsLower,
+	unicode.IsUpper,
+	unicode.IsDigit,
+	func(r rune) bool { return !unicode.IsLower(r) && !unicode.IsUpper(r) && !unicode.IsDigit(r) },
+}
+
+// ppolicyResponse is the value of the Password Policy response control of a
+// Bind
+type ppolicyResponse struct {
+	warning      int // ppolicyNone or the kind of warning
+	warningValue int // seconds before expiration, or grace logins remaining
+	err          int // ppolicyNone or the error
+}
+
+// control returns the response control
+func (r ppolicyResponse) control() *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "PasswordPolicyResponseValue")
+	if r.warning != ppolicyNone {
+		warning := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Warning")
+		warning.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, ber.Tag(r.warning), int64(r.warningValue), "Warning Value"))
+		value.AppendChild(warning)
+	}
+	if r.err != ppolicyNone {
+		value.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, int64(r.err), "Error"))
+	}
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, oidPasswordPolicy, "Control Type"))
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), "Control Value"))
+	return control
+}
+
+// validatePasswordPolicy checks the [passwordPolicy] settings
+func validatePasswordPolicy(cfg *config) error {
+	policy := &cfg.PasswordPolicy
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"maxAgeDays", policy.MaxAgeDays},
+		{"expireWarningDays", policy.ExpireWarningDays},
+		{"graceLogins", policy.GraceLogins},
+		{"minLength", policy.MinLength},
+		{"history", policy.History},
+	} {
+		if setting.value < 0 {
+			return fmt.Errorf("Invalid passwordPolicy.%s %d", setting.name, setting.value)
+		}
+	}
+	if policy.Complexity < 0 || policy.Complexity > len(passwordClasses) {
+		return fmt.Errorf("Invalid passwordPolicy.complexity %d: expected 0 to %d character classes", policy.Complexity, len(passwordClasses))
+	}
+	return nil
+}
+
+// checkPasswordPolicy checks the password settings of a user for checkConfig,
+// reporting each problem with the setting it is about
+func checkPasswordPolicy(u *configUser, problem func(key, format string, args ...interface{})) {
+	for _, setting := range []struct{ name, value string }{{"pwdChangedTime", u.PwdChangedTime}, {"passwordExpires", u.PasswordExpires}} {
+		if _, err := parseConfigTime(setting.value); err != nil && len(setting.value) > 0 {
+			problem(setting.name, "user '%s': invalid %s '%s': please use RFC 3339 or YYYY-MM-DD", u.CommonName, setting.name, setting.value)
+		}
+	}
+	for j, hash := range u.PasswordHistory {
+		if _, _, _, err := parsePassword(hash); err != nil {
+			problem("passwordHistory", "user '%s': invalid passwordHistory #%d: %s", u.CommonName, j, err.Error())
+		}
+	}
+}
+
+// passwordExpiry returns when the password of a user expires, if it does:
+// at passwordExpires, or passwordPolicy.maxAgeDays after pwdChangedTime.
+// Passwords without a pwdChangedTime don't age.
+func (u configUser) passwordExpiry(policy *configPasswordPolicy) (time.Time, bool) {
+	if len(u.PasswordExpires) > 0 {
+		// an invalid date expires the password
+		expires, _ := parseConfigTime(u.PasswordExpires)
+		return expires, true
+	}
+	if policy.MaxAgeDays == 0 || len(u.PwdChangedTime) == 0 {
+		return time.Time{}, false
+	}
+	changed, err := parseConfigTime(u.PwdChangedTime)
+	if err != nil {
+		return time.Time{}, true
+	}
+	return changed.AddDate(0, 0, policy.MaxAgeDays), true
+}
+
+// checkPasswordAge checks that the password a user bound with hasn't expired,
+// once it was found right. An expired password is accepted for
+// passwordPolicy.graceLogins binds, which are counted when the bind is done,
+// and the user must change it. The response of the Password Policy control
+// is recorded in the session.
+func (h configHandler) checkPasswordAge(user *configUser, rec *auditRecord, bindDN string, conn net.Conn, done bool) (ldap.LDAPResultCode, bool) {
+	clog := newConnLogger(conn)
+	policy := &h.cfg.PasswordPolicy
+	response := ppolicyResponse{warning: ppolicyNone, err: ppolicyNone}
+	mustChange := user.PasswordMustChange
+	if mustChange {
+		response.err = ppolicyChangeAfterReset
+	}
+
+	now := time.Now()
+	expires, ok := user.passwordExpiry(policy)
+	switch {
+	case ok && !now.Before(expires):
+		left := otpStates.graceLoginsLeft(user.CommonName, expires, policy.GraceLogins)
+		granted := left > 0
+		if granted && done {
+			var err error
+			if left, err = otpStates.useGraceLogin(user.CommonName, expires, policy.GraceLogins); err != nil {
+				clog.Warningf("Grace login error: '%s' for '%s' from '%s'", err.Error(), bindDN, conn.RemoteAddr().String())
+				granted = false
+			}
+		}
+		if !granted {
+			clog.Warningf("Bind Error: password of '%s' expired on %s", bindDN, expires.Format(time.RFC3339))
+			rec.fail(bindOutcomePasswordExpired, "password expired")
+			sessionPasswordPolicy(conn, ppolicyResponse{warning: ppolicyNone, err: ppolicyPasswordExpired}, false)
+			return ldap.LDAPResultInvalidCredentials, false
+		}
+		clog.Noticef("Grace login with the expired password of '%s', %d left", bindDN, left)
+		response.warning, response.warningValue = ppolicyGraceAuthNsRemaining, left
+		mustChange = true
+	case ok && expires.Sub(now) < time.Duration(policy.ExpireWarningDays)*24*time.Hour:
+		clog.Infof("Password of '%s' expires on %s", bindDN, expires.Format(time.RFC3339))
+		response.warning, response.warningValue = ppolicyTimeBeforeExpiration, int(expires.Sub(now).Seconds())
+	}
+	if done {
+		sessionPasswordPolicy(conn, response, mustChange)
+	}
+	return ldap.LDAPResultSuccess, true
+}
+
+// setPassword sets the userPassword of a user through LDAP. A clear-text
+// password must meet the policy; hashed ones are taken as they are. The
+// previous password is kept in the history, and a password set by an admin
+// must be changed at the next bind if the policy says so.
+func (e *directoryEdit) setPassword(u *configUser, value string) error {
+	policy := &e.cfg.PasswordPolicy
+	if len(value) > 0 && !strings.HasPrefix(value, "{") {
+		if len([]rune(value)) < policy.MinLength {
+			return writeErrorf(ldap.LDAPResultConstraintViolation, "userPassword must be at least %d characters long", policy.MinLength)
+		}
+		classes := 0
+		for _, class := range passwordClasses {
+			if strings.IndexFunc(value, class) != -1 {
+				classes++
+			}
+		}
+		if classes < policy.Complexity {
+			return writeErrorf(ldap.LDAPResultConstraintViolation,
+				"userPassword must have characters of %d of lower case, upper case, digits and others", policy.Complexity)
+		}
+		if policy.History > 0 {
+			for _, previous := range append([]string{u.UserPassword}, u.PasswordHistory...) {
+				if ok, _ := checkPassword(previous, value); ok {
+					return writeErrorf(ldap.LDAPResultConstraintViolation, "userPassword was used before")
+				}
+			}
+		}
+	}
+	hashed, err := hashUserPassword(value)
+	if err != nil || hashed == u.UserPassword {
+		return err
+	}
+	if policy.History > 0 && len(u.UserPassword) > 0 {
+		u.PasswordHistory = append([]string{u.UserPassword}, u.PasswordHistory...)
+	}
+	if len(u.PasswordHistory) > policy.History {
+		u.PasswordHistory = u.PasswordHistory[:policy.History]
+	}
+	u.UserPassword = hashed
+	u.PwdChangedTime = time.Now().UTC().Format(time.RFC3339)
+	u.PasswordExpires = ""
+	u.PasswordMustChange = policy.MustChange && len(value) > 0 && !strings.EqualFold(e.boundUser, u.CommonName)
+	return nil
+}
+
+// epochDays returns the days since 1970-01-01 of t, as shadowAccount
+// attributes count them
+func epochDays(t time.Time) int {
+	return int(t.Unix() / (24 * 60 * 60))
+}
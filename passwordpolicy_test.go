@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metala/ldap"
+)
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy configPasswordPolicy
+		err    string
+	}{
+		{"none", configPasswordPolicy{}, ""},
+		{"policy", configPasswordPolicy{MaxAgeDays: 90, ExpireWarningDays: 14, GraceLogins: 3, MinLength: 12, Complexity: 4, History: 5, MustChange: true}, ""},
+		{"negative max age", configPasswordPolicy{MaxAgeDays: -1}, "Invalid passwordPolicy.maxAgeDays -1"},
+		{"negative grace logins", configPasswordPolicy{GraceLogins: -2}, "Invalid passwordPolicy.graceLogins -2"},
+		{"negative history", configPasswordPolicy{History: -1}, "Invalid passwordPolicy.history -1"},
+		{"too complex", configPasswordPolicy{Complexity: 5}, "Invalid passwordPolicy.complexity 5: expected 0 to 4 character classes"},
+	}
+	for _, test := range tests {
+		err := validatePasswordPolicy(&config{PasswordPolicy: test.policy})
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && err != nil {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     configUser
+		problems []string
+	}{
+		{"valid", configUser{PwdChangedTime: "2024-01-01T12:00:00Z", PasswordExpires: "2025-01-01", PasswordHistory: []string{testPasswordHash}}, nil},
+		{"invalid pwdChangedTime", configUser{PwdChangedTime: "yesterday"}, []string{"pwdChangedTime: user 'alice': invalid pwdChangedTime 'yesterday'"}},
+		{"invalid passwordExpires", configUser{PasswordExpires: "2025-13-01"}, []string{"passwordExpires: user 'alice': invalid passwordExpires '2025-13-01'"}},
+		{"invalid history", configUser{PasswordHistory: []string{testPasswordHash, "plain"}}, []string{"passwordHistory: user 'alice': invalid passwordHistory #1: "}},
+	}
+	for _, test := range tests {
+		test.user.CommonName = "alice"
+		problems := []string{}
+		checkPasswordPolicy(&test.user, func(key, format string, args ...interface{}) {
+			problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+		})
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: problems %q, want %q", test.name, problems, test.problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.HasPrefix(problem, test.problems[i]) {
+				t.Errorf("%s: problem %q, want %q", test.name, problem, test.problems[i])
+			}
+		}
+	}
+}
+
+func TestBindPasswordAge(t *testing.T) {
+	useOTPStateFile(t)
+	audit := captureAudit(t)
+	daysAgo := func(days int) string {
+		return time.Now().AddDate(0, 0, -days).UTC().Format(time.RFC3339)
+	}
+	h := newTestHandler(&config{
+		PasswordPolicy: configPasswordPolicy{MaxAgeDays: 90, ExpireWarningDays: 14, GraceLogins: 2},
+		Users: []configUser{
+			{CommonName: "fresh", UserPassword: testPasswordHash, PwdChangedTime: daysAgo(10)},
+			{CommonName: "ageless", UserPassword: testPasswordHash},
+			{CommonName: "expiring", UserPassword: testPasswordHash, PwdChangedTime: daysAgo(80)},
+			{CommonName: "expired", UserPassword: testPasswordHash, PwdChangedTime: daysAgo(100)},
+			{CommonName: "deadline", UserPassword: testPasswordHash, PasswordExpires: "2000-01-01", PwdChangedTime: daysAgo(1)},
+			{CommonName: "reset", UserPassword: testPasswordHash, PwdChangedTime: daysAgo(1), PasswordMustChange: true},
+		},
+	})
+
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		outcome    string
+		warning    int
+		value      int // of the warning; for the time before expiration, in days
+		err        int
+		mustChange bool
+	}{
+		{"fresh", "fresh", "secret", bindOutcomeSuccess, ppolicyNone, 0, ppolicyNone, false},
+		{"without pwdChangedTime", "ageless", "secret", bindOutcomeSuccess, ppolicyNone, 0, ppolicyNone, false},
+		{"about to expire", "expiring", "secret", bindOutcomeSuccess, ppolicyTimeBeforeExpiration, 10, ppolicyNone, false},
+		// a wrong password doesn't use up a grace login
+		{"expired, wrong password", "expired", "guess", bindOutcomeBadPassword, ppolicyNone, 0, ppolicyNone, false},
+		{"first grace login", "expired", "secret", bindOutcomeSuccess, ppolicyGraceAuthNsRemaining, 1, ppolicyNone, true},
+		{"last grace login", "expired", "secret", bindOutcomeSuccess, ppolicyGraceAuthNsRemaining, 0, ppolicyNone, true},
+		{"no grace login left", "expired", "secret", bindOutcomePasswordExpired, ppolicyNone, 0, ppolicyPasswordExpired, false},
+		{"passwordExpires", "deadline", "secret", bindOutcomeSuccess, ppolicyGraceAuthNsRemaining, 1, ppolicyNone, true},
+		{"must change", "reset", "secret", bindOutcomeSuccess, ppolicyNone, 0, ppolicyChangeAfterReset, true},
+	}
+	for _, test := range tests {
+		conn := newTestConn(t)
+		s := &session{id: conn.addr.id, operations: map[string]uint64{}}
+		sessions.mu.Lock()
+		sessions.sessions[s.id] = s
+		sessions.mu.Unlock()
+
+		result, rec := bind(t, h, audit, userDN(test.user), test.password, conn)
+		sessions.end(s, sessionEndClose)
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome {
+			t.Errorf("%s: %d %+v, want outcome %q", test.name, result, rec, test.outcome)
+			continue
+		}
+		want := ppolicyResponse{warning: test.warning, warningValue: test.value, err: test.err}
+		response := s.takePasswordPolicy()
+		if response == nil {
+			if test.outcome != bindOutcomeBadPassword {
+				t.Errorf("%s: no password policy response", test.name)
+			}
+			continue
+		}
+		if response.warning == ppolicyTimeBeforeExpiration {
+			response.warningValue = (response.warningValue + 3600) / (24 * 3600)
+		}
+		if *response != want || s.bindingMustChange != test.mustChange {
+			t.Errorf("%s: %+v must change %v, want %+v %v", test.name, *response, s.bindingMustChange, want, test.mustChange)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default of push.timeout
+const defaultPushTimeout = 30 * time.Second
+
+// Results of a push approval
+const (
+	pushApprove = "approve"
+	pushDeny    = "deny"
+)
+
+// pushRequest is the JSON body of the webhook call, see the README
+type pushRequest struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	BindDN   string    `json:"bindDn"`
+	SourceIP string    `json:"sourceIp,omitempty"`
+	Listener string    `json:"listener,omitempty"`
+	Time     time.Time `json:"time"`
+	Expires  time.Time `json:"expires"`
+	Callback string    `json:"callback,omitempty"`
+}
+
+// pushResult is the answer of the approval service, in the response to the
+// webhook call or in a callback
+type pushResult struct {
+	Result string `json:"result"`
+}
+
+// pendingPush is a Bind waiting for its approval
+type pendingPush struct {
+	secret string
+	result chan string
+}
+
+// pushRegistry holds the Binds waiting for the callback of the approval
+// service
+type pushRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*pendingPush
+}
+
+var pushApprovals = &pushRegistry{pending: map[string]*pendingPush{}}
+
+// validatePushConfig checks the [push] settings against the users of the
+// config file
+func validatePushConfig(cfg *config) error {
+	if len(cfg.Push.URL) == 0 {
+		for _, u := range cfg.Users {
+			if u.Push {
+				return fmt.Errorf("User '%s' approves binds by push, which requires a push.url", u.CommonName)
+			}
+		}
+		return nil
+	}
+	for _, setting := range []struct{ name, value string }{{"push.url", cfg.Push.URL}, {"push.callbackURL", cfg.Push.CallbackURL}} {
+		if len(setting.value) == 0 {
+			continue
+		}
+		u, err := url.Parse(setting.value)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return fmt.Errorf("Invalid %s '%s': please use an http or https URL", setting.name, setting.value)
+		}
+	}
+	if len(cfg.Push.CallbackURL) > 0 {
+		if len(cfg.Push.Secret) == 0 {
+			return fmt.Errorf("push.callbackURL requires a push.secret, which authenticates the callbacks")
+		}
+		if !cfg.HTTP.Enabled {
+			return fmt.Errorf("push.callbackURL requires the HTTP server: please set http.enabled")
+		}
+	}
+	if len(cfg.Push.Timeout) > 0 {
+		if _, err := time.ParseDuration(cfg.Push.Timeout); err != nil {
+			return fmt.Errorf("Invalid push.timeout: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// approve asks the approval service of pushConfig to approve a Bind as user,
+// and waits for its answer until the timeout. The service answers in the
+// response to the webhook call, or with 202 Accepted, then in a callback.
+func (r *pushRegistry) approve(pushConfig *configPush, user, bindDN string, conn net.Conn) (bool, error) {
+	timeout := defaultPushTimeout
+	if len(pushConfig.Timeout) > 0 {
+		timeout, _ = time.ParseDuration(pushConfig.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	id, err := newPushID()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	req := pushRequest{ID: id, User: user, BindDN: bindDN, Time: now, Expires: now.Add(timeout)}
+	req.SourceIP, _ = connSource(conn)
+	_, req.Listener = connInfo(conn)
+	if len(pushConfig.CallbackURL) > 0 {
+		req.Callback = strings.TrimSuffix(pushConfig.CallbackURL, "/") + "/push/" + id
+	}
+
+	pending := &pendingPush{secret: pushConfig.Secret, result: make(chan string, 1)}
+	r.mu.Lock()
+	r.pending[id] = pending
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, pushConfig.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if len(pushConfig.Secret) > 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+pushConfig.Secret)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, fmt.Errorf("no answer within %s", timeout)
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	result := ""
+	switch resp.StatusCode {
+	case http.StatusOK:
+		answer := pushResult{}
+		if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+			return false, fmt.Errorf("invalid response: %s", err.Error())
+		}
+		result = answer.Result
+	case http.StatusAccepted:
+		select {
+		case result = <-pending.result:
+		case <-ctx.Done():
+			return false, fmt.Errorf("no answer within %s", timeout)
+		}
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	switch result {
+	case pushApprove:
+		return true, nil
+	case pushDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid result '%s'", result)
+}
+
+// resolve passes the result of a callback to the Bind waiting for it; it
+// reports false for unknown or finished requests, and for a wrong or empty
+// secret
+func (r *pushRegistry) resolve(id, secret, result string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending, ok := r.pending[id]
+	if !ok || len(pending.secret) == 0 || subtle.ConstantTimeCompare([]byte(secret), []byte(pending.secret)) != 1 {
+		return false
+	}
+	select {
+	case pending.result <- result:
+		return true
+	default:
+		// answered already
+		return false
+	}
+}
+
+// newPushID returns a random, unguessable request ID
+func newPushID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// servePush takes the callback of the approval service: a POST to
+// /push/<id> with the result as JSON
+func servePush(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		serveJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	answer := pushResult{}
+	if err := json.NewDecoder(r.Body).Decode(&answer); err != nil || (answer.Result != pushApprove && answer.Result != pushDeny) {
+		serveJSONError(w, http.StatusBadRequest, "the result must be 'approve' or 'deny'")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/push/")
+	secret := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if !pushApprovals.resolve(id, secret, answer.Result) {
+		serveJSONError(w, http.StatusNotFound, "no pending request with this ID")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
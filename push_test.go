@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/metala/ldap"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidatePushConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		push configPush
+		http bool
+		err  string
+	}{
+		{"webhook", configPush{URL: "https://approve.example.com/authnds"}, false, ""},
+		{"callback", configPush{URL: "https://approve.example.com/authnds", Secret: "s3cret", CallbackURL: "https://authnds.example.com:5555"}, true, ""},
+		{"callback without secret", configPush{URL: "https://approve.example.com/authnds", CallbackURL: "https://authnds.example.com:5555"}, true, "requires a push.secret"},
+		{"callback without HTTP", configPush{URL: "https://approve.example.com/authnds", Secret: "s3cret", CallbackURL: "https://authnds.example.com:5555"}, false, "requires the HTTP server"},
+		{"invalid URL", configPush{URL: "approve.example.com"}, false, "Invalid push.url"},
+		{"invalid timeout", configPush{URL: "https://approve.example.com/authnds", Timeout: "30"}, false, "Invalid push.timeout"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validatePushConfig(&config{Push: test.push, HTTP: configHTTP{Enabled: test.http}})
+			if len(test.err) == 0 && err != nil || len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// callback posts a result to the callback of a push request, as the approval
+// service does, and returns the status of the answer
+func callback(req pushRequest, secret, result string) int {
+	body, _ := json.Marshal(pushResult{Result: result})
+	r := httptest.NewRequest(http.MethodPost, req.Callback, strings.NewReader(string(body)))
+	if len(secret) > 0 {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	w := httptest.NewRecorder()
+	servePush(w, r)
+	return w.Code
+}
+
+func TestPushApproval(t *testing.T) {
+	const secret = "s3cret"
+	var callbacks sync.WaitGroup
+	tests := []struct {
+		name     string
+		webhook  func(req pushRequest, w http.ResponseWriter)
+		approved bool
+		err      string
+	}{
+		{
+			name:     "approve",
+			webhook:  func(req pushRequest, w http.ResponseWriter) { w.Write([]byte(`{"result":"approve"}`)) },
+			approved: true,
+		},
+		{
+			name:    "deny",
+			webhook: func(req pushRequest, w http.ResponseWriter) { w.Write([]byte(`{"result":"deny"}`)) },
+		},
+		{
+			name:    "timeout",
+			webhook: func(req pushRequest, w http.ResponseWriter) { time.Sleep(300 * time.Millisecond) },
+			err:     "no answer within",
+		},
+		{
+			name:    "webhook error",
+			webhook: func(req pushRequest, w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) },
+			err:     "webhook returned 500",
+		},
+		{
+			name: "callback",
+			webhook: func(req pushRequest, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusAccepted)
+				callbacks.Add(1)
+				go func() {
+					defer callbacks.Done()
+					if code := callback(req, secret, pushApprove); code != http.StatusNoContent {
+						t.Errorf("callback answered %d", code)
+					}
+				}()
+			},
+			approved: true,
+		},
+		{
+			name: "callback with a bad secret",
+			webhook: func(req pushRequest, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusAccepted)
+				callbacks.Add(1)
+				go func() {
+					defer callbacks.Done()
+					for _, secret := range []string{"wrong", ""} {
+						if code := callback(req, secret, pushApprove); code != http.StatusNotFound {
+							t.Errorf("callback with the secret %q answered %d", secret, code)
+						}
+					}
+				}()
+			},
+			err: "no answer within",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer "+secret {
+					t.Errorf("webhook called with %q", r.Header.Get("Authorization"))
+				}
+				req := pushRequest{}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User != "alice" || req.BindDN != userDN("alice") {
+					t.Errorf("webhook called with %+v: %v", req, err)
+				}
+				test.webhook(req, w)
+			}))
+			defer server.Close()
+
+			pushConfig := &configPush{URL: server.URL, Secret: secret, Timeout: "200ms", CallbackURL: "https://authnds.example.com:5555"}
+			approved, err := pushApprovals.approve(pushConfig, "alice", userDN("alice"), newTestConn(t))
+			callbacks.Wait()
+			if approved != test.approved {
+				t.Errorf("approved %v, want %v", approved, test.approved)
+			}
+			if len(test.err) == 0 && err != nil || len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPushCallbackWithoutSecret(t *testing.T) {
+	// a pending request without a secret takes no callbacks, not even with an
+	// empty bearer token
+	pushApprovals.mu.Lock()
+	pushApprovals.pending["nosecret"] = &pendingPush{result: make(chan string, 1)}
+	pushApprovals.mu.Unlock()
+	defer func() {
+		pushApprovals.mu.Lock()
+		delete(pushApprovals.pending, "nosecret")
+		pushApprovals.mu.Unlock()
+	}()
+	req := pushRequest{Callback: "https://authnds.example.com:5555/push/nosecret"}
+	for _, secret := range []string{"", "anything"} {
+		if code := callback(req, secret, pushApprove); code != http.StatusNotFound {
+			t.Errorf("callback with the secret %q answered %d", secret, code)
+		}
+	}
+}
+
+func TestBindPush(t *testing.T) {
+	const otpSecret = "JBSWY3DPEHPK3PXP"
+	audit := captureAudit(t)
+	var mu sync.Mutex
+	answer, calls := "", 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if len(answer) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"result":"` + answer + `"}`))
+	}))
+	defer server.Close()
+	h := newTestHandler(&config{
+		Push:  configPush{URL: server.URL, Secret: "s3cret", Timeout: "1s"},
+		Users: []configUser{{CommonName: "alice", UserPassword: testPasswordHash, OTPSecret: otpSecret, Push: true}},
+	})
+	code, err := totp.GenerateCode(otpSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		answer   string // of the webhook, an error when empty
+		calls    int
+		outcome  string
+		reason   string
+		factors  string
+	}{
+		{"approved", "secret", pushApprove, 1, bindOutcomeSuccess, "", "password,push"},
+		{"denied", "secret", pushDeny, 1, bindOutcomeBadOTP, "push denied", ""},
+		{"webhook error", "secret", "", 1, bindOutcomeBadOTP, "push failed", ""},
+		// no push without the password
+		{"wrong password", "guess", pushApprove, 0, bindOutcomeBadPassword, "invalid password", ""},
+		// nor with another second factor
+		{"TOTP", "secret" + code, pushApprove, 0, bindOutcomeSuccess, "", "password,totp"},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		answer, calls = test.answer, 0
+		mu.Unlock()
+		result, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		mu.Lock()
+		if (result == ldap.LDAPResultSuccess) != (test.outcome == bindOutcomeSuccess) || rec.Outcome != test.outcome || rec.Reason != test.reason ||
+			strings.Join(rec.Factors, ",") != test.factors || calls != test.calls {
+			t.Errorf("%s: %d %+v with %d webhook calls, want outcome %q reason %q factors %q with %d", test.name, result, rec, calls, test.outcome, test.reason, test.factors, test.calls)
+		}
+		mu.Unlock()
+	}
+}
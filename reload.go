@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/metala/ldap"
+)
+
+// How often the config files are checked for changes with watchConfig
+const configWatchInterval = 2 * time.Second
+
+// reloadWrittenConfig reloads the config once an LDAP write has saved it to
+// the config files, so the change is served before the write returns
+var reloadWrittenConfig = func() error {
+	return fmt.Errorf("The configuration can't be reloaded")
+}
+
+// reloadableBackend forwards requests to the backend built from the most
+// recently loaded config, so that a reload never affects a request in flight.
+// Writes run one at a time, each against the backend left by the previous one.
+type reloadableBackend struct {
+	current atomic.Value
+	writes  sync.Mutex
+}
+
+func newReloadableBackend(handler Backend) *reloadableBackend {
+	b := &reloadableBackend{}
+	b.current.Store(&handler)
+	return b
+}
+
+func (b *reloadableBackend) backend() Backend {
+	return *b.current.Load().(*Backend)
+}
+
+// swap replaces the backend and returns the previous one
+func (b *reloadableBackend) swap(handler Backend) Backend {
+	return *b.current.Swap(&handler).(*Backend)
+}
+
+func (b *reloadableBackend) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return b.backend().Bind(bindDN, bindSimplePw, conn)
+}
+
+func (b *reloadableBackend) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return b.backend().Search(boundDN, searchReq, conn)
+}
+
+func (b *reloadableBackend) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	return b.backend().Add(boundDN, req, conn)
+}
+
+func (b *reloadableBackend) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	return b.backend().Modify(boundDN, req, conn)
+}
+
+func (b *reloadableBackend) Delete(boundDN string, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	return b.backend().Delete(boundDN, deleteDN, conn)
+}
+
+func (b *reloadableBackend) ModifyDN(boundDN string, req ldap.ModifyDNRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	b.writes.Lock()
+	defer b.writes.Unlock()
+	return b.backend().ModifyDN(boundDN, req, conn)
+}
+
+func (b *reloadableBackend) Compare(boundDN string, req ldap.CompareRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return b.backend().Compare(boundDN, req, conn)
+}
+
+func (b *reloadableBackend) Close(boundDN string, conn net.Conn) error {
+	return b.backend().Close(boundDN, conn)
+}
+
+// configReloader reloads the users, groups and settings of the config, with
+// watchConfig, whenever one of the config files changes.
+// Listeners are bound at startup and are not affected by a reload.
+type configReloader struct {
+	backend *reloadableBackend
+	yubikey yubikeyValidator
+
+	mu          sync.Mutex
+	cfg         *config
+	fingerprint string
+}
+
+func newConfigReloader(cfg *config, backend *reloadableBackend, yubikey yubikeyValidator) *configReloader {
+	return &configReloader{
+		backend:     backend,
+		yubikey:     yubikey,
+		cfg:         cfg,
+		fingerprint: configFilesFingerprint(cfg),
+	}
+}
+
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Notice("Reloading configuration")
+	cfg, err := loadConfig(r.cfg.ConfigFile, r.cfg.format)
+	if err != nil {
+		// Don't retry the broken files until they change again
+		r.fingerprint = configFilesFingerprint(r.cfg)
+		log.Errorf("Configuration reload failed, keeping the current configuration: %s", err.Error())
+		observeConfigReload(false)
+		return err
+	}
+	handler, err := newBackend(cfg, r.yubikey)
+	if err == nil {
+		// Yubico validation servers are set at startup, local keys reload
+		if local, ok := r.yubikey.(*localYubikeyValidator); ok && cfg.Yubikey.Validation == yubikeyValidationLocal {
+			err = local.setKeys(&cfg.Yubikey)
+		}
+	}
+	if err == nil {
+		err = otpStates.configure(&cfg.OTP)
+	}
+	if err != nil {
+		r.fingerprint = configFilesFingerprint(r.cfg)
+		log.Errorf("Configuration reload failed, keeping the current configuration: %s", err.Error())
+		observeConfigReload(false)
+		return err
+	}
+	r.cfg = cfg
+	r.fingerprint = configFilesFingerprint(cfg)
+	sessions.setTimeouts(&cfg.Sessions)
+	if old, ok := r.backend.swap(handler).(*sqlHandler); ok {
+		old.close()
+	}
+	observeConfigReload(true)
+	log.Notice("Configuration reloaded")
+	return nil
+}
+
+// changed reports whether watchConfig is set and a config file has changed
+func (r *configReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg.WatchConfig && configFilesFingerprint(r.cfg) != r.fingerprint
+}
+
+// awsUsersChanged reports whether the awsUsers source is due for polling and
+// has changed
+func (r *configReloader) awsUsersChanged() bool {
+	r.mu.Lock()
+	cfg := r.cfg
+	r.mu.Unlock()
+	if cfg.AwsUsers.Enabled && awsUsers.poll(cfg) {
+		log.Noticef("Users changed in %s", cfg.AwsUsers.Source)
+		return true
+	}
+	return false
+}
+
+// run reloads on config file changes and when the awsUsers source changes
+func (r *configReloader) run() {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if r.changed() {
+			log.Notice("Configuration files changed")
+			r.reload()
+		} else if r.awsUsersChanged() {
+			r.reload()
+		}
+	}
+}
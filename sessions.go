@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+// Reasons a session ends, used as the "reason" label of metricSessionsEnded
+const (
+	sessionEndClose           = "close"
+	sessionEndUnbind          = "unbind"
+	sessionEndIdleTimeout     = "idle_timeout"
+	sessionEndAbsoluteTimeout = "absolute_timeout"
+	sessionEndKilled          = "killed"
+)
+
+// names of LDAP operations in the operation counts of a session
+var sessionOperations = map[ber.Tag]string{
+	ldap.ApplicationBindRequest:     "bind",
+	ldap.ApplicationUnbindRequest:   "unbind",
+	ldap.ApplicationSearchRequest:   "search",
+	ldap.ApplicationModifyRequest:   "modify",
+	ldap.ApplicationAddRequest:      "add",
+	ldap.ApplicationDelRequest:      "delete",
+	ldap.ApplicationModifyDNRequest: "modifydn",
+	ldap.ApplicationCompareRequest:  "compare",
+	ldap.ApplicationAbandonRequest:  "abandon",
+	ldap.ApplicationExtendedRequest: "extended",
+}
+
+// session is the state of a client connection, from the moment it's
+// accepted until it's closed
+type session struct {
+	id        uint64
+	listener  string
+	source    string
+	connected time.Time
+	conn      *ldapConn
+
+	mu           sync.Mutex
+	tls          bool
+	boundDN      string
+	user         string
+	factors      []string
+	boundAt      time.Time
+	lastActivity time.Time
+	operations   map[string]uint64
+	ended        string // why the session ended, empty while it's open
+	mustChange   bool   // the password must be changed before anything else
+	// the user and factors of a Bind waiting for its response
+	bindingUser    string
+	bindingFactors []string
+	// the password policy response of the Bind, and whether it binds a user
+	// who must change their password
+	bindingPasswordPolicy *ppolicyResponse
+	bindingMustChange     bool
+	// an OTP challenge: the next Bind to challengeDN is taken as one to
+	// challengeUserDN, until challengeUntil
+	challengeDN       string
+	challengeUserDN   string
+	challengeUntil    time.Time
+	challengeResponse string // the user DN of the Bind answering it
+}
+
+// sessionInfo is a session as listed by the admin interface
+type sessionInfo struct {
+	ID           uint64            `json:"id"`
+	Listener     string            `json:"listener"`
+	Source       string            `json:"source,omitempty"`
+	TLS          bool              `json:"tls"`
+	ConnectedAt  time.Time         `json:"connectedAt"`
+	LastActivity time.Time         `json:"lastActivity"`
+	BindDN       string            `json:"bindDn,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Factors      []string          `json:"factors,omitempty"`
+	BoundAt      *time.Time        `json:"boundAt,omitempty"`
+	MustChange   bool              `json:"mustChangePassword,omitempty"`
+	Operations   map[string]uint64 `json:"operations"`
+}
+
+// sessionRegistry holds the open sessions of all listeners
+type sessionRegistry struct {
+	mu              sync.Mutex
+	sessions        map[uint64]*session
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+}
+
+var sessions = &sessionRegistry{sessions: map[uint64]*session{}}
+
+// validateSessionConfig checks the [sessions] timeouts
+func validateSessionConfig(sessionConfig *configSessions) error {
+	if len(sessionConfig.IdleTimeout) > 0 {
+		if _, err := time.ParseDuration(sessionConfig.IdleTimeout); err != nil {
+			return fmt.Errorf("Invalid sessions.idleTimeout: %s", err.Error())
+		}
+	}
+	if len(sessionConfig.AbsoluteTimeout) > 0 {
+		if _, err := time.ParseDuration(sessionConfig.AbsoluteTimeout); err != nil {
+			return fmt.Errorf("Invalid sessions.absoluteTimeout: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// setTimeouts applies the [sessions] timeouts of a (re)loaded config. Open
+// sessions get them when they next wait for a request.
+func (r *sessionRegistry) setTimeouts(sessionConfig *configSessions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idleTimeout, _ = time.ParseDuration(sessionConfig.IdleTimeout)
+	r.absoluteTimeout, _ = time.ParseDuration(sessionConfig.AbsoluteTimeout)
+}
+
+// open registers the session of a new connection
+func (r *sessionRegistry) open(conn *ldapConn, tls bool) *session {
+	id, listener := connInfo(conn)
+	now := time.Now()
+	s := &session{
+		id:           id,
+		listener:     listener,
+		connected:    now,
+		conn:         conn,
+		tls:          tls,
+		lastActivity: now,
+		operations:   map[string]uint64{},
+	}
+	if ip, port := connSource(conn); len(ip) > 0 {
+		s.source = ip + ":" + port
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[id] = s
+	return s
+}
+
+// end removes a session from the registry, once
+func (r *sessionRegistry) end(s *session, reason string) {
+	s.mu.Lock()
+	if len(s.ended) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = reason
+	operations := uint64(0)
+	for _, count := range s.operations {
+		operations += count
+	}
+	boundDN := s.boundDN
+	s.mu.Unlock()
+
+	r.mu.Lock()
+	delete(r.sessions, s.id)
+	r.mu.Unlock()
+	metricSessionsEnded.WithLabelValues(reason).Inc()
+	connLogger(s.id).Debugf("Session ended (%s) after %s and %d operations, bound as '%s'", reason, time.Since(s.connected).Round(time.Second), operations, boundDN)
+}
+
+// get returns the open session of a connection ID, or nil
+func (r *sessionRegistry) get(id uint64) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// deadline returns when a session waiting for a request times out, and why;
+// the zero time when it doesn't
+func (r *sessionRegistry) deadline(s *session) (time.Time, string) {
+	r.mu.Lock()
+	idle, absolute := r.idleTimeout, r.absoluteTimeout
+	r.mu.Unlock()
+
+	var deadline time.Time
+	reason := ""
+	if idle > 0 {
+		deadline = time.Now().Add(idle)
+		reason = sessionEndIdleTimeout
+	}
+	if absolute > 0 {
+		if end := s.connected.Add(absolute); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			reason = sessionEndAbsoluteTimeout
+		}
+	}
+	return deadline, reason
+}
+
+// list returns the open sessions by ID, only those of user when it's set
+func (r *sessionRegistry) list(user string) []sessionInfo {
+	r.mu.Lock()
+	open := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		open = append(open, s)
+	}
+	r.mu.Unlock()
+
+	infos := []sessionInfo{}
+	for _, s := range open {
+		info := s.info()
+		if len(user) == 0 || strings.EqualFold(info.User, user) {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// kill disconnects the sessions of the given IDs, and returns how many were
+// open
+func (r *sessionRegistry) kill(ids []uint64) int {
+	killed := 0
+	for _, id := range ids {
+		if s := r.get(id); s != nil {
+			connLogger(id).Noticef("Session killed by an administrator")
+			r.end(s, sessionEndKilled)
+			s.conn.disconnect("Session terminated by an administrator")
+			killed++
+		}
+	}
+	return killed
+}
+
+// info returns a copy of the state of a session
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := sessionInfo{
+		ID:           s.id,
+		Listener:     s.listener,
+		Source:       s.source,
+		TLS:          s.tls,
+		ConnectedAt:  s.connected,
+		LastActivity: s.lastActivity,
+		BindDN:       s.boundDN,
+		User:         s.user,
+		Factors:      append([]string{}, s.factors...),
+		MustChange:   s.mustChange,
+		Operations:   map[string]uint64{},
+	}
+	if !s.boundAt.IsZero() {
+		boundAt := s.boundAt
+		info.BoundAt = &boundAt
+	}
+	for name, count := range s.operations {
+		info.Operations[name] = count
+	}
+	return info
+}
+
+// isEnded reports whether the session ended
+func (s *session) isEnded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ended) > 0
+}
+
+// count records a request
+func (s *session) count(tag ber.Tag) {
+	name, ok := sessionOperations[tag]
+	if !ok {
+		name = "other"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operations[name]++
+	s.lastActivity = time.Now()
+}
+
+// startedTLS records a successful StartTLS
+func (s *session) startedTLS() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tls = true
+}
+
+// isTLS reports whether the session is encrypted
+func (s *session) isTLS() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tls
+}
+
+// bindDN returns the DN the session is bound as, "" when anonymous
+func (s *session) bindDN() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.boundDN
+}
+
+// authenticated records the user and factors a Bind handler accepted; they
+// apply once the Bind response is sent
+func (s *session) authenticated(user string, factors []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bindingUser = user
+	s.bindingFactors = factors
+}
+
+// bound records the response to a Bind as dn. Like the ldap library, a
+// failed Bind leaves the session bound as before.
+func (s *session) bound(dn string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.boundDN = dn
+		s.user = s.bindingUser
+		s.factors = s.bindingFactors
+		s.boundAt = time.Now()
+		s.mustChange = s.bindingMustChange
+	}
+	s.bindingUser = ""
+	s.bindingFactors = nil
+	s.bindingMustChange = false
+}
+
+// passwordPolicy records the password policy response of a Bind, and
+// whether the user it binds must change their password
+func (s *session) passwordPolicy(response ppolicyResponse, mustChange bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bindingPasswordPolicy = &response
+	s.bindingMustChange = mustChange
+}
+
+// takePasswordPolicy returns the password policy response of the Bind being
+// answered, if any
+func (s *session) takePasswordPolicy() *ppolicyResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := s.bindingPasswordPolicy
+	s.bindingPasswordPolicy = nil
+	return response
+}
+
+// mustChangePassword reports whether the bound user must change their
+// password before anything else
+func (s *session) mustChangePassword() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mustChange
+}
+
+// boundFactors returns the factors the bound user authenticated with
+func (s *session) boundFactors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.factors...)
+}
+
+// passwordChanged records that the bound user changed their password
+func (s *session) passwordChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mustChange = false
+}
+
+// challenge records that the user bound as dn must send an OTP in the next
+// Bind, to challengeDN
+func (s *session) challenge(dn, challengeDN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.challengeDN = challengeDN
+	s.challengeUserDN = dn
+	s.challengeUntil = time.Now().Add(otpChallengeTimeout)
+}
+
+// takeChallenge ends the pending challenge, if any, on the next Bind, and
+// returns the DN of the user it's for when that Bind answers it
+func (s *session) takeChallenge(dn string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userDN := s.challengeUserDN
+	ok := len(userDN) > 0 && sameDN(dn, s.challengeDN) && time.Now().Before(s.challengeUntil)
+	s.challengeDN, s.challengeUserDN, s.challengeUntil = "", "", time.Time{}
+	s.challengeResponse = ""
+	if ok {
+		s.challengeResponse = userDN
+	}
+	return userDN, ok
+}
+
+// isChallengeResponse reports whether the Bind as dn answers a challenge
+func (s *session) isChallengeResponse(dn string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := len(s.challengeResponse) > 0 && sameDN(dn, s.challengeResponse)
+	s.challengeResponse = ""
+	return ok
+}
+
+// sessionAuthenticated records, from a Bind handler, who the connection is
+// about to be bound as
+func sessionAuthenticated(conn net.Conn, user string, factors []string) {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		s.authenticated(user, factors)
+	}
+}
+
+// sessionBindDN returns the DN a connection is bound as, "" when anonymous
+func sessionBindDN(conn net.Conn) string {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		return s.bindDN()
+	}
+	return ""
+}
+
+// sessionPasswordPolicy records, from a Bind handler, the password policy
+// response of the Bind, and whether the user must change their password
+func sessionPasswordPolicy(conn net.Conn, response ppolicyResponse, mustChange bool) {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		s.passwordPolicy(response, mustChange)
+	}
+}
+
+// sessionMustChangePassword reports whether the user a connection is bound
+// as must change their password before anything else
+func sessionMustChangePassword(conn net.Conn) bool {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		return s.mustChangePassword()
+	}
+	return false
+}
+
+// sessionFactors returns the factors the user a connection is bound as
+// authenticated with
+func sessionFactors(conn net.Conn) []string {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		return s.boundFactors()
+	}
+	return nil
+}
+
+// sessionPasswordChanged records that the bound user changed their password
+func sessionPasswordChanged(conn net.Conn) {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		s.passwordChanged()
+	}
+}
+
+// sessionChallenge asks, from a Bind handler, for the OTP of the user bound
+// as dn in a Bind to challengeDN
+func sessionChallenge(conn net.Conn, dn, challengeDN string) {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		s.challenge(dn, challengeDN)
+	}
+}
+
+// sessionChallengeResponse reports, from a Bind handler, whether the Bind as
+// dn answers a challenge
+func sessionChallengeResponse(conn net.Conn, dn string) bool {
+	id, _ := connInfo(conn)
+	if s := sessions.get(id); s != nil {
+		return s.isChallengeResponse(dn)
+	}
+	return false
+}
+
+// serveSessions lists the open sessions on GET, and kills them on DELETE:
+// /sessions/<id> for a single one, /sessions?user=<name> for those of a user
+func serveSessions(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(sessions.list(user))
+	case http.MethodDelete:
+		ids := []uint64{}
+		if idText := strings.TrimPrefix(r.URL.Path, "/sessions/"); idText != r.URL.Path && len(idText) > 0 {
+			id, err := strconv.ParseUint(idText, 10, 64)
+			if err != nil {
+				serveJSONError(w, http.StatusBadRequest, "invalid session ID")
+				return
+			}
+			ids = append(ids, id)
+		} else if len(user) > 0 {
+			for _, info := range sessions.list(user) {
+				ids = append(ids, info.ID)
+			}
+		} else {
+			serveJSONError(w, http.StatusBadRequest, "a session ID or user is required")
+			return
+		}
+		killed := sessions.kill(ids)
+		if killed == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(map[string]int{"killed": killed})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		serveJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func serveJSONError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/metala/ldap"
+)
+
+func TestValidateSessionConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config configSessions
+		err    string
+	}{
+		{"no timeouts", configSessions{}, ""},
+		{"timeouts", configSessions{IdleTimeout: "15m", AbsoluteTimeout: "8h"}, ""},
+		{"invalid idle timeout", configSessions{IdleTimeout: "15"}, "Invalid sessions.idleTimeout"},
+		{"invalid absolute timeout", configSessions{AbsoluteTimeout: "a day"}, "Invalid sessions.absoluteTimeout"},
+	}
+	for _, test := range tests {
+		err := validateSessionConfig(&test.config)
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && err != nil {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    configSessions
+		connected time.Duration // how long ago the session was opened
+		after     time.Duration // the deadline is about this long from now
+		reason    string
+	}{
+		{"no timeouts", configSessions{}, 0, 0, ""},
+		{"idle", configSessions{IdleTimeout: "15m"}, time.Hour, 15 * time.Minute, sessionEndIdleTimeout},
+		{"absolute", configSessions{AbsoluteTimeout: "8h"}, time.Hour, 7 * time.Hour, sessionEndAbsoluteTimeout},
+		{"idle before absolute", configSessions{IdleTimeout: "15m", AbsoluteTimeout: "8h"}, time.Hour, 15 * time.Minute, sessionEndIdleTimeout},
+		{"absolute before idle", configSessions{IdleTimeout: "15m", AbsoluteTimeout: "8h"}, 470 * time.Minute, 10 * time.Minute, sessionEndAbsoluteTimeout},
+	}
+	r := &sessionRegistry{sessions: map[uint64]*session{}}
+	for _, test := range tests {
+		r.setTimeouts(&test.config)
+		deadline, reason := r.deadline(&session{connected: time.Now().Add(-test.connected)})
+		if reason != test.reason || test.after == 0 && !deadline.IsZero() ||
+			test.after > 0 && (deadline.Before(time.Now().Add(test.after-time.Minute)) || deadline.After(time.Now().Add(test.after))) {
+			t.Errorf("%s: %v (%s), want in %s (%s)", test.name, deadline, reason, test.after, test.reason)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	h := newTestHandler(&config{Users: []configUser{{CommonName: "carol", UserPassword: testPasswordHash}}})
+	addr := startTestServer(t, h)
+	carol := dialTestServer(t, addr)
+	if code := resultCode(carol.bind(userDN("carol"), "secret")); code != ldap.LDAPResultSuccess {
+		t.Fatalf("Bind %d", code)
+	}
+	// an anonymous session of the same listener
+	dialTestServer(t, addr).whoAmI()
+
+	tests := []struct {
+		name       string
+		user       string
+		sessions   int
+		operations map[string]uint64
+	}{
+		{"of a user", "CAROL", 1, map[string]uint64{"bind": 1}},
+		{"of another user", "dave", 0, nil},
+	}
+	for _, test := range tests {
+		infos := sessions.list(test.user)
+		if len(infos) != test.sessions {
+			t.Errorf("%s: %d sessions, want %d", test.name, len(infos), test.sessions)
+			continue
+		}
+		if test.operations == nil {
+			continue
+		}
+		info := infos[0]
+		if info.Listener != "test" || info.BindDN != userDN("carol") || info.User != "carol" || strings.Join(info.Factors, ",") != "password" ||
+			info.BoundAt == nil || info.Operations["bind"] != test.operations["bind"] {
+			t.Errorf("%s: %+v", test.name, info)
+		}
+	}
+
+	// the session ends with an Unbind
+	unbind := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	unbind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, carol.messageID+1, "Message ID"))
+	unbind.AppendChild(ber.Encode(ber.ClassApplication, ber.TypePrimitive, ldap.ApplicationUnbindRequest, nil, "Unbind Request"))
+	if _, err := carol.conn.Write(unbind.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); len(sessions.list("carol")) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the session didn't end with an Unbind")
+		}
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	sessions.setTimeouts(&configSessions{IdleTimeout: "100ms"})
+	t.Cleanup(func() { sessions.setTimeouts(&configSessions{}) })
+	c := dialTestServer(t, startTestServer(t, newTestHandler(&config{})))
+
+	// a Notice of Disconnection, and the connection is closed
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	notice, err := ber.ReadPacket(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := notice.Children[0].Value.(int64); id != 0 || notice.Children[1].Tag != ldap.ApplicationExtendedResponse {
+		t.Fatalf("not a Notice of Disconnection: message %d, tag %d", id, notice.Children[1].Tag)
+	}
+	if _, err := ber.ReadPacket(c.conn); err == nil {
+		t.Error("the connection is still open")
+	}
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/metala/ldap"
+)
+
+const (
+	defaultSQLCacheTTL = 30 * time.Second
+	sqlQueryTimeout    = 10 * time.Second
+)
+
+// database/sql driver names of the sql.driver setting
+var sqlDrivers = map[string]string{
+	"sqlite":     "sqlite",
+	"sqlite3":    "sqlite",
+	"postgres":   "postgres",
+	"postgresql": "postgres",
+}
+
+// sqlMigrations are applied in order, each at most once. The statements are
+// plain SQL understood by both SQLite and PostgreSQL. Never edit a released
+// migration, add a new one instead.
+var sqlMigrations = [][]string{
+	// 1: initial schema
+	{
+		`CREATE TABLE authnds_users (
+			name          TEXT PRIMARY KEY,
+			disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+			display_name  TEXT NOT NULL DEFAULT '',
+			given_name    TEXT NOT NULL DEFAULT '',
+			surname       TEXT NOT NULL DEFAULT '',
+			mail          TEXT NOT NULL DEFAULT '',
+			user_password TEXT NOT NULL DEFAULT '',
+			posix_uid     INTEGER NOT NULL DEFAULT 0,
+			posix_gid     INTEGER NOT NULL DEFAULT 0,
+			homedir       TEXT NOT NULL DEFAULT '',
+			login_shell   TEXT NOT NULL DEFAULT '',
+			otp_secret    TEXT NOT NULL DEFAULT '',
+			yubikey       TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE authnds_groups (
+			name        TEXT PRIMARY KEY,
+			description TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE authnds_memberships (
+			user_name  TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			group_name TEXT NOT NULL REFERENCES authnds_groups (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			PRIMARY KEY (user_name, group_name)
+		)`,
+		`CREATE TABLE authnds_ssh_keys (
+			user_name  TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position   INTEGER NOT NULL DEFAULT 0,
+			public_key TEXT NOT NULL
+		)`,
+		`CREATE TABLE authnds_app_passwords (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			sha256    TEXT NOT NULL
+		)`,
+	},
+	// 2: more than one TOTP secret and Yubikey per user
+	{
+		`CREATE TABLE authnds_otp_secrets (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			name      TEXT NOT NULL,
+			secret    TEXT NOT NULL,
+			disabled  BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE TABLE authnds_yubikeys (
+			user_name  TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position   INTEGER NOT NULL DEFAULT 0,
+			yubikey_id TEXT NOT NULL,
+			name       TEXT NOT NULL DEFAULT '',
+			disabled   BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+	},
+	// 3: HOTP secrets and recovery codes
+	{
+		`CREATE TABLE authnds_hotp_secrets (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			name      TEXT NOT NULL,
+			secret    TEXT NOT NULL,
+			disabled  BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE TABLE authnds_recovery_codes (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			hash      TEXT NOT NULL
+		)`,
+	},
+	// 4: push approval
+	{
+		`ALTER TABLE authnds_users ADD COLUMN push BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 5: named app passwords; sources and listeners are comma-separated
+	{
+		`CREATE TABLE authnds_named_app_passwords (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			name      TEXT NOT NULL,
+			password  TEXT NOT NULL,
+			created   TEXT NOT NULL DEFAULT '',
+			expires   TEXT NOT NULL DEFAULT '',
+			sources   TEXT NOT NULL DEFAULT '',
+			listeners TEXT NOT NULL DEFAULT ''
+		)`,
+	},
+	// 6: password policy
+	{
+		`ALTER TABLE authnds_users ADD COLUMN pwd_changed_time TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE authnds_users ADD COLUMN password_expires TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE authnds_users ADD COLUMN password_must_change BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE authnds_password_history (
+			user_name TEXT NOT NULL REFERENCES authnds_users (name) ON DELETE CASCADE ON UPDATE CASCADE,
+			position  INTEGER NOT NULL DEFAULT 0,
+			hash      TEXT NOT NULL
+		)`,
+	},
+	// 7: account validity
+	{
+		`ALTER TABLE authnds_users ADD COLUMN valid_from TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE authnds_users ADD COLUMN valid_until TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+// validateSQLConfig checks the [sql] settings of the sql datastore
+func validateSQLConfig(sqlConfig *configSQL) error {
+	if _, ok := sqlDrivers[sqlConfig.Driver]; !ok {
+		return fmt.Errorf("Unknown sql driver '%s': please use one of 'sqlite' or 'postgres'", sqlConfig.Driver)
+	}
+	available := false
+	for _, driver := range sql.Drivers() {
+		available = available || driver == sqlDrivers[sqlConfig.Driver]
+	}
+	if !available {
+		return fmt.Errorf("The sql driver '%s' is not available on %s/%s", sqlConfig.Driver, runtime.GOOS, runtime.GOARCH)
+	}
+	if len(sqlConfig.DSN) == 0 {
+		return fmt.Errorf("sql.dsn must be set")
+	}
+	if len(sqlConfig.CacheTTL) > 0 {
+		if _, err := time.ParseDuration(sqlConfig.CacheTTL); err != nil {
+			return fmt.Errorf("Invalid sql.cacheTTL: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// openSQL opens the connection pool and applies pending migrations
+func openSQL(sqlConfig *configSQL) (*sql.DB, error) {
+	db, err := sql.Open(sqlDrivers[sqlConfig.Driver], sqlConfig.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if sqlConfig.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(sqlConfig.MaxOpenConns)
+	}
+	if sqlConfig.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(sqlConfig.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if sqlConfig.Migrate {
+		if err := migrateSQL(ctx, db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Migration failed: %s", err.Error())
+		}
+	}
+	return db, nil
+}
+
+// migrateSQL applies the migrations newer than the recorded schema version
+func migrateSQL(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS authnds_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	version := 0
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM authnds_schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for v := version + 1; v <= len(sqlMigrations); v++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, statement := range sqlMigrations[v-1] {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("version %d: %s", v, err.Error())
+			}
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO authnds_schema_migrations (version) VALUES (%d)`, v)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Noticef("Applied database migration %d", v)
+	}
+	return nil
+}
+
+// loadSQLDirectory reads every user and group from the database
+func loadSQLDirectory(db *sql.DB) ([]configUser, []configGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	// read everything in one transaction, for a consistent snapshot
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	users := []configUser{}
+	index := map[string]int{}
+	rows, err := tx.QueryContext(ctx, `SELECT name, disabled, display_name, given_name, surname, mail, user_password,
+		posix_uid, posix_gid, homedir, login_shell, otp_secret, yubikey, push, pwd_changed_time, password_expires, password_must_change,
+		valid_from, valid_until FROM authnds_users ORDER BY name`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		u := configUser{}
+		if err := rows.Scan(&u.CommonName, &u.Disabled, &u.DisplayName, &u.GivenName, &u.Surname, &u.Mail, &u.UserPassword,
+			&u.PosixUserID, &u.PosixGroupID, &u.Homedir, &u.LoginShell, &u.OTPSecret, &u.Yubikey, &u.Push,
+			&u.PwdChangedTime, &u.PasswordExpires, &u.PasswordMustChange, &u.ValidFrom, &u.ValidUntil); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		index[u.CommonName] = len(users)
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	groups := []configGroup{}
+	rows, err = tx.QueryContext(ctx, `SELECT name, description FROM authnds_groups ORDER BY name`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		g := configGroup{}
+		if err := rows.Scan(&g.CommonName, &g.Description); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Memberships, SSH keys, app passwords, recovery codes and password
+	// history are all (user, value) pairs
+	lists := []struct {
+		query string
+		add   func(u *configUser, value string)
+	}{
+		{`SELECT user_name, group_name FROM authnds_memberships ORDER BY user_name, group_name`,
+			func(u *configUser, value string) { u.GroupNames = append(u.GroupNames, value) }},
+		{`SELECT user_name, public_key FROM authnds_ssh_keys ORDER BY user_name, position`,
+			func(u *configUser, value string) { u.SSHKeys = append(u.SSHKeys, value) }},
+		{`SELECT user_name, sha256 FROM authnds_app_passwords ORDER BY user_name, position`,
+			func(u *configUser, value string) { u.PassAppSHA256 = append(u.PassAppSHA256, strings.ToLower(value)) }},
+		{`SELECT user_name, hash FROM authnds_recovery_codes ORDER BY user_name, position`,
+			func(u *configUser, value string) { u.RecoveryCodes = append(u.RecoveryCodes, value) }},
+		{`SELECT user_name, hash FROM authnds_password_history ORDER BY user_name, position`,
+			func(u *configUser, value string) { u.PasswordHistory = append(u.PasswordHistory, value) }},
+	}
+	for _, list := range lists {
+		rows, err := tx.QueryContext(ctx, list.query)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var userName, value string
+			if err := rows.Scan(&userName, &value); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if i, ok := index[userName]; ok {
+				list.add(&users[i], value)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// TOTP and HOTP secrets
+	secretLists := []struct {
+		table string
+		add   func(u *configUser, secret configUserOTPSecret)
+	}{
+		{"authnds_otp_secrets", func(u *configUser, secret configUserOTPSecret) { u.OTPSecrets = append(u.OTPSecrets, secret) }},
+		{"authnds_hotp_secrets", func(u *configUser, secret configUserOTPSecret) { u.HOTPSecrets = append(u.HOTPSecrets, secret) }},
+	}
+	for _, list := range secretLists {
+		rows, err := tx.QueryContext(ctx, `SELECT user_name, name, secret, disabled FROM `+list.table+` ORDER BY user_name, position`)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var userName string
+			secret := configUserOTPSecret{}
+			if err := rows.Scan(&userName, &secret.Name, &secret.Secret, &secret.Disabled); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if i, ok := index[userName]; ok {
+				list.add(&users[i], secret)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT user_name, name, password, created, expires, sources, listeners
+		FROM authnds_named_app_passwords ORDER BY user_name, position`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var userName, sources, listeners string
+		appPassword := configUserAppPassword{}
+		if err := rows.Scan(&userName, &appPassword.Name, &appPassword.Password, &appPassword.Created, &appPassword.Expires, &sources, &listeners); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		appPassword.Sources, appPassword.Listeners = splitSQLList(sources), splitSQLList(listeners)
+		if i, ok := index[userName]; ok {
+			users[i].AppPasswords = append(users[i].AppPasswords, appPassword)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT user_name, yubikey_id, name, disabled FROM authnds_yubikeys ORDER BY user_name, position`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var userName string
+		yubikey := configUserYubikey{}
+		if err := rows.Scan(&userName, &yubikey.ID, &yubikey.Name, &yubikey.Disabled); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if i, ok := index[userName]; ok {
+			users[i].Yubikeys = append(users[i].Yubikeys, yubikey)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return users, groups, nil
+}
+
+// splitSQLList splits a comma-separated column into its values
+func splitSQLList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// sqlHandler serves the users and groups of a SQL database. They are loaded
+// into a configHandler, so entries look exactly like those of the config
+// file, and reloaded in the background once older than the cache TTL; binds
+// and searches never wait for the database.
+type sqlHandler struct {
+	cfg     *config
+	yubikey yubikeyValidator
+	db      *sql.DB
+	ttl     time.Duration
+
+	mu         sync.Mutex
+	current    Backend
+	loaded     time.Time
+	refreshing bool
+	// refreshes are numbered, so a slow one can't replace a newer snapshot
+	started   int
+	installed int
+}
+
+func newSQLHandler(cfg *config, yubikey yubikeyValidator) (*sqlHandler, error) {
+	db, err := openSQL(&cfg.SQL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s database: %s", cfg.SQL.Driver, err.Error())
+	}
+	h := &sqlHandler{cfg: cfg, yubikey: yubikey, db: db, ttl: defaultSQLCacheTTL}
+	if len(cfg.SQL.CacheTTL) > 0 {
+		h.ttl, _ = time.ParseDuration(cfg.SQL.CacheTTL)
+	}
+	if len(cfg.Users) > 0 || len(cfg.Groups) > 0 {
+		log.Warning("The sql datastore ignores the users and groups of the config file")
+	}
+	if err := h.refresh(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to load users and groups: %s", err.Error())
+	}
+	return h, nil
+}
+
+// refresh replaces the snapshot of the users and groups
+func (h *sqlHandler) refresh() error {
+	h.mu.Lock()
+	h.started++
+	refresh := h.started
+	h.mu.Unlock()
+
+	users, groups, err := loadSQLDirectory(h.db)
+	if err != nil {
+		return err
+	}
+	snapshot := *h.cfg
+	snapshot.Users = users
+	snapshot.Groups = groups
+	snapshot.userSources = nil
+	snapshot.groupSources = nil
+
+	h.mu.Lock()
+	if refresh > h.installed {
+		h.current = configHandler{cfg: &snapshot, yubikey: h.yubikey, store: sqlStore{h}}
+		h.loaded = time.Now()
+		h.installed = refresh
+	}
+	h.mu.Unlock()
+	log.Debugf("Loaded %d users and %d groups from the database", len(users), len(groups))
+	return nil
+}
+
+// handler returns the current snapshot, starting a refresh if it has expired.
+// Until the refresh completes, or when it fails, the old snapshot is used.
+func (h *sqlHandler) handler() Backend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.loaded) > h.ttl && !h.refreshing {
+		h.refreshing = true
+		go func() {
+			err := h.refresh()
+			h.mu.Lock()
+			if err != nil {
+				log.Warningf("Unable to reload users and groups from the database, keeping the cached copy: %s", err.Error())
+				// retry after another TTL rather than on every request
+				h.loaded = time.Now()
+			}
+			h.refreshing = false
+			h.mu.Unlock()
+		}()
+	}
+	return h.current
+}
+
+func (h *sqlHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().Bind(bindDN, bindSimplePw, conn)
+}
+
+func (h *sqlHandler) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	return h.handler().Search(boundDN, searchReq, conn)
+}
+
+func (h *sqlHandler) Add(boundDN string, req ldap.AddRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().Add(boundDN, req, conn)
+}
+
+func (h *sqlHandler) Modify(boundDN string, req ldap.ModifyRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().Modify(boundDN, req, conn)
+}
+
+func (h *sqlHandler) Delete(boundDN string, deleteDN string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().Delete(boundDN, deleteDN, conn)
+}
+
+func (h *sqlHandler) ModifyDN(boundDN string, req ldap.ModifyDNRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().ModifyDN(boundDN, req, conn)
+}
+
+func (h *sqlHandler) Compare(boundDN string, req ldap.CompareRequest, conn net.Conn) (ldap.LDAPResultCode, error) {
+	return h.handler().Compare(boundDN, req, conn)
+}
+
+func (h *sqlHandler) Close(boundDN string, conn net.Conn) error {
+	return h.handler().Close(boundDN, conn)
+}
+
+// close releases the connection pool, once the handler has been replaced
+func (h *sqlHandler) close() error {
+	return h.db.Close()
+}
+
+// rebind numbers the ? placeholders of a query for PostgreSQL
+func (h *sqlHandler) rebind(query string) string {
+	if sqlDrivers[h.cfg.SQL.Driver] != "postgres" {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&out, "$%d", n)
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// sqlStore saves LDAP writes to the database, then refreshes the snapshot.
+// App passwords and second factors can't be written over LDAP and are kept as
+// they are.
+type sqlStore struct {
+	h *sqlHandler
+}
+
+func (s sqlStore) apply(changes directoryChanges) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	tx, err := s.h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.ExecContext(ctx, s.h.rebind(query), args...)
+		}
+	}
+
+	// Groups first, so memberships can refer to them; deleted groups last.
+	// Child rows are updated explicitly, as SQLite only enforces foreign keys
+	// (and cascades) with _pragma=foreign_keys(1).
+	for _, c := range changes.groups {
+		switch {
+		case c.group == nil:
+			continue
+		case len(c.name) == 0:
+			exec(`INSERT INTO authnds_groups (name, description) VALUES (?, ?)`, c.group.CommonName, c.group.Description)
+		default:
+			exec(`UPDATE authnds_groups SET name = ?, description = ? WHERE name = ?`, c.group.CommonName, c.group.Description, c.name)
+		}
+	}
+	for _, c := range changes.users {
+		if len(c.name) > 0 {
+			exec(`DELETE FROM authnds_memberships WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_ssh_keys WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_password_history WHERE user_name = ?`, c.name)
+		}
+		if c.user == nil {
+			exec(`DELETE FROM authnds_app_passwords WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_otp_secrets WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_yubikeys WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_hotp_secrets WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_recovery_codes WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_named_app_passwords WHERE user_name = ?`, c.name)
+			exec(`DELETE FROM authnds_users WHERE name = ?`, c.name)
+			continue
+		}
+		u := c.user
+		if len(c.name) == 0 {
+			exec(`INSERT INTO authnds_users (name, disabled, display_name, given_name, surname, mail, user_password,
+				posix_uid, posix_gid, homedir, login_shell, otp_secret, yubikey, push, pwd_changed_time, password_expires,
+				password_must_change, valid_from, valid_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				u.CommonName, u.Disabled, u.DisplayName, u.GivenName, u.Surname, u.Mail, u.UserPassword,
+				u.PosixUserID, u.PosixGroupID, u.Homedir, u.LoginShell, u.OTPSecret, u.Yubikey, u.Push, u.PwdChangedTime,
+				u.PasswordExpires, u.PasswordMustChange, u.ValidFrom, u.ValidUntil)
+		} else {
+			exec(`UPDATE authnds_users SET name = ?, disabled = ?, display_name = ?, given_name = ?, surname = ?, mail = ?,
+				user_password = ?, posix_uid = ?, posix_gid = ?, homedir = ?, login_shell = ?, pwd_changed_time = ?,
+				password_expires = ?, password_must_change = ? WHERE name = ?`,
+				u.CommonName, u.Disabled, u.DisplayName, u.GivenName, u.Surname, u.Mail,
+				u.UserPassword, u.PosixUserID, u.PosixGroupID, u.Homedir, u.LoginShell, u.PwdChangedTime,
+				u.PasswordExpires, u.PasswordMustChange, c.name)
+			exec(`UPDATE authnds_app_passwords SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+			exec(`UPDATE authnds_otp_secrets SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+			exec(`UPDATE authnds_yubikeys SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+			exec(`UPDATE authnds_hotp_secrets SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+			exec(`UPDATE authnds_recovery_codes SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+			exec(`UPDATE authnds_named_app_passwords SET user_name = ? WHERE user_name = ?`, u.CommonName, c.name)
+		}
+		for _, group := range u.GroupNames {
+			exec(`INSERT INTO authnds_memberships (user_name, group_name) VALUES (?, ?)`, u.CommonName, group)
+		}
+		for i, key := range u.SSHKeys {
+			exec(`INSERT INTO authnds_ssh_keys (user_name, position, public_key) VALUES (?, ?, ?)`, u.CommonName, i, key)
+		}
+		for i, hash := range u.PasswordHistory {
+			exec(`INSERT INTO authnds_password_history (user_name, position, hash) VALUES (?, ?, ?)`, u.CommonName, i, hash)
+		}
+	}
+	for _, c := range changes.groups {
+		if c.group == nil {
+			exec(`DELETE FROM authnds_memberships WHERE group_name = ?`, c.name)
+			exec(`DELETE FROM authnds_groups WHERE name = ?`, c.name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.h.refresh()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSQLConfig(t *testing.T) *config {
+	return &config{
+		Backend: configBackend{BaseDN: testBaseDN, Datastore: "sql"},
+		SQL: configSQL{
+			Driver:  "sqlite",
+			DSN:     filepath.Join(t.TempDir(), "users.db") + "?_pragma=foreign_keys(1)",
+			Migrate: true,
+		},
+	}
+}
+
+func newTestSQLHandler(t *testing.T, cfg *config) *sqlHandler {
+	h, err := newSQLHandler(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.close() })
+	return h
+}
+
+func TestSQLMigrations(t *testing.T) {
+	cfg := newTestSQLConfig(t)
+	for _, run := range []string{"first", "again"} {
+		db, err := openSQL(&cfg.SQL)
+		if err != nil {
+			t.Fatalf("%s: %s", run, err.Error())
+		}
+		var version, applied int
+		if err := db.QueryRow(`SELECT MAX(version), COUNT(*) FROM authnds_schema_migrations`).Scan(&version, &applied); err != nil {
+			t.Fatalf("%s: %s", run, err.Error())
+		}
+		if version != len(sqlMigrations) || applied != len(sqlMigrations) {
+			t.Errorf("%s: schema version %d with %d migrations, want %d", run, version, applied, len(sqlMigrations))
+		}
+		// the columns and tables of the latest migrations are there
+		if _, err := db.Exec(`SELECT valid_from, valid_until, password_must_change FROM authnds_users`); err != nil {
+			t.Errorf("%s: %s", run, err.Error())
+		}
+		if _, err := db.Exec(`SELECT user_name, position, hash FROM authnds_password_history`); err != nil {
+			t.Errorf("%s: %s", run, err.Error())
+		}
+		db.Close()
+	}
+}
+
+func TestSQLWithoutMigrations(t *testing.T) {
+	cfg := newTestSQLConfig(t)
+	cfg.SQL.Migrate = false
+	if _, err := newSQLHandler(cfg, nil); err == nil {
+		t.Error("loaded users from a database without the schema")
+	}
+}
+
+func TestSQLUserGroupCRUD(t *testing.T) {
+	h := newTestSQLHandler(t, newTestSQLConfig(t))
+	store := sqlStore{h}
+	alice := configUser{
+		CommonName:   "alice",
+		UserPassword: testPasswordHash,
+		PosixUserID:  5001,
+		PosixGroupID: 5000,
+		Mail:         "alice@example.com",
+		GroupNames:   []string{"staff"},
+		SSHKeys:      []string{"ssh-ed25519 AAAA alice"},
+		ValidUntil:   "2100-01-01",
+	}
+	renamed := alice
+	renamed.CommonName = "alicia"
+	renamed.GroupNames = []string{"admins", "staff"}
+	renamed.PasswordHistory = []string{testPasswordHash}
+	renamed.ValidUntil = "2100-01-01" // not written by updates
+
+	tests := []struct {
+		name    string
+		changes directoryChanges
+		users   []configUser
+		groups  []configGroup
+	}{
+		{
+			name: "add",
+			changes: directoryChanges{
+				groups: []groupChange{{"", &configGroup{CommonName: "staff", Description: "Staff"}}},
+				users:  []userChange{{"", &alice}},
+			},
+			users:  []configUser{alice},
+			groups: []configGroup{{CommonName: "staff", Description: "Staff"}},
+		},
+		{
+			name: "modify and rename",
+			changes: directoryChanges{
+				groups: []groupChange{{"", &configGroup{CommonName: "admins"}}},
+				users:  []userChange{{"alice", &renamed}},
+			},
+			users:  []configUser{renamed},
+			groups: []configGroup{{CommonName: "admins"}, {CommonName: "staff", Description: "Staff"}},
+		},
+		{
+			name: "delete",
+			changes: directoryChanges{
+				groups: []groupChange{{"admins", nil}},
+				users:  []userChange{{"alicia", nil}},
+			},
+			users:  []configUser{},
+			groups: []configGroup{{CommonName: "staff", Description: "Staff"}},
+		},
+	}
+	for _, test := range tests {
+		if err := store.apply(test.changes); err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		users := directoryUsers(h)
+		if !reflect.DeepEqual(users, test.users) {
+			t.Errorf("%s: users\n%+v\nwant\n%+v", test.name, users, test.users)
+		}
+		if groups := h.handler().(configHandler).cfg.Groups; !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("%s: groups %+v, want %+v", test.name, groups, test.groups)
+		}
+	}
+}
+
+func TestSQLCacheTTL(t *testing.T) {
+	cfg := newTestSQLConfig(t)
+	cfg.SQL.CacheTTL = "1h"
+	h := newTestSQLHandler(t, cfg)
+	if _, err := h.db.ExecContext(context.Background(), `INSERT INTO authnds_users (name) VALUES ('bob')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if users := directoryUsers(h); len(users) != 0 {
+		t.Fatalf("users %+v read before the cache TTL", users)
+	}
+	h.mu.Lock()
+	h.loaded = time.Now().Add(-2 * time.Hour)
+	h.mu.Unlock()
+	// the expired snapshot is served while it is refreshed
+	if users := directoryUsers(h); len(users) != 0 {
+		t.Fatalf("users %+v read without waiting for the refresh", users)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(directoryUsers(h)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the expired snapshot was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if users := directoryUsers(h); users[0].CommonName != "bob" {
+		t.Errorf("users %+v after the refresh", users)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !(windows && 386)
+// +build !windows !386
+
+package main
+
+// The pure-Go SQLite driver, which doesn't support 32-bit Windows
+import _ "modernc.org/sqlite"
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// syslog facilities by name, see RFC 5424 section 6.2.1
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslog severities of the go-logging levels
+var syslogSeverities = map[logging.Level]int{
+	logging.CRITICAL: 2,
+	logging.ERROR:    3,
+	logging.WARNING:  4,
+	logging.NOTICE:   5,
+	logging.INFO:     6,
+	logging.DEBUG:    7,
+}
+
+// How many messages wait for the remote syslog server before new ones are
+// dropped, and how long connecting and writing to it may take
+const (
+	remoteSyslogQueueSize = 1000
+	remoteSyslogTimeout   = 5 * time.Second
+)
+
+// remoteSyslogBackend sends RFC 5424 messages to a remote syslog server over
+// UDP, TCP or TLS. Stream transports use octet-counting framing (RFC 6587).
+// Messages are queued and sent by a single writer, so a slow or unreachable
+// server never holds up logging: when the queue is full, they are dropped.
+type remoteSyslogBackend struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	appName   string
+	timeout   time.Duration
+
+	queue   chan []byte
+	dropped uint64 // atomic, messages dropped since the last one sent
+
+	// used by the writer only
+	conn    net.Conn
+	retryAt time.Time
+}
+
+func newRemoteSyslogBackend(syslogConfig *configRemoteSyslog) (*remoteSyslogBackend, error) {
+	facility, ok := syslogFacilities[syslogConfig.Facility]
+	if !ok {
+		return nil, fmt.Errorf("Unknown syslog facility '%s'", syslogConfig.Facility)
+	}
+	b := &remoteSyslogBackend{
+		network:  syslogConfig.Network,
+		address:  syslogConfig.Address,
+		facility: facility,
+		appName:  filepath.Base(os.Args[0]),
+		timeout:  remoteSyslogTimeout,
+		queue:    make(chan []byte, remoteSyslogQueueSize),
+	}
+	if b.hostname, _ = os.Hostname(); len(b.hostname) == 0 {
+		b.hostname = "-"
+	}
+
+	switch b.network {
+	case "udp", "tcp":
+	case "tls":
+		b.tlsConfig = &tls.Config{}
+		if len(syslogConfig.CA) > 0 {
+			pem, err := ioutil.ReadFile(syslogConfig.CA)
+			if err != nil {
+				return nil, err
+			}
+			b.tlsConfig.RootCAs = x509.NewCertPool()
+			if !b.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in %s", syslogConfig.CA)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown syslog network '%s': please use one of 'udp', 'tcp' or 'tls'", b.network)
+	}
+
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *remoteSyslogBackend) connect() error {
+	var err error
+	dialer := &net.Dialer{Timeout: b.timeout}
+	if b.network == "tls" {
+		b.conn, err = tls.DialWithDialer(dialer, "tcp", b.address, b.tlsConfig)
+	} else {
+		b.conn, err = dialer.Dial(b.network, b.address)
+	}
+	return err
+}
+
+// frame builds the RFC 5424 message of a record
+func (b *remoteSyslogBackend) frame(level logging.Level, message string) []byte {
+	severity, ok := syslogSeverities[level]
+	if !ok {
+		severity = syslogSeverities[logging.INFO]
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "<%d>1 %s %s %s %d - - %s",
+		b.facility*8+severity,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		b.hostname, b.appName, os.Getpid(), message)
+	if b.network == "udp" {
+		return msg.Bytes()
+	}
+	return append([]byte(fmt.Sprintf("%d ", msg.Len())), msg.Bytes()...)
+}
+
+// Log queues a record for the writer, or drops it when the queue is full
+func (b *remoteSyslogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	select {
+	case b.queue <- b.frame(level, rec.Formatted(calldepth+1)):
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+	return nil
+}
+
+// run is the writer: it sends the queued messages in order, and reports
+// those that were dropped once it can send again
+func (b *remoteSyslogBackend) run() {
+	for frame := range b.queue {
+		if !b.write(frame) {
+			atomic.AddUint64(&b.dropped, 1)
+			continue
+		}
+		if dropped := atomic.SwapUint64(&b.dropped, 0); dropped > 0 {
+			b.write(b.frame(logging.WARNING, fmt.Sprintf("%d log messages were dropped", dropped)))
+		}
+	}
+}
+
+// write sends a message, reconnecting once if the connection was lost. While
+// the server is unreachable, messages are dropped without waiting for it.
+func (b *remoteSyslogBackend) write(frame []byte) bool {
+	if b.conn != nil {
+		b.conn.SetWriteDeadline(time.Now().Add(b.timeout))
+		if _, err := b.conn.Write(frame); err == nil {
+			return true
+		}
+		b.conn.Close()
+		b.conn = nil
+	}
+	if time.Now().Before(b.retryAt) {
+		return false
+	}
+	if err := b.connect(); err != nil {
+		b.conn = nil
+		b.retryAt = time.Now().Add(b.timeout)
+		return false
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(b.timeout))
+	_, err := b.conn.Write(frame)
+	return err == nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// syslogTestLogger logs through b with the message as the only format
+func syslogTestLogger(b *remoteSyslogBackend) *logging.Logger {
+	logger := logging.MustGetLogger("syslogtest")
+	logger.SetBackend(logging.AddModuleLevel(logging.NewBackendFormatter(b, logging.MustStringFormatter("%{message}"))))
+	return logger
+}
+
+// readSyslogFrame reads an octet-counted message and returns its text
+func readSyslogFrame(t *testing.T, r *bufio.Reader) string {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatal(err)
+	}
+	return string(msg)
+}
+
+func TestRemoteSyslogDelivery(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	b, err := newRemoteSyslogBackend(&configRemoteSyslog{Network: "tcp", Address: listener.Addr().String(), Facility: "local0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	logger := syslogTestLogger(b)
+	logger.Warning("first")
+	logger.Info("second")
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"<132>1 ", "<134>1 "} {
+		if msg := readSyslogFrame(t, r); !strings.HasPrefix(msg, want) {
+			t.Errorf("message %q, want the priority %q", msg, want)
+		}
+	}
+}
+
+func TestRemoteSyslogDropped(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// the writer isn't running yet, so the queue fills up
+	b := &remoteSyslogBackend{network: "tcp", hostname: "-", appName: "authnds", timeout: time.Second, queue: make(chan []byte, 1), conn: server}
+	logger := syslogTestLogger(b)
+	start := time.Now()
+	for _, message := range []string{"kept", "dropped", "dropped"} {
+		logger.Info(message)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("logging to a full queue took %v", elapsed)
+	}
+
+	go b.run()
+	defer close(b.queue)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+	for _, want := range []string{" kept", " 2 log messages were dropped"} {
+		if msg := readSyslogFrame(t, r); !strings.HasSuffix(msg, want) {
+			t.Errorf("message %q, want %q", msg, want)
+		}
+	}
+}
+
+func TestRemoteSyslogWriteDeadline(t *testing.T) {
+	// a server that doesn't read, and can't be reached again
+	client, server := net.Pipe()
+	defer client.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	b := &remoteSyslogBackend{network: "tcp", address: address, hostname: "-", appName: "authnds", timeout: 50 * time.Millisecond, conn: server}
+	start := time.Now()
+	if b.write(b.frame(logging.INFO, "stalled")) {
+		t.Error("wrote to a server that doesn't read")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the write took %v", elapsed)
+	}
+	// until the retry, messages are dropped without connecting
+	if b.write(b.frame(logging.INFO, "dropped")) || b.conn != nil {
+		t.Error("reconnected before the retry")
+	}
+}
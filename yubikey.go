@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/GeertJohan/yubigo"
+)
+
+// Yubikey OTP validation modes, the values of yubikey.validation
+const (
+	yubikeyValidationCloud   = "yubicloud"
+	yubikeyValidationServers = "servers"
+	yubikeyValidationLocal   = "local"
+)
+
+// A Yubico OTP is the 12 modhex characters of the public ID of the key,
+// followed by a 16 byte AES block in modhex
+const (
+	yubikeyPublicIDLength = 12
+	yubikeyOTPLength      = 44
+)
+
+// modhex is the hex alphabet of Yubikeys, which types the same on most
+// keyboard layouts
+const modhexAlphabet = "cbdefghijklnrtuv"
+
+// yubikeyValidator checks Yubico OTPs
+type yubikeyValidator interface {
+	verify(otp string) (bool, error)
+	// the validation servers, probed by /readyz
+	servers() []string
+}
+
+// newYubikeyValidator returns the validator selected by yubikey.validation,
+// or nil when Yubikey OTPs are not configured
+func newYubikeyValidator(cfg *config) (yubikeyValidator, error) {
+	switch cfg.Yubikey.Validation {
+	case yubikeyValidationLocal:
+		v := &localYubikeyValidator{counterFile: cfg.Yubikey.CounterFile}
+		if err := v.setKeys(&cfg.Yubikey); err != nil {
+			return nil, err
+		}
+		if err := v.load(); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case yubikeyValidationServers:
+		auth, err := yubigo.NewYubiAuth(cfg.YubikeyClientID, cfg.YubikeySecret)
+		if err != nil {
+			return nil, err
+		}
+		u, _ := url.Parse(cfg.Yubikey.Servers[0])
+		auth.UseHttps(u.Scheme == "https")
+		servers := []string{}
+		for _, server := range cfg.Yubikey.Servers {
+			servers = append(servers, strings.TrimPrefix(server, u.Scheme+"://"))
+		}
+		auth.SetApiServerList(servers...)
+		return yubicoValidator{auth, cfg.Yubikey.Servers}, nil
+	}
+	if len(cfg.YubikeyClientID) == 0 || len(cfg.YubikeySecret) == 0 {
+		return nil, nil
+	}
+	auth, err := yubigo.NewYubiAuth(cfg.YubikeyClientID, cfg.YubikeySecret)
+	if err != nil {
+		return nil, err
+	}
+	servers := []string{}
+	for _, server := range auth.GetApiServerList() {
+		servers = append(servers, "https://"+server)
+	}
+	return yubicoValidator{auth, servers}, nil
+}
+
+// validateYubikeyConfig checks the [yubikey] settings
+func validateYubikeyConfig(cfg *config) error {
+	switch cfg.Yubikey.Validation {
+	case "", yubikeyValidationCloud:
+	case yubikeyValidationServers:
+		if len(cfg.YubikeyClientID) == 0 || len(cfg.YubikeySecret) == 0 {
+			return fmt.Errorf("yubikey.validation = \"servers\" requires yubikeyClientID and yubikeySecret")
+		}
+		if len(cfg.Yubikey.Servers) == 0 {
+			return fmt.Errorf("yubikey.validation = \"servers\" requires a list of yubikey.servers")
+		}
+		scheme := ""
+		for _, server := range cfg.Yubikey.Servers {
+			u, err := url.Parse(server)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+				return fmt.Errorf("Invalid yubikey.servers URL '%s': please use e.g. https://yubikey-val.example.com/wsapi/2.0/verify", server)
+			}
+			if len(scheme) > 0 && u.Scheme != scheme {
+				return fmt.Errorf("yubikey.servers must all use http or all use https")
+			}
+			scheme = u.Scheme
+		}
+	case yubikeyValidationLocal:
+		if len(cfg.Yubikey.CounterFile) == 0 {
+			return fmt.Errorf("yubikey.validation = \"local\" requires a yubikey.counterFile to keep OTPs from being replayed")
+		}
+		if _, err := loadYubikeyKeys(&cfg.Yubikey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown yubikey.validation '%s': please use one of 'yubicloud', 'servers' or 'local'", cfg.Yubikey.Validation)
+	}
+	return nil
+}
+
+// yubicoValidator checks OTPs with YubiCloud, or with yubikey-val servers
+type yubicoValidator struct {
+	auth *yubigo.YubiAuth
+	urls []string
+}
+
+func (v yubicoValidator) verify(otp string) (bool, error) {
+	_, ok, err := v.auth.Verify(otp)
+	return ok, err
+}
+
+func (v yubicoValidator) servers() []string {
+	return v.urls
+}
+
+// yubikeyKey is the secret of a Yubikey, as programmed into its OTP slot
+type yubikeyKey struct {
+	privateID []byte
+	aesKey    []byte
+}
+
+// yubikeyCounter is the position of the last accepted OTP of a Yubikey. The
+// use counter increases when the key is plugged in, the session counter with
+// each OTP of the same use.
+type yubikeyCounter struct {
+	UseCounter     uint16 `json:"useCounter"`
+	SessionCounter uint8  `json:"sessionCounter"`
+}
+
+func (c yubikeyCounter) after(last yubikeyCounter) bool {
+	return c.UseCounter > last.UseCounter || (c.UseCounter == last.UseCounter && c.SessionCounter > last.SessionCounter)
+}
+
+// localYubikeyValidator decrypts OTPs with the AES keys of the config, the
+// way a Yubico key server does. The counters of the last OTP of each key are
+// saved to counterFile before an OTP is accepted, so none can be replayed,
+// even after a restart.
+type localYubikeyValidator struct {
+	counterFile string
+
+	mu       sync.Mutex
+	keys     map[string]yubikeyKey
+	counters map[string]yubikeyCounter
+}
+
+// setKeys replaces the keys, e.g. on a reload; counters are kept
+func (v *localYubikeyValidator) setKeys(yubikeyConfig *configYubikey) error {
+	keys, err := loadYubikeyKeys(yubikeyConfig)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// load reads the counters saved by a previous run
+func (v *localYubikeyValidator) load() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.counters = map[string]yubikeyCounter{}
+	data, err := ioutil.ReadFile(v.counterFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &v.counters); err != nil {
+		return fmt.Errorf("Invalid Yubikey counter file %s: %s", v.counterFile, err.Error())
+	}
+	return nil
+}
+
+// save writes the counters
+func (v *localYubikeyValidator) save() error {
+	return saveJSONFile(v.counterFile, v.counters)
+}
+
+func (v *localYubikeyValidator) verify(otp string) (bool, error) {
+	if len(otp) != yubikeyOTPLength {
+		return false, fmt.Errorf("OTP is not %d characters long", yubikeyOTPLength)
+	}
+	publicID := strings.ToLower(otp[:yubikeyPublicIDLength])
+	token, err := modhexDecode(otp[yubikeyPublicIDLength:])
+	if err != nil {
+		return false, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[publicID]
+	if !ok {
+		return false, fmt.Errorf("no AES key for Yubikey %s", publicID)
+	}
+	block, err := aes.NewCipher(key.aesKey)
+	if err != nil {
+		return false, err
+	}
+	plain := make([]byte, aes.BlockSize)
+	block.Decrypt(plain, token)
+	// the CRC of the block, CRC included, is a constant when it's intact
+	if crc16(plain) != 0xf0b8 {
+		return false, fmt.Errorf("OTP of Yubikey %s fails the CRC check", publicID)
+	}
+	if !bytes.Equal(plain[:6], key.privateID) {
+		return false, fmt.Errorf("OTP of Yubikey %s has the wrong private ID", publicID)
+	}
+
+	// the top bit of the use counter is a flag
+	counter := yubikeyCounter{
+		UseCounter:     (uint16(plain[6]) | uint16(plain[7])<<8) & 0x7fff,
+		SessionCounter: plain[11],
+	}
+	if !counter.after(v.counters[publicID]) {
+		return false, fmt.Errorf("OTP of Yubikey %s was already used", publicID)
+	}
+	last, seen := v.counters[publicID]
+	v.counters[publicID] = counter
+	if err := v.save(); err != nil {
+		// don't accept an OTP that could be replayed after a restart
+		if seen {
+			v.counters[publicID] = last
+		} else {
+			delete(v.counters, publicID)
+		}
+		return false, fmt.Errorf("unable to save Yubikey counters: %s", err.Error())
+	}
+	return true, nil
+}
+
+func (v *localYubikeyValidator) servers() []string {
+	return nil
+}
+
+// loadYubikeyKeys reads the keys of yubikey.keys and yubikey.keyFile, by
+// public ID. The key file has a "publicID,privateID,aesKey" line per key,
+// and may have # comments.
+func loadYubikeyKeys(yubikeyConfig *configYubikey) (map[string]yubikeyKey, error) {
+	entries := yubikeyConfig.Keys
+	if len(yubikeyConfig.KeyFile) > 0 {
+		f, err := os.Open(yubikeyConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read yubikey.keyFile: %s", err.Error())
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if len(text) == 0 || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Split(text, ",")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: expected publicID,privateID,aesKey", yubikeyConfig.KeyFile, line)
+			}
+			entries = append(entries, configYubikeyKey{
+				PublicID:  strings.TrimSpace(fields[0]),
+				PrivateID: strings.TrimSpace(fields[1]),
+				AESKey:    strings.TrimSpace(fields[2]),
+			})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := map[string]yubikeyKey{}
+	for _, entry := range entries {
+		entry.PublicID = strings.ToLower(entry.PublicID)
+		if _, err := modhexDecode(entry.PublicID); err != nil || len(entry.PublicID) != yubikeyPublicIDLength {
+			return nil, fmt.Errorf("Invalid Yubikey public ID '%s': expected %d modhex characters", entry.PublicID, yubikeyPublicIDLength)
+		}
+		if _, ok := keys[entry.PublicID]; ok {
+			return nil, fmt.Errorf("Yubikey '%s' has more than one key", entry.PublicID)
+		}
+		privateID, err := hex.DecodeString(entry.PrivateID)
+		if err != nil || len(privateID) != 6 {
+			return nil, fmt.Errorf("Invalid private ID of Yubikey '%s': expected 12 hex characters", entry.PublicID)
+		}
+		aesKey, err := hex.DecodeString(entry.AESKey)
+		if err != nil || len(aesKey) != 16 {
+			return nil, fmt.Errorf("Invalid AES key of Yubikey '%s': expected 32 hex characters", entry.PublicID)
+		}
+		keys[entry.PublicID] = yubikeyKey{privateID, aesKey}
+	}
+	return keys, nil
+}
+
+// modhexDecode decodes modhex, such as the token of an OTP
+func modhexDecode(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("modhex has an odd length")
+	}
+	out := make([]byte, len(s)/2)
+	for i := 0; i < len(s); i++ {
+		n := strings.IndexByte(modhexAlphabet, s[i]|0x20)
+		if n == -1 {
+			return nil, fmt.Errorf("invalid modhex character '%c'", s[i])
+		}
+		out[i/2] = out[i/2]<<4 | byte(n)
+	}
+	return out, nil
+}
+
+// crc16 is the ISO 13239 CRC of Yubikey OTPs
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			odd := crc&1 != 0
+			crc >>= 1
+			if odd {
+				crc ^= 0x8408
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/metala/ldap"
+)
+
+const (
+	testYubikeyID        = "cccccbdefghi"
+	testYubikeyPrivateID = "0102030405a6"
+	testYubikeyAESKey    = "000102030405060708090a0b0c0d0e0f"
+)
+
+// yubikeyOTP returns the OTP a Yubikey programmed with privateID and aesKey
+// types at a use and session counter
+func yubikeyOTP(publicID, privateID, aesKey string, use uint16, session uint8) string {
+	plain := make([]byte, aes.BlockSize)
+	id, _ := hex.DecodeString(privateID)
+	copy(plain, id)
+	plain[6], plain[7] = byte(use), byte(use>>8)
+	plain[11] = session
+	crc := ^crc16(plain[:14])
+	plain[14], plain[15] = byte(crc), byte(crc>>8)
+
+	key, _ := hex.DecodeString(aesKey)
+	block, _ := aes.NewCipher(key)
+	token := make([]byte, aes.BlockSize)
+	block.Encrypt(token, plain)
+	otp := []byte(publicID)
+	for _, b := range token {
+		otp = append(otp, modhexAlphabet[b>>4], modhexAlphabet[b&0xf])
+	}
+	return string(otp)
+}
+
+// newTestYubikeyValidator validates the OTPs of the test key, keeping its
+// counters in counterFile
+func newTestYubikeyValidator(t *testing.T, counterFile string) *localYubikeyValidator {
+	v, err := newYubikeyValidator(&config{Yubikey: configYubikey{
+		Validation:  yubikeyValidationLocal,
+		Keys:        []configYubikeyKey{{PublicID: testYubikeyID, PrivateID: testYubikeyPrivateID, AESKey: testYubikeyAESKey}},
+		CounterFile: counterFile,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.(*localYubikeyValidator)
+}
+
+func TestValidateYubikeyConfig(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.csv")
+	if err := ioutil.WriteFile(keyFile, []byte("# publicID,privateID,aesKey\n"+testYubikeyID+","+testYubikeyPrivateID+","+testYubikeyAESKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badKeyFile := filepath.Join(t.TempDir(), "keys.csv")
+	if err := ioutil.WriteFile(badKeyFile, []byte(testYubikeyID+","+testYubikeyPrivateID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := configYubikeyKey{PublicID: testYubikeyID, PrivateID: testYubikeyPrivateID, AESKey: testYubikeyAESKey}
+	local := func(keys ...configYubikeyKey) configYubikey {
+		return configYubikey{Validation: yubikeyValidationLocal, Keys: keys, CounterFile: "counters.json"}
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		yubikey  configYubikey
+		err      string
+	}{
+		{"YubiCloud", "", configYubikey{}, ""},
+		{"unknown validation", "", configYubikey{Validation: "hsm"}, "Unknown yubikey.validation 'hsm'"},
+		{"servers", "1", configYubikey{Validation: yubikeyValidationServers, Servers: []string{"https://val1.example.com/wsapi/2.0/verify", "https://val2.example.com/wsapi/2.0/verify"}}, ""},
+		{"servers without credentials", "", configYubikey{Validation: yubikeyValidationServers, Servers: []string{"https://val.example.com/wsapi/2.0/verify"}}, "requires yubikeyClientID and yubikeySecret"},
+		{"no servers", "1", configYubikey{Validation: yubikeyValidationServers}, "requires a list of yubikey.servers"},
+		{"server not a URL", "1", configYubikey{Validation: yubikeyValidationServers, Servers: []string{"val.example.com"}}, "Invalid yubikey.servers URL 'val.example.com'"},
+		{"http and https servers", "1", configYubikey{Validation: yubikeyValidationServers, Servers: []string{"https://val1.example.com/", "http://val2.example.com/"}}, "must all use http or all use https"},
+		{"local", "", local(key), ""},
+		{"local key file", "", configYubikey{Validation: yubikeyValidationLocal, KeyFile: keyFile, CounterFile: "counters.json"}, ""},
+		{"no counter file", "", configYubikey{Validation: yubikeyValidationLocal, Keys: []configYubikeyKey{key}}, "requires a yubikey.counterFile"},
+		{"invalid public ID", "", local(configYubikeyKey{PublicID: "cccccc", PrivateID: testYubikeyPrivateID, AESKey: testYubikeyAESKey}), "Invalid Yubikey public ID 'cccccc'"},
+		{"key twice", "", local(key, key), "has more than one key"},
+		{"invalid private ID", "", local(configYubikeyKey{PublicID: testYubikeyID, PrivateID: "0102", AESKey: testYubikeyAESKey}), "Invalid private ID"},
+		{"invalid AES key", "", local(configYubikeyKey{PublicID: testYubikeyID, PrivateID: testYubikeyPrivateID, AESKey: "not hex"}), "Invalid AES key"},
+		{"invalid key file", "", configYubikey{Validation: yubikeyValidationLocal, KeyFile: badKeyFile, CounterFile: "counters.json"}, "expected publicID,privateID,aesKey"},
+		{"missing key file", "", configYubikey{Validation: yubikeyValidationLocal, KeyFile: keyFile + ".missing", CounterFile: "counters.json"}, "Unable to read yubikey.keyFile"},
+	}
+	for _, test := range tests {
+		cfg := &config{YubikeyClientID: test.clientID, YubikeySecret: test.clientID, Yubikey: test.yubikey}
+		err := validateYubikeyConfig(cfg)
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && err != nil {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLocalYubikeyValidator(t *testing.T) {
+	counterFile := filepath.Join(t.TempDir(), "counters.json")
+	v := newTestYubikeyValidator(t, counterFile)
+	otp := func(use uint16, session uint8) string {
+		return yubikeyOTP(testYubikeyID, testYubikeyPrivateID, testYubikeyAESKey, use, session)
+	}
+
+	tests := []struct {
+		name string
+		otp  string
+		err  string
+	}{
+		{"first OTP", otp(1, 0), ""},
+		{"replayed", otp(1, 0), "was already used"},
+		{"next of the session", otp(1, 1), ""},
+		{"of an earlier use", otp(0, 7), "was already used"},
+		{"of the next use", otp(2, 0), ""},
+		{"upper case", strings.ToUpper(otp(2, 1)), ""},
+		{"another AES key", yubikeyOTP(testYubikeyID, testYubikeyPrivateID, "0f0e0d0c0b0a09080706050403020100", 3, 0), "fails the CRC check"},
+		{"another private ID", yubikeyOTP(testYubikeyID, "a60504030201", testYubikeyAESKey, 3, 0), "has the wrong private ID"},
+		{"unknown Yubikey", yubikeyOTP("cccccccccccc", testYubikeyPrivateID, testYubikeyAESKey, 3, 0), "no AES key for Yubikey cccccccccccc"},
+		{"truncated", otp(3, 0)[:40], "OTP is not 44 characters long"},
+		{"not modhex", otp(3, 0)[:43] + "x", "invalid modhex character 'x'"},
+	}
+	for _, test := range tests {
+		ok, err := v.verify(test.otp)
+		if len(test.err) > 0 && (ok || err == nil || !strings.Contains(err.Error(), test.err)) || len(test.err) == 0 && (!ok || err != nil) {
+			t.Errorf("%s: %v %v, want %q", test.name, ok, err, test.err)
+		}
+	}
+
+	// the counters survive a restart
+	v = newTestYubikeyValidator(t, counterFile)
+	if ok, _ := v.verify(otp(2, 1)); ok {
+		t.Error("an OTP was replayed after a restart")
+	}
+	if ok, err := v.verify(otp(2, 2)); !ok {
+		t.Errorf("after a restart: %v", err)
+	}
+
+	// an OTP isn't accepted unless its counters are saved
+	v = newTestYubikeyValidator(t, filepath.Join(t.TempDir(), "missing", "counters.json"))
+	if ok, err := v.verify(otp(5, 0)); ok || err == nil || !strings.Contains(err.Error(), "unable to save Yubikey counters") {
+		t.Errorf("unsaved counters: %v %v", ok, err)
+	}
+	if len(v.counters) > 0 {
+		t.Errorf("counters %v kept without being saved", v.counters)
+	}
+}
+
+func TestBindYubikey(t *testing.T) {
+	audit := captureAudit(t)
+	cfg := &config{
+		Backend: configBackend{BaseDN: testBaseDN},
+		Users:   []configUser{{CommonName: "alice", UserPassword: testPasswordHash, Yubikey: testYubikeyID}},
+	}
+	h := newConfigHandler(cfg, newTestYubikeyValidator(t, filepath.Join(t.TempDir(), "counters.json"))).(configHandler)
+	otp := func(use uint16) string {
+		return yubikeyOTP(testYubikeyID, testYubikeyPrivateID, testYubikeyAESKey, use, 0)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		code     ldap.LDAPResultCode
+		outcome  string
+		reason   string
+		factors  string
+	}{
+		{"password and OTP", "secret" + otp(1), ldap.LDAPResultSuccess, bindOutcomeSuccess, "", "password,yubikey"},
+		{"replayed OTP", "secret" + otp(1), ldap.LDAPResultInvalidCredentials, bindOutcomeBadOTP, "invalid yubikey OTP", ""},
+		{"wrong password", "guess" + otp(2), ldap.LDAPResultInvalidCredentials, bindOutcomeBadPassword, "invalid password", ""},
+		{"OTP missing", "secret", ldap.LDAPResultInvalidCredentials, bindOutcomeBadOTP, "OTP missing", ""},
+		{"OTP of another Yubikey", "secret" + yubikeyOTP("cccccccccccc", testYubikeyPrivateID, testYubikeyAESKey, 3, 0), ldap.LDAPResultInvalidCredentials, bindOutcomeBadOTP, "OTP missing", ""},
+	}
+	for _, test := range tests {
+		code, rec := bind(t, h, audit, userDN("alice"), test.password, newTestConn(t))
+		if code != test.code || rec.Outcome != test.outcome || rec.Reason != test.reason || strings.Join(rec.Factors, ",") != test.factors {
+			t.Errorf("%s: %d %+v, want %d outcome %q reason %q factors %q", test.name, code, rec, test.code, test.outcome, test.reason, test.factors)
+		}
+	}
+}